@@ -0,0 +1,808 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/tuommaki/rollingdiff/export"
+	"github.com/tuommaki/rollingdiff/fastcdc"
+	"github.com/tuommaki/rollingdiff/history"
+	"github.com/tuommaki/rollingdiff/librsync"
+	"github.com/tuommaki/rollingdiff/report"
+	"github.com/tuommaki/rollingdiff/rollingdiff"
+	"github.com/tuommaki/rollingdiff/watch"
+)
+
+// paramsValue is a flag holding a single set of chunk size limits.
+type paramsValue struct {
+	params *fastcdc.Params
+}
+
+func (v paramsValue) String() string {
+	if v.params == nil {
+		return ""
+	}
+	return v.params.String()
+}
+
+func (v paramsValue) Set(value string) error {
+	p, err := parseParams(value)
+	if err != nil {
+		return err
+	}
+
+	*v.params = p
+	return nil
+}
+
+// chunkFlags registers flags selecting chunking in `fs`.
+func chunkFlags(fs *flag.FlagSet) *chunkOptions {
+	opts := &chunkOptions{Params: fastcdc.DefaultParams, Hash: "sha256"}
+	fs.Var(paramsValue{&opts.Params}, "params", "content defined chunk size limits as min:normal:max")
+	fs.IntVar(&opts.BlockSize, "block", 0, "split into fixed size blocks matched at any offset, librsync formats default to 2048")
+	return opts
+}
+
+// hashFlags registers flags selecting hashing of `opts` in `fs`.
+func hashFlags(fs *flag.FlagSet, opts *chunkOptions) {
+	fs.StringVar(&opts.Hash, "hash", "sha256", "strong hash, sha256 for native format, or blake2 or md4 for librsync format")
+	fs.StringVar(&opts.Rollsum, "rollsum", "rabinkarp", "rolling checksum of librsync format, rabinkarp or rsync")
+}
+
+// outputOptions selects format of reports.
+type outputOptions struct {
+	Format   string
+	Literals string
+}
+
+// outputFlags registers flags selecting output format in `fs`.
+func outputFlags(fs *flag.FlagSet) *outputOptions {
+	opts := &outputOptions{}
+	fs.StringVar(&opts.Format, "output", "text", "output format, text, json or jsonl")
+	fs.StringVar(&opts.Literals, "literals", "length", "literal data in JSON output, length or base64")
+	return opts
+}
+
+func (o outputOptions) validate() error {
+	switch o.Format {
+	case "text", "json", "jsonl":
+	default:
+		return fmt.Errorf("unknown output format %q", o.Format)
+	}
+
+	_, err := export.ParseLiterals(o.Literals)
+	return err
+}
+
+// writeJSON writes `v` to `w` as indented JSON.
+func writeJSON(w io.Writer, v interface{}) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// readInputs reads files at `paths`, with - standing for stdin.
+func readInputs(paths ...string) ([][]byte, error) {
+	stdin := false
+	data := make([][]byte, len(paths))
+	for i, path := range paths {
+		var err error
+		if path == "-" {
+			if stdin {
+				return nil, errors.New("only one input can be read from stdin")
+			}
+			stdin = true
+			data[i], err = ioutil.ReadAll(os.Stdin)
+		} else {
+			data[i], err = ioutil.ReadFile(path)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return data, nil
+}
+
+// writeOutput writes `data` to file at `path`, with - standing for stdout.
+func writeOutput(path string, data []byte) error {
+	if path == "-" {
+		_, err := os.Stdout.Write(data)
+		return err
+	}
+
+	return ioutil.WriteFile(path, data, 0666)
+}
+
+func signatureCmd(args []string) error {
+	fs := newFlagSet("signature", "FILE SIGFILE")
+	opts := chunkFlags(fs)
+	hashFlags(fs, opts)
+	out := outputFlags(fs)
+	if err := parseArgs(fs, args, 2); err != nil {
+		return err
+	}
+	if err := out.validate(); err != nil {
+		return err
+	}
+
+	in, err := readInputs(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	if out.Format != "text" {
+		// Chunk metadata is written instead of a signature file.
+		if opts.Hash != "sha256" {
+			return fmt.Errorf("%s output is not available for hash %s", out.Format, opts.Hash)
+		}
+
+		chunks := opts.chunker().Signatures(in[0])
+		var buf bytes.Buffer
+		if out.Format == "jsonl" {
+			err = export.WriteChunksLines(&buf, chunks)
+		} else {
+			err = writeJSON(&buf, export.Chunks(chunks))
+		}
+		if err != nil {
+			return err
+		}
+		return writeOutput(fs.Arg(1), buf.Bytes())
+	}
+
+	sig, err := makeSignature(in[0], *opts)
+	if err != nil {
+		return err
+	}
+
+	return writeOutput(fs.Arg(1), sig)
+}
+
+func deltaCmd(args []string) error {
+	fs := newFlagSet("delta", "SIGFILE NEWFILE DELTAFILE")
+	appendOnly := fs.Bool("append", false, "expect NEWFILE to be appended to, re-chunking only its end")
+	if err := parseArgs(fs, args, 3); err != nil {
+		return err
+	}
+
+	in, err := readInputs(fs.Arg(0), fs.Arg(1))
+	if err != nil {
+		return err
+	}
+
+	delta, err := makeDelta(in[0], in[1], *appendOnly)
+	if err != nil {
+		return fmt.Errorf("%s: %w", fs.Arg(0), err)
+	}
+
+	return writeOutput(fs.Arg(2), delta)
+}
+
+func patchCmd(args []string) error {
+	fs := newFlagSet("patch", "OLDFILE DELTAFILE OUTFILE")
+	if err := parseArgs(fs, args, 3); err != nil {
+		return err
+	}
+
+	in, err := readInputs(fs.Arg(0), fs.Arg(1))
+	if err != nil {
+		return err
+	}
+
+	data, err := applyDelta(in[0], in[1])
+	if err != nil {
+		return fmt.Errorf("%s: %w", fs.Arg(1), err)
+	}
+
+	return writeOutput(fs.Arg(2), data)
+}
+
+// deltaStats describes a delta computed by the stats command. Changes are
+// counted by operation, or by command for librsync deltas.
+type deltaStats struct {
+	OldSize       int            `json:"old_size"`
+	NewSize       int            `json:"new_size"`
+	ReusedBytes   int            `json:"reused_bytes"`
+	AddedBytes    int            `json:"added_bytes"`
+	DeletedBytes  int            `json:"deleted_bytes"`
+	Moves         int            `json:"moves"`
+	Changes       map[string]int `json:"changes"`
+	SignatureSize int            `json:"signature_size"`
+	DeltaSize     int            `json:"delta_size"`
+	// Ratio is the size of the delta relative to the new file.
+	Ratio float64 `json:"ratio"`
+}
+
+func statsCmd(args []string) error {
+	fs := newFlagSet("stats", "OLDFILE NEWFILE")
+	opts := chunkFlags(fs)
+	hashFlags(fs, opts)
+	out := outputFlags(fs)
+	if err := parseArgs(fs, args, 2); err != nil {
+		return err
+	}
+	if err := out.validate(); err != nil {
+		return err
+	}
+
+	in, err := readInputs(fs.Arg(0), fs.Arg(1))
+	if err != nil {
+		return err
+	}
+	oldData, newData := in[0], in[1]
+
+	sig, err := makeSignature(oldData, *opts)
+	if err != nil {
+		return err
+	}
+
+	delta, err := makeDelta(sig, newData, false)
+	if err != nil {
+		return err
+	}
+
+	st := deltaStats{
+		Changes:       make(map[string]int),
+		SignatureSize: len(sig),
+		DeltaSize:     len(delta),
+	}
+
+	var summary rollingdiff.Summary
+	if fileMagic(delta) == librsync.DeltaMagic {
+		cmds, err := librsync.ReadDelta(bytes.NewReader(delta))
+		if err != nil {
+			return err
+		}
+
+		summary = summarizeCommands(len(oldData), cmds)
+		for _, c := range cmds {
+			if c.Data != nil {
+				st.Changes["literal"]++
+			} else {
+				st.Changes["copy"]++
+			}
+		}
+	} else {
+		var f deltaFile
+		if err := decodeFile(delta, &f); err != nil {
+			return err
+		}
+
+		chunker := f.chunker()
+		summary = rollingdiff.Summarize(chunker.Signatures(oldData), chunker.Signatures(newData), f.Patch.Changes)
+		for _, c := range f.Patch.Changes {
+			st.Changes[c.Op.String()]++
+		}
+	}
+
+	st.OldSize, st.NewSize = summary.OldSize, summary.NewSize
+	st.ReusedBytes, st.AddedBytes, st.DeletedBytes = summary.Reused, summary.Added, summary.Deleted
+	st.Moves = summary.Moves
+	if st.NewSize > 0 {
+		st.Ratio = float64(st.DeltaSize) / float64(st.NewSize)
+	}
+
+	switch out.Format {
+	case "json":
+		return writeJSON(os.Stdout, st)
+	case "jsonl":
+		return json.NewEncoder(os.Stdout).Encode(st)
+	}
+
+	var names []string
+	for name := range st.Changes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var counts []string
+	for _, name := range names {
+		counts = append(counts, fmt.Sprintf("%d %s", st.Changes[name], name))
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "old size:\t%d\n", st.OldSize)
+	fmt.Fprintf(tw, "new size:\t%d\n", st.NewSize)
+	fmt.Fprintf(tw, "reused bytes:\t%d (%.1f%% of new)\n", st.ReusedBytes, percent(st.ReusedBytes, st.NewSize))
+	fmt.Fprintf(tw, "added bytes:\t%d (%.1f%% of new)\n", st.AddedBytes, percent(st.AddedBytes, st.NewSize))
+	fmt.Fprintf(tw, "deleted bytes:\t%d (%.1f%% of old)\n", st.DeletedBytes, percent(st.DeletedBytes, st.OldSize))
+	fmt.Fprintf(tw, "moves:\t%d\n", st.Moves)
+	fmt.Fprintf(tw, "changes:\t%s\n", strings.Join(counts, ", "))
+	fmt.Fprintf(tw, "signature size:\t%d\n", st.SignatureSize)
+	fmt.Fprintf(tw, "delta size:\t%d (%.2f%% of new)\n", st.DeltaSize, 100*st.Ratio)
+	return tw.Flush()
+}
+
+func percent(n, total int) float64 {
+	if total == 0 {
+		return 0
+	}
+	return 100 * float64(n) / float64(total)
+}
+
+// summarizeCommands accounts for bytes of librsync delta `cmds` applied to
+// old data of `oldSize` bytes. Copies from before the end of the previous
+// copy count as moves, and old data not copied at all as deleted.
+func summarizeCommands(oldSize int, cmds []librsync.Command) rollingdiff.Summary {
+	s := rollingdiff.Summary{OldSize: oldSize, Changes: len(cmds)}
+
+	var copies []librsync.Command
+	end := int64(0)
+	for _, c := range cmds {
+		if c.Data != nil {
+			s.Added += len(c.Data)
+			continue
+		}
+
+		s.Reused += int(c.Length)
+		if c.Offset < end {
+			s.Moves++
+		}
+		end = c.Offset + c.Length
+		copies = append(copies, c)
+	}
+	s.NewSize = s.Reused + s.Added
+
+	// Bytes of the old data covered by any copy.
+	sort.Slice(copies, func(i, j int) bool { return copies[i].Offset < copies[j].Offset })
+	covered, reach := int64(0), int64(0)
+	for _, c := range copies {
+		start, stop := c.Offset, c.Offset+c.Length
+		if start < reach {
+			start = reach
+		}
+		if stop > start {
+			covered += stop - start
+			reach = stop
+		}
+	}
+	s.Deleted = oldSize - int(covered)
+
+	return s
+}
+
+func diffCmd(args []string) error {
+	fs := newFlagSet("diff", "OLDFILE|OLDDIR NEWFILE|NEWDIR")
+	opts := chunkFlags(fs)
+	out := outputFlags(fs)
+	quiet := fs.Bool("quiet", false, "report only by exit status, stopping at the first differing chunk")
+	if err := parseArgs(fs, args, 2); err != nil {
+		return err
+	}
+	if err := out.validate(); err != nil {
+		return err
+	}
+
+	if isDir(fs.Arg(0)) && isDir(fs.Arg(1)) {
+		if out.Format != "text" && !*quiet {
+			return fmt.Errorf("%s output is not available for directories", out.Format)
+		}
+		return diffTrees(fs.Arg(0), fs.Arg(1), *quiet)
+	}
+
+	if *quiet {
+		same, err := sameFiles(fs.Arg(0), fs.Arg(1), opts.chunker())
+		if err != nil {
+			return err
+		}
+		if !same {
+			return errDiffer
+		}
+		return nil
+	}
+
+	in, err := readInputs(fs.Arg(0), fs.Arg(1))
+	if err != nil {
+		return err
+	}
+
+	chunker := opts.chunker()
+	oldChunks := chunker.Signatures(in[0])
+
+	var changes []rollingdiff.Change
+	if opts.BlockSize > 0 {
+		changes = rollingdiff.MatchBlocks(rollingdiff.BlockSignatures(oldChunks), in[1])
+	} else {
+		changes = rollingdiff.Delta(oldChunks, chunker.Signatures(in[1]))
+	}
+
+	lit, _ := export.ParseLiterals(out.Literals)
+	switch out.Format {
+	case "json":
+		err = writeJSON(os.Stdout, export.Changes(changes, lit))
+	case "jsonl":
+		err = export.WriteChangesLines(os.Stdout, changes, lit)
+	default:
+		for _, c := range changes {
+			fmt.Println(formatChange(c))
+		}
+	}
+
+	if err == nil && len(changes) > 0 {
+		return errDiffer
+	}
+	return err
+}
+
+// sameFiles reports whether files at `oldPath` and `newPath`, with - standing
+// for stdin, split into the same chunks. Both are read as streams, up to the
+// first differing chunk.
+func sameFiles(oldPath, newPath string, chunker rollingdiff.Chunker) (bool, error) {
+	if oldPath == "-" && newPath == "-" {
+		return false, errors.New("only one input can be read from stdin")
+	}
+
+	// Regular files of different sizes differ without reading them.
+	oldInfo, oldErr := os.Stat(oldPath)
+	newInfo, newErr := os.Stat(newPath)
+	if oldErr == nil && newErr == nil && oldInfo.Mode().IsRegular() && newInfo.Mode().IsRegular() && oldInfo.Size() != newInfo.Size() {
+		return false, nil
+	}
+
+	oldFile, err := openInput(oldPath)
+	if err != nil {
+		return false, err
+	}
+	defer oldFile.Close()
+
+	newFile, err := openInput(newPath)
+	if err != nil {
+		return false, err
+	}
+	defer newFile.Close()
+
+	oldReader, newReader := chunker.NewReader(oldFile), chunker.NewReader(newFile)
+	for {
+		oldChunk, oldErr := oldReader.Next()
+		if oldErr != nil && oldErr != io.EOF {
+			return false, oldErr
+		}
+
+		newChunk, newErr := newReader.Next()
+		if newErr != nil && newErr != io.EOF {
+			return false, newErr
+		}
+
+		if oldErr == io.EOF || newErr == io.EOF {
+			return oldErr == newErr, nil
+		}
+
+		if oldChunk.Signature != newChunk.Signature {
+			return false, nil
+		}
+	}
+}
+
+// openInput opens file at `path` for reading, with - standing for stdin.
+func openInput(path string) (io.ReadCloser, error) {
+	if path == "-" {
+		return ioutil.NopCloser(os.Stdin), nil
+	}
+	return os.Open(path)
+}
+
+func reportCmd(args []string) error {
+	fs := newFlagSet("report", "OLDFILE NEWFILE HTMLFILE")
+	params := fastcdc.DefaultParams
+	fs.Var(paramsValue{&params}, "params", "content defined chunk size limits as min:normal:max")
+	if err := parseArgs(fs, args, 3); err != nil {
+		return err
+	}
+
+	in, err := readInputs(fs.Arg(0), fs.Arg(1))
+	if err != nil {
+		return err
+	}
+
+	chunker := rollingdiff.Chunker{Params: params}
+	oldChunks := chunker.Signatures(in[0])
+	newChunks := chunker.Signatures(in[1])
+	changes := rollingdiff.Delta(oldChunks, newChunks)
+
+	var buf bytes.Buffer
+	r := report.New(fs.Arg(0), fs.Arg(1), oldChunks, newChunks, changes)
+	if err := r.WriteHTML(&buf); err != nil {
+		return err
+	}
+
+	return writeOutput(fs.Arg(2), buf.Bytes())
+}
+
+// errDone stops watching after the requested number of versions.
+var errDone = errors.New("done")
+
+func watchCmd(args []string) error {
+	fs := newFlagSet("watch", "FILE OUTDIR|-")
+	params := fastcdc.DefaultParams
+	fs.Var(paramsValue{&params}, "params", "content defined chunk size limits as min:normal:max")
+	interval := fs.Duration("interval", time.Second, "polling interval")
+	count := fs.Int("count", 0, "stop after emitting this many deltas, 0 for no limit")
+	if err := parseArgs(fs, args, 2); err != nil {
+		return err
+	}
+
+	out := fs.Arg(1)
+	if out != "-" {
+		if err := os.MkdirAll(out, 0777); err != nil {
+			return err
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	w := watch.New(fs.Arg(0), rollingdiff.Chunker{Params: params})
+	err := w.Run(ctx, *interval, func(v watch.Version) error {
+		delta, err := encodeFile(deltaMagic, &deltaFile{Params: params, Patch: v.Patch})
+		if err != nil {
+			return err
+		}
+
+		if out == "-" {
+			// Deltas on a stream are prefixed by their length.
+			var size [8]byte
+			binary.BigEndian.PutUint64(size[:], uint64(len(delta)))
+			if _, err := os.Stdout.Write(append(size[:], delta...)); err != nil {
+				return err
+			}
+		} else if err := writeOutput(filepath.Join(out, fmt.Sprintf("%06d.delta", v.Seq)), delta); err != nil {
+			return err
+		}
+
+		if *count > 0 && v.Seq >= *count {
+			return errDone
+		}
+		return nil
+	})
+
+	if errors.Is(err, errDone) || errors.Is(err, context.Canceled) {
+		return nil
+	}
+	return err
+}
+
+// formatChange describes `c` on a single line.
+func formatChange(c rollingdiff.Change) string {
+	switch c.Op {
+	case rollingdiff.Delete:
+		return fmt.Sprintf("delete %d", c.From)
+	case rollingdiff.Add:
+		return fmt.Sprintf("add %d (%d bytes)", c.To, len(c.Bytes))
+	case rollingdiff.Move:
+		return fmt.Sprintf("move %d -> %d", c.From, c.To)
+	case rollingdiff.Edit:
+		literal := 0
+		for _, p := range c.Parts {
+			literal += len(p.Bytes)
+		}
+		return fmt.Sprintf("edit %d from %d (%d parts, %d literal bytes)", c.To, c.From, len(c.Parts), literal)
+	}
+	return c.Op.String()
+}
+
+var historyCommands = map[string]func(args []string) error{
+	"add":     historyAddCmd,
+	"list":    historyListCmd,
+	"extract": historyExtractCmd,
+}
+
+func historyCmd(args []string) error {
+	if len(args) == 0 {
+		fmt.Fprintf(os.Stderr, "usage: %s history add|list|extract [flags] DIR ...\n", os.Args[0])
+		return errUsage
+	}
+
+	cmd, exists := historyCommands[args[0]]
+	if !exists {
+		fmt.Fprintf(os.Stderr, "%s: unknown history command %q\n", os.Args[0], args[0])
+		return errUsage
+	}
+	return cmd(args[1:])
+}
+
+func historyAddCmd(args []string) error {
+	fs := newFlagSet("history add", "DIR FILE")
+	opts := chunkFlags(fs)
+	interval := fs.Int("interval", history.DefaultBaseInterval, "store every nth version in full")
+	maxChain := fs.Int64("max-chain", 0, "store a version in full when deltas since the last full one exceed this many bytes, 0 for no limit")
+	if err := parseArgs(fs, args, 2); err != nil {
+		return err
+	}
+
+	// Flags only apply when the store is created.
+	s, err := history.Open(fs.Arg(0))
+	if errors.Is(err, os.ErrNotExist) {
+		s, err = history.Create(fs.Arg(0), history.Options{
+			Chunker:      opts.chunker(),
+			BaseInterval: *interval,
+			MaxChainSize: *maxChain,
+		})
+	}
+	if err != nil {
+		return err
+	}
+
+	in, err := readInputs(fs.Arg(1))
+	if err != nil {
+		return err
+	}
+
+	v, err := s.Add(in[0])
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("version %d: %s, %d bytes stored\n", v.Number, versionType(v), v.Stored)
+	return nil
+}
+
+func historyListCmd(args []string) error {
+	fs := newFlagSet("history list", "DIR")
+	if err := parseArgs(fs, args, 1); err != nil {
+		return err
+	}
+
+	s, err := history.Open(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "version\ttime\tsize\tstored\ttype\tchain\n")
+	for _, v := range s.Versions() {
+		chain, err := s.Chain(v.Number)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%d\t%d\t%s\t%d\n", v.Number, v.Time.Format(time.RFC3339), v.Size, v.Stored, versionType(v), len(chain))
+	}
+	return tw.Flush()
+}
+
+func historyExtractCmd(args []string) error {
+	fs := newFlagSet("history extract", "DIR VERSION OUTFILE")
+	if err := parseArgs(fs, args, 3); err != nil {
+		return err
+	}
+
+	n, err := strconv.Atoi(fs.Arg(1))
+	if err != nil {
+		return fmt.Errorf("invalid version %q", fs.Arg(1))
+	}
+
+	s, err := history.Open(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	data, err := s.Get(n)
+	if err != nil {
+		return err
+	}
+
+	return writeOutput(fs.Arg(2), data)
+}
+
+func versionType(v history.Version) string {
+	if v.Base {
+		return "full"
+	}
+	return "delta"
+}
+
+func verifyCmd(args []string) error {
+	fs := newFlagSet("verify", "SIGFILE FILE")
+	repair := fs.String("repair", "", "write FILE rebuilt from intact chunks found anywhere in it to this file")
+	if err := parseArgs(fs, args, 2); err != nil {
+		return err
+	}
+
+	in, err := readInputs(fs.Arg(0), fs.Arg(1))
+	if err != nil {
+		return err
+	}
+	data := in[1]
+
+	if fileMagic(in[0]) != sigMagic {
+		return fmt.Errorf("%s: %w in native format", fs.Arg(0), errNotSignature)
+	}
+	var f sigFile
+	if err := decodeFile(in[0], &f); err != nil {
+		return fmt.Errorf("%s: %w", fs.Arg(0), err)
+	}
+
+	// FILE is split where the signature expects its chunks. Data past the
+	// expected end is an orphaned chunk of its own.
+	manifest, size, err := f.chunks()
+	if err != nil {
+		return fmt.Errorf("%s: %w", fs.Arg(0), err)
+	}
+
+	var stored []rollingdiff.Chunk
+	for i, c := range manifest {
+		if c.Offset >= len(data) {
+			break
+		}
+
+		end := c.Offset + f.Blocks[i].Size
+		if end > len(data) {
+			end = len(data)
+		}
+		c.Bytes = data[c.Offset:end]
+		stored = append(stored, c)
+	}
+	if len(data) > size {
+		stored = append(stored, rollingdiff.Chunk{Bytes: data[size:], Index: len(f.Blocks), Offset: size, Signature: sha256.Sum256(data[size:])})
+	}
+
+	verr := &rollingdiff.VerifyError{}
+	if err := rollingdiff.VerifyManifest(manifest, stored); err != nil && !errors.As(err, &verr) {
+		return err
+	}
+
+	digest := sha256.Sum256(data)
+	if len(verr.Corrupted) == 0 && len(verr.Missing) == 0 && len(verr.Orphaned) == 0 && digest == f.Digest {
+		// Nothing to repair, but the file is still written as asked.
+		if *repair != "" {
+			return writeOutput(*repair, data)
+		}
+		return nil
+	}
+
+	for _, r := range []struct {
+		name    string
+		indexes []int
+	}{
+		{"corrupted", verr.Corrupted},
+		{"missing", verr.Missing},
+		{"orphaned", verr.Orphaned},
+	} {
+		if len(r.indexes) > 0 {
+			fmt.Printf("%s: %d chunks %v\n", r.name, len(r.indexes), r.indexes)
+		}
+	}
+	if digest != f.Digest {
+		// Chunks may all match when the signature itself is inconsistent.
+		fmt.Printf("digest mismatch: expected %x, got %x\n", f.Digest, digest)
+	}
+
+	if *repair != "" {
+		// Chunks displaced within FILE are found by chunking it again.
+		chunker := f.chunker()
+		repaired, err := rollingdiff.Repair(manifest, append(stored, chunker.Signatures(data)...))
+		if err != nil {
+			var missing *rollingdiff.VerifyError
+			if !errors.As(err, &missing) {
+				return err
+			}
+			fmt.Printf("cannot repair: content of %d chunks not found %v\n", len(missing.Missing), missing.Missing)
+			return errDiffer
+		}
+
+		var buf bytes.Buffer
+		for _, c := range repaired {
+			buf.Write(c.Bytes)
+		}
+		if err := writeOutput(*repair, buf.Bytes()); err != nil {
+			return err
+		}
+	}
+
+	return errDiffer
+}
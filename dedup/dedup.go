@@ -0,0 +1,251 @@
+// Package dedup analyzes how much storage could be saved by chunk level
+// deduplication.
+package dedup
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/bits"
+	"os"
+	"path/filepath"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/tuommaki/rollingdiff/fastcdc"
+	"github.com/tuommaki/rollingdiff/rollingdiff"
+)
+
+// Bucket counts chunks whose size falls within [Min, Max).
+type Bucket struct {
+	Min   int
+	Max   int
+	Count int
+}
+
+// Repeat describes a chunk that occurs more than once.
+type Repeat struct {
+	Signature [sha256.Size]byte
+	Size      int
+	Count     int
+}
+
+// Report is the result of deduplication analysis.
+type Report struct {
+	Params       fastcdc.Params
+	Files        int
+	TotalBytes   int64
+	UniqueBytes  int64
+	TotalChunks  int
+	UniqueChunks int
+	// Sizes is a histogram of chunk sizes in power of two buckets.
+	Sizes []Bucket
+	// Top lists the most frequently repeated chunks.
+	Top []Repeat
+}
+
+// Ratio returns deduplication ratio, i.e. how many times larger the total
+// data is compared to its unique chunks.
+func (r Report) Ratio() float64 {
+	if r.UniqueBytes == 0 {
+		return 1
+	}
+	return float64(r.TotalBytes) / float64(r.UniqueBytes)
+}
+
+// Savings returns the fraction of total bytes that deduplication removes.
+func (r Report) Savings() float64 {
+	if r.TotalBytes == 0 {
+		return 0
+	}
+	return 1 - float64(r.UniqueBytes)/float64(r.TotalBytes)
+}
+
+type chunkStat struct {
+	size  int
+	count int
+}
+
+// Analyzer accumulates chunk statistics over multiple inputs. Only chunk
+// signatures and sizes are retained, not the data itself.
+type Analyzer struct {
+	chunker rollingdiff.Chunker
+	files   int
+	total   int64
+	chunks  int
+	sizes   map[int]int
+	stats   map[[sha256.Size]byte]*chunkStat
+}
+
+// NewAnalyzer returns an Analyzer that splits data using chunk size limits of
+// `params`.
+func NewAnalyzer(params fastcdc.Params) *Analyzer {
+	return &Analyzer{
+		chunker: rollingdiff.Chunker{Params: params},
+		sizes:   make(map[int]int),
+		stats:   make(map[[sha256.Size]byte]*chunkStat),
+	}
+}
+
+// Add splits `data` into chunks and records them.
+func (a *Analyzer) Add(data []byte) {
+	a.files++
+	a.total += int64(len(data))
+
+	for _, c := range a.chunker.Signatures(data) {
+		a.chunks++
+		a.sizes[bits.Len(uint(len(c.Bytes)))]++
+
+		s, exists := a.stats[c.Signature]
+		if !exists {
+			s = &chunkStat{size: len(c.Bytes)}
+			a.stats[c.Signature] = s
+		}
+		s.count++
+	}
+}
+
+// Report returns statistics of all data added so far. At most `top` most
+// repeated chunks are listed, none if `top` is not positive.
+func (a *Analyzer) Report(top int) Report {
+	r := Report{
+		Params:       a.chunker.Params,
+		Files:        a.files,
+		TotalBytes:   a.total,
+		TotalChunks:  a.chunks,
+		UniqueChunks: len(a.stats),
+	}
+
+	for sig, s := range a.stats {
+		r.UniqueBytes += int64(s.size)
+		if s.count > 1 {
+			r.Top = append(r.Top, Repeat{Signature: sig, Size: s.size, Count: s.count})
+		}
+	}
+
+	sort.Slice(r.Top, func(i, j int) bool {
+		if r.Top[i].Count != r.Top[j].Count {
+			return r.Top[i].Count > r.Top[j].Count
+		}
+		if r.Top[i].Size != r.Top[j].Size {
+			return r.Top[i].Size > r.Top[j].Size
+		}
+		return string(r.Top[i].Signature[:]) < string(r.Top[j].Signature[:])
+	})
+	if top < 0 {
+		top = 0
+	}
+	if len(r.Top) > top {
+		r.Top = r.Top[:top]
+	}
+
+	var lens []int
+	for l := range a.sizes {
+		lens = append(lens, l)
+	}
+	sort.Ints(lens)
+	for _, l := range lens {
+		r.Sizes = append(r.Sizes, Bucket{
+			Min:   (1 << uint(l)) >> 1,
+			Max:   1 << uint(l),
+			Count: a.sizes[l],
+		})
+	}
+
+	return r
+}
+
+// Analyze runs analysis over regular files found in `paths`, descending into
+// directories, once for each of the given chunk size limits. At most `top`
+// most repeated chunks are listed in each report.
+func Analyze(paths []string, params []fastcdc.Params, top int) ([]Report, error) {
+	analyzers := make([]*Analyzer, len(params))
+	for i, p := range params {
+		if err := p.Validate(); err != nil {
+			return nil, err
+		}
+		analyzers[i] = NewAnalyzer(p)
+	}
+
+	for _, root := range paths {
+		err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+
+			if !info.Mode().IsRegular() {
+				return nil
+			}
+
+			data, err := ioutil.ReadFile(path)
+			if err != nil {
+				return err
+			}
+
+			for _, a := range analyzers {
+				a.Add(data)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	reports := make([]Report, len(analyzers))
+	for i, a := range analyzers {
+		reports[i] = a.Report(top)
+	}
+
+	return reports, nil
+}
+
+// WriteReports writes human readable reports to `w`, laying the summaries of
+// different chunk size limits side by side.
+func WriteReports(w io.Writer, reports []Report) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+
+	row := func(name string, value func(r Report) string) {
+		fmt.Fprintf(tw, "%s\t", name)
+		for _, r := range reports {
+			fmt.Fprintf(tw, "%s\t", value(r))
+		}
+		fmt.Fprintln(tw)
+	}
+
+	row("params (min:normal:max)", func(r Report) string { return r.Params.String() })
+	row("files", func(r Report) string { return fmt.Sprint(r.Files) })
+	row("total bytes", func(r Report) string { return fmt.Sprint(r.TotalBytes) })
+	row("unique bytes", func(r Report) string { return fmt.Sprint(r.UniqueBytes) })
+	row("dedup ratio", func(r Report) string { return fmt.Sprintf("%.3f", r.Ratio()) })
+	row("savings", func(r Report) string { return fmt.Sprintf("%.1f%%", 100*r.Savings()) })
+	row("total chunks", func(r Report) string { return fmt.Sprint(r.TotalChunks) })
+	row("unique chunks", func(r Report) string { return fmt.Sprint(r.UniqueChunks) })
+	row("average chunk", func(r Report) string {
+		if r.TotalChunks == 0 {
+			return "0"
+		}
+		return fmt.Sprint(r.TotalBytes / int64(r.TotalChunks))
+	})
+
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	for _, r := range reports {
+		fmt.Fprintf(w, "\nchunk sizes with params %s:\n", r.Params)
+		for _, b := range r.Sizes {
+			fmt.Fprintf(w, "  [%d, %d): %d\n", b.Min, b.Max, b.Count)
+		}
+
+		if len(r.Top) > 0 {
+			fmt.Fprintf(w, "most repeated chunks with params %s:\n", r.Params)
+			for _, t := range r.Top {
+				fmt.Fprintf(w, "  %x: %d x %d bytes\n", t.Signature[:8], t.Count, t.Size)
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,126 @@
+package dedup
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/tuommaki/rollingdiff/fastcdc"
+	"github.com/tuommaki/rollingdiff/internal/testutil"
+)
+
+func Test_Analyzer_Counts_Duplicate_Data_Once(t *testing.T) {
+	data := testutil.RandomBytes(t, 1, 8*fastcdc.MaxSize)
+
+	a := NewAnalyzer(fastcdc.DefaultParams)
+	a.Add(data)
+	a.Add(data)
+	a.Add(data)
+
+	r := a.Report(5)
+
+	if r.Files != 3 {
+		t.Fatalf("expected r.Files == 3, got %d", r.Files)
+	}
+
+	if r.TotalBytes != 3*int64(len(data)) {
+		t.Fatalf("expected r.TotalBytes == %d, got %d", 3*len(data), r.TotalBytes)
+	}
+
+	if r.UniqueBytes != int64(len(data)) {
+		t.Fatalf("expected r.UniqueBytes == %d, got %d", len(data), r.UniqueBytes)
+	}
+
+	if r.Ratio() != 3 {
+		t.Fatalf("expected r.Ratio() == 3, got %f", r.Ratio())
+	}
+
+	if r.TotalChunks != 3*r.UniqueChunks {
+		t.Fatalf("expected r.TotalChunks == 3 * r.UniqueChunks, got %d != 3 * %d", r.TotalChunks, r.UniqueChunks)
+	}
+
+	if len(r.Top) != 5 {
+		t.Fatalf("expected 5 top repeated chunks, got %d", len(r.Top))
+	}
+	for _, top := range r.Top {
+		if top.Count != 3 {
+			t.Fatalf("expected each chunk to repeat 3 times, got %d", top.Count)
+		}
+	}
+
+	count := 0
+	for _, b := range r.Sizes {
+		count += b.Count
+	}
+	if count != r.TotalChunks {
+		t.Fatalf("expected histogram to cover all %d chunks, got %d", r.TotalChunks, count)
+	}
+
+	for _, top := range []int{0, -1} {
+		if r := a.Report(top); len(r.Top) != 0 {
+			t.Fatalf("expected no top repeated chunks for top %d, got %d", top, len(r.Top))
+		}
+	}
+}
+
+func Test_Analyze_Compares_Params(t *testing.T) {
+	dir := t.TempDir()
+
+	base := testutil.RandomBytes(t, 1, 8*fastcdc.MaxSize)
+	modified := append(testutil.RandomBytes(t, 2, 100), base...)
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "a"), base, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "b"), modified, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	params := []fastcdc.Params{
+		fastcdc.DefaultParams,
+		{MinSize: 512, NormalSize: 2048, MaxSize: 8192},
+	}
+
+	reports, err := Analyze([]string{dir}, params, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(reports) != 2 {
+		t.Fatalf("expected 2 reports, got %d", len(reports))
+	}
+
+	for i, r := range reports {
+		if r.Params != params[i] {
+			t.Fatalf("expected reports[%d].Params == %v, got %v", i, params[i], r.Params)
+		}
+		if r.Files != 2 {
+			t.Fatalf("expected reports[%d].Files == 2, got %d", i, r.Files)
+		}
+		if r.Ratio() <= 1.5 {
+			t.Fatalf("expected reports[%d].Ratio() > 1.5, got %f", i, r.Ratio())
+		}
+	}
+
+	// Smaller chunks lose less data around the modification.
+	if reports[1].UniqueBytes >= reports[0].UniqueBytes {
+		t.Fatalf("expected smaller chunks to dedup better, got %d >= %d", reports[1].UniqueBytes, reports[0].UniqueBytes)
+	}
+
+	var buf bytes.Buffer
+	if err := WriteReports(&buf, reports); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "512:2048:8192") {
+		t.Fatalf("expected report to mention params, got:\n%s", buf.String())
+	}
+}
+
+func Test_Analyze_Rejects_Invalid_Params(t *testing.T) {
+	_, err := Analyze(nil, []fastcdc.Params{{MinSize: 4096, NormalSize: 1024, MaxSize: 8192}}, 10)
+	if err == nil {
+		t.Fatalf("expected error for invalid params")
+	}
+}
@@ -0,0 +1,330 @@
+// Package encrypt provides authenticated encryption of chunk payloads and
+// delta literals.
+//
+// Keys form a two level hierarchy: a master key, held by the user, wraps a
+// randomly generated data key which is stored alongside the encrypted data.
+// All actual encryption and chunk identification is done with subkeys derived
+// from the data key, so the master key can be rotated by re-wrapping the data
+// key without touching any stored chunk.
+package encrypt
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/tuommaki/rollingdiff/rollingdiff"
+)
+
+// KeySize is the size of both master and data keys in bytes.
+const KeySize = 32
+
+var (
+	// ErrIntegrity is returned when authentication of encrypted data fails,
+	// i.e. the ciphertext, its identifier or the key is not what it was at
+	// the time of encryption.
+	ErrIntegrity = errors.New("encrypt: integrity check failed")
+
+	// ErrKeySize is returned when a key of wrong length is given.
+	ErrKeySize = errors.New("encrypt: invalid key size")
+)
+
+// Labels used for deriving subkeys from the data key. These must never
+// change, otherwise previously stored data becomes unreadable.
+const (
+	labelEncryption = "rollingdiff/encrypt/v1/encryption"
+	labelIdentifier = "rollingdiff/encrypt/v1/identifier"
+	labelNonce      = "rollingdiff/encrypt/v1/nonce"
+)
+
+// Key is a data key with its derived subkeys.
+type Key struct {
+	aead     cipher.AEAD
+	idKey    []byte
+	nonceKey []byte
+}
+
+// GenerateMasterKey returns a new random master key.
+func GenerateMasterKey() ([]byte, error) {
+	return randomBytes(KeySize)
+}
+
+// NewDataKey generates a new random data key and returns it together with
+// its wrapped form, encrypted with `master`. The wrapped key is meant to be
+// stored next to the encrypted data.
+func NewDataKey(master []byte) (*Key, []byte, error) {
+	dataKey, err := randomBytes(KeySize)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	wrapped, err := wrapKey(master, dataKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	k, err := newKey(dataKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return k, wrapped, nil
+}
+
+// UnwrapDataKey decrypts a wrapped data key with `master`. ErrIntegrity is
+// returned if `master` is not the key that was used for wrapping.
+func UnwrapDataKey(master, wrapped []byte) (*Key, error) {
+	dataKey, err := unwrapKey(master, wrapped)
+	if err != nil {
+		return nil, err
+	}
+
+	return newKey(dataKey)
+}
+
+// RewrapDataKey re-encrypts a wrapped data key from `oldMaster` to
+// `newMaster`.
+func RewrapDataKey(oldMaster, newMaster, wrapped []byte) ([]byte, error) {
+	dataKey, err := unwrapKey(oldMaster, wrapped)
+	if err != nil {
+		return nil, err
+	}
+
+	return wrapKey(newMaster, dataKey)
+}
+
+// ID computes keyed identifier for `plaintext`. Unlike plain SHA-256
+// signature, the identifier does not reveal anything about the content to
+// someone not holding the data key.
+func (k *Key) ID(plaintext []byte) [sha256.Size]byte {
+	var id [sha256.Size]byte
+	copy(id[:], mac(k.idKey, plaintext))
+	return id
+}
+
+// Seal encrypts `plaintext` and returns its keyed identifier together with
+// the ciphertext.
+//
+// Nonce is derived from the plaintext with a keyed PRF, which makes the
+// encryption deterministic: same plaintext always results in same ciphertext
+// and identifier. This is what allows deduplication of encrypted chunks, and
+// since a nonce is only ever repeated for an identical message, it does not
+// weaken AES-GCM.
+func (k *Key) Seal(plaintext []byte) ([sha256.Size]byte, []byte) {
+	id := k.ID(plaintext)
+	nonce := mac(k.nonceKey, plaintext)[:k.aead.NonceSize()]
+
+	ciphertext := make([]byte, len(nonce), len(nonce)+len(plaintext)+k.aead.Overhead())
+	copy(ciphertext, nonce)
+	ciphertext = k.aead.Seal(ciphertext, nonce, plaintext, id[:])
+
+	return id, ciphertext
+}
+
+// Open decrypts and authenticates `ciphertext` sealed with identifier `id`.
+// ErrIntegrity is returned if the ciphertext was modified, it does not belong
+// to `id`, or it was sealed with another data key.
+func (k *Key) Open(id [sha256.Size]byte, ciphertext []byte) ([]byte, error) {
+	if len(ciphertext) < k.aead.NonceSize() {
+		return nil, fmt.Errorf("%x: %w", id, ErrIntegrity)
+	}
+
+	nonce, ciphertext := ciphertext[:k.aead.NonceSize()], ciphertext[k.aead.NonceSize():]
+	plaintext, err := k.aead.Open(nil, nonce, ciphertext, id[:])
+	if err != nil {
+		return nil, fmt.Errorf("%x: %w", id, ErrIntegrity)
+	}
+
+	// Additional AEAD would already catch any tampering with the identifier,
+	// but verify that the content matches it as well.
+	if k.ID(plaintext) != id {
+		return nil, fmt.Errorf("%x: %w", id, ErrIntegrity)
+	}
+
+	return plaintext, nil
+}
+
+// SealChunks returns copy of `chunks` where each chunk's Bytes are encrypted
+// and Signature is replaced with keyed identifier.
+func (k *Key) SealChunks(chunks []rollingdiff.Chunk) []rollingdiff.Chunk {
+	sealed := make([]rollingdiff.Chunk, len(chunks))
+	for i, c := range chunks {
+		c.Signature, c.Bytes = k.Seal(c.Bytes)
+		sealed[i] = c
+	}
+
+	return sealed
+}
+
+// OpenChunks reverses SealChunks. The returned chunks carry plain SHA-256
+// signatures of the decrypted content.
+func (k *Key) OpenChunks(chunks []rollingdiff.Chunk) ([]rollingdiff.Chunk, error) {
+	opened := make([]rollingdiff.Chunk, len(chunks))
+	for i, c := range chunks {
+		plaintext, err := k.Open(c.Signature, c.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("chunk %d: %w", c.Index, err)
+		}
+
+		c.Bytes = plaintext
+		c.Signature = sha256.Sum256(plaintext)
+		opened[i] = c
+	}
+
+	return opened, nil
+}
+
+// SealChanges returns copy of `changes` where literal data of Add changes
+// and inserts of Edit changes is encrypted. Keyed identifier of each literal
+// is prepended to the encrypted bytes.
+func (k *Key) SealChanges(changes []rollingdiff.Change) []rollingdiff.Change {
+	sealed := make([]rollingdiff.Change, len(changes))
+	for i, c := range changes {
+		switch c.Op {
+		case rollingdiff.Add:
+			c.Bytes = k.sealLiteral(c.Bytes)
+		case rollingdiff.Edit:
+			parts := make([]rollingdiff.Part, len(c.Parts))
+			for j, p := range c.Parts {
+				if p.Bytes != nil {
+					p.Bytes = k.sealLiteral(p.Bytes)
+				}
+				parts[j] = p
+			}
+			c.Parts = parts
+		}
+		sealed[i] = c
+	}
+
+	return sealed
+}
+
+// OpenChanges reverses SealChanges.
+func (k *Key) OpenChanges(changes []rollingdiff.Change) ([]rollingdiff.Change, error) {
+	opened := make([]rollingdiff.Change, len(changes))
+	for i, c := range changes {
+		switch c.Op {
+		case rollingdiff.Add:
+			plaintext, err := k.openLiteral(c.Bytes)
+			if err != nil {
+				return nil, fmt.Errorf("change %d: %w", i, err)
+			}
+			c.Bytes = plaintext
+		case rollingdiff.Edit:
+			parts := make([]rollingdiff.Part, len(c.Parts))
+			for j, p := range c.Parts {
+				if p.Bytes != nil {
+					plaintext, err := k.openLiteral(p.Bytes)
+					if err != nil {
+						return nil, fmt.Errorf("change %d: part %d: %w", i, j, err)
+					}
+					p.Bytes = plaintext
+				}
+				parts[j] = p
+			}
+			c.Parts = parts
+		}
+		opened[i] = c
+	}
+
+	return opened, nil
+}
+
+func (k *Key) sealLiteral(plaintext []byte) []byte {
+	id, ciphertext := k.Seal(plaintext)
+	return append(id[:], ciphertext...)
+}
+
+func (k *Key) openLiteral(sealed []byte) ([]byte, error) {
+	if len(sealed) < sha256.Size {
+		return nil, ErrIntegrity
+	}
+
+	var id [sha256.Size]byte
+	copy(id[:], sealed)
+
+	return k.Open(id, sealed[sha256.Size:])
+}
+
+func newKey(dataKey []byte) (*Key, error) {
+	if len(dataKey) != KeySize {
+		return nil, ErrKeySize
+	}
+
+	aead, err := newAEAD(mac(dataKey, []byte(labelEncryption)))
+	if err != nil {
+		return nil, err
+	}
+
+	return &Key{
+		aead:     aead,
+		idKey:    mac(dataKey, []byte(labelIdentifier)),
+		nonceKey: mac(dataKey, []byte(labelNonce)),
+	}, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	if len(key) != KeySize {
+		return nil, ErrKeySize
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+func wrapKey(master, dataKey []byte) ([]byte, error) {
+	aead, err := newAEAD(master)
+	if err != nil {
+		return nil, err
+	}
+
+	// Data keys are random, hence a random nonce is used for wrapping.
+	nonce, err := randomBytes(aead.NonceSize())
+	if err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(nonce, nonce, dataKey, []byte(labelEncryption)), nil
+}
+
+func unwrapKey(master, wrapped []byte) ([]byte, error) {
+	aead, err := newAEAD(master)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(wrapped) < aead.NonceSize() {
+		return nil, fmt.Errorf("data key: %w", ErrIntegrity)
+	}
+
+	nonce, ciphertext := wrapped[:aead.NonceSize()], wrapped[aead.NonceSize():]
+	dataKey, err := aead.Open(nil, nonce, ciphertext, []byte(labelEncryption))
+	if err != nil {
+		return nil, fmt.Errorf("data key: %w", ErrIntegrity)
+	}
+
+	return dataKey, nil
+}
+
+func mac(key, data []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+func randomBytes(n int) ([]byte, error) {
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(rand.Reader, buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
@@ -0,0 +1,188 @@
+package encrypt
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/tuommaki/rollingdiff/fastcdc"
+	"github.com/tuommaki/rollingdiff/internal/testutil"
+	"github.com/tuommaki/rollingdiff/rollingdiff"
+)
+
+func testKey(t *testing.T) ([]byte, *Key, []byte) {
+	t.Helper()
+
+	master, err := GenerateMasterKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	k, wrapped, err := NewDataKey(master)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return master, k, wrapped
+}
+
+func Test_Seal_Open_Roundtrip(t *testing.T) {
+	_, k, _ := testKey(t)
+	data := testutil.RandomBytes(t, 1, 1024)
+
+	id, ciphertext := k.Seal(data)
+	if bytes.Contains(ciphertext, data[:64]) {
+		t.Fatalf("expected ciphertext not to contain plaintext")
+	}
+
+	plaintext, err := k.Open(id, ciphertext)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(data, plaintext) {
+		t.Fatalf("expected plaintext == data")
+	}
+}
+
+func Test_Seal_Is_Deterministic(t *testing.T) {
+	_, k, _ := testKey(t)
+	data := testutil.RandomBytes(t, 1, 1024)
+
+	id1, ciphertext1 := k.Seal(data)
+	id2, ciphertext2 := k.Seal(data)
+
+	if id1 != id2 || !bytes.Equal(ciphertext1, ciphertext2) {
+		t.Fatalf("expected sealing same plaintext twice to produce same result")
+	}
+}
+
+func Test_ID_Is_Keyed(t *testing.T) {
+	_, k1, _ := testKey(t)
+	_, k2, _ := testKey(t)
+	data := testutil.RandomBytes(t, 1, 1024)
+
+	if k1.ID(data) == k2.ID(data) {
+		t.Fatalf("expected identifiers with different keys to differ")
+	}
+}
+
+func Test_Open_Detects_Tampering(t *testing.T) {
+	_, k, _ := testKey(t)
+	_, other, _ := testKey(t)
+	data := testutil.RandomBytes(t, 1, 1024)
+
+	id, ciphertext := k.Seal(data)
+
+	tampered := append([]byte{}, ciphertext...)
+	tampered[len(tampered)/2] ^= 0x01
+	if _, err := k.Open(id, tampered); !errors.Is(err, ErrIntegrity) {
+		t.Fatalf("expected ErrIntegrity for modified ciphertext, got %v", err)
+	}
+
+	wrongID := id
+	wrongID[0] ^= 0x01
+	if _, err := k.Open(wrongID, ciphertext); !errors.Is(err, ErrIntegrity) {
+		t.Fatalf("expected ErrIntegrity for wrong identifier, got %v", err)
+	}
+
+	if _, err := other.Open(id, ciphertext); !errors.Is(err, ErrIntegrity) {
+		t.Fatalf("expected ErrIntegrity for wrong key, got %v", err)
+	}
+
+	if _, err := k.Open(id, ciphertext[:4]); !errors.Is(err, ErrIntegrity) {
+		t.Fatalf("expected ErrIntegrity for truncated ciphertext, got %v", err)
+	}
+}
+
+func Test_Data_Key_Wrapping(t *testing.T) {
+	master, k, wrapped := testKey(t)
+	data := testutil.RandomBytes(t, 1, 1024)
+	id, ciphertext := k.Seal(data)
+
+	unwrapped, err := UnwrapDataKey(master, wrapped)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := unwrapped.Open(id, ciphertext); err != nil {
+		t.Fatalf("expected unwrapped key to open data, got %v", err)
+	}
+
+	wrongMaster, _ := GenerateMasterKey()
+	if _, err := UnwrapDataKey(wrongMaster, wrapped); !errors.Is(err, ErrIntegrity) {
+		t.Fatalf("expected ErrIntegrity for wrong master key, got %v", err)
+	}
+
+	rewrapped, err := RewrapDataKey(master, wrongMaster, wrapped)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	unwrapped, err = UnwrapDataKey(wrongMaster, rewrapped)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := unwrapped.Open(id, ciphertext); err != nil {
+		t.Fatalf("expected rewrapped key to open data, got %v", err)
+	}
+}
+
+func Test_Sealed_Chunks_And_Changes(t *testing.T) {
+	_, k, _ := testKey(t)
+
+	oldData := testutil.RandomBytes(t, 1, 4*fastcdc.MaxSize)
+	newData := append(testutil.RandomBytes(t, 2, fastcdc.MaxSize)[:fastcdc.MinSize], oldData...)
+
+	oldChunks := rollingdiff.Signatures(oldData)
+	newChunks := rollingdiff.Signatures(newData)
+
+	sealedOld := k.SealChunks(oldChunks)
+	sealedNew := k.SealChunks(newChunks)
+
+	for i := range sealedOld {
+		if sealedOld[i].Signature == oldChunks[i].Signature {
+			t.Fatalf("expected sealed chunk %d to not reveal plain signature", i)
+		}
+	}
+
+	opened, err := k.OpenChunks(sealedOld)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range opened {
+		if opened[i].Signature != oldChunks[i].Signature || !bytes.Equal(opened[i].Bytes, oldChunks[i].Bytes) {
+			t.Fatalf("expected opened chunk %d to equal original", i)
+		}
+	}
+
+	// Keyed identifiers are deterministic, so delta can be computed over
+	// sealed chunks as well.
+	plainChanges := rollingdiff.Delta(oldChunks, newChunks)
+	sealedChanges := rollingdiff.Delta(sealedOld, sealedNew)
+	if len(plainChanges) != len(sealedChanges) {
+		t.Fatalf("expected len(plainChanges) == len(sealedChanges), got %d != %d", len(plainChanges), len(sealedChanges))
+	}
+
+	changes := k.SealChanges(plainChanges)
+	openedChanges, err := k.OpenChanges(changes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range openedChanges {
+		if !bytes.Equal(openedChanges[i].Bytes, plainChanges[i].Bytes) {
+			t.Fatalf("expected opened change %d to equal original", i)
+		}
+	}
+
+	for i := range changes {
+		if changes[i].Op == rollingdiff.Add {
+			changes[i].Bytes[len(changes[i].Bytes)-1] ^= 0x01
+			break
+		}
+	}
+	if _, err := k.OpenChanges(changes); !errors.Is(err, ErrIntegrity) {
+		t.Fatalf("expected ErrIntegrity for modified change, got %v", err)
+	}
+}
@@ -0,0 +1,149 @@
+// Package export encodes chunk lists and deltas as JSON, or as JSON Lines
+// for streaming, for consumption by other programs. Operations are encoded
+// by name and digests as hex strings.
+package export
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/tuommaki/rollingdiff/rollingdiff"
+)
+
+// Literals selects how literal data of changes is encoded.
+type Literals int
+
+const (
+	// Summarize leaves literal data out, keeping only its length.
+	Summarize Literals = iota
+	// Embed includes literal data encoded as base64.
+	Embed
+)
+
+// ParseLiterals parses literal encoding by name, "length" or "base64".
+func ParseLiterals(name string) (Literals, error) {
+	switch name {
+	case "length":
+		return Summarize, nil
+	case "base64":
+		return Embed, nil
+	}
+	return 0, fmt.Errorf("export: unknown literal encoding %q", name)
+}
+
+// Chunk is the metadata of a chunk, without its content.
+type Chunk struct {
+	Index     int    `json:"index"`
+	Offset    int    `json:"offset"`
+	Size      int    `json:"size"`
+	Signature string `json:"signature"`
+}
+
+// Part is a byte-level operation of an edit, either "copy" or "insert".
+// Offset is always zero for inserts.
+type Part struct {
+	Op     string `json:"op"`
+	Offset int    `json:"offset"`
+	Length int    `json:"length"`
+	Bytes  []byte `json:"bytes,omitempty"`
+}
+
+// Change is a single change of a delta. Only chunk indexes meaningful for
+// the operation are set. Size is the length of literal data of added
+// chunks.
+type Change struct {
+	Op    string `json:"op"`
+	From  *int   `json:"from,omitempty"`
+	To    *int   `json:"to,omitempty"`
+	Size  int    `json:"size,omitempty"`
+	Bytes []byte `json:"bytes,omitempty"`
+	Parts []Part `json:"parts,omitempty"`
+}
+
+// NewChunk returns the metadata of `c`.
+func NewChunk(c rollingdiff.Chunk) Chunk {
+	return Chunk{
+		Index:     c.Index,
+		Offset:    c.Offset,
+		Size:      len(c.Bytes),
+		Signature: hex.EncodeToString(c.Signature[:]),
+	}
+}
+
+// NewChange returns `c` with its literal data encoded as selected by `lit`.
+func NewChange(c rollingdiff.Change, lit Literals) Change {
+	from, to := c.From, c.To
+	e := Change{Op: c.Op.String()}
+
+	switch c.Op {
+	case rollingdiff.Delete:
+		e.From = &from
+	case rollingdiff.Add:
+		e.To = &to
+		e.Size = len(c.Bytes)
+		if lit == Embed {
+			e.Bytes = c.Bytes
+		}
+	case rollingdiff.Move, rollingdiff.Edit:
+		e.From, e.To = &from, &to
+	}
+
+	for _, p := range c.Parts {
+		if p.Bytes == nil {
+			e.Parts = append(e.Parts, Part{Op: "copy", Offset: p.Offset, Length: p.Length})
+			continue
+		}
+
+		part := Part{Op: "insert", Length: len(p.Bytes)}
+		if lit == Embed {
+			part.Bytes = p.Bytes
+		}
+		e.Parts = append(e.Parts, part)
+	}
+
+	return e
+}
+
+// Chunks returns metadata of all `chunks`.
+func Chunks(chunks []rollingdiff.Chunk) []Chunk {
+	out := make([]Chunk, len(chunks))
+	for i, c := range chunks {
+		out[i] = NewChunk(c)
+	}
+	return out
+}
+
+// Changes encodes all `changes` as selected by `lit`.
+func Changes(changes []rollingdiff.Change, lit Literals) []Change {
+	out := make([]Change, len(changes))
+	for i, c := range changes {
+		out[i] = NewChange(c, lit)
+	}
+	return out
+}
+
+// WriteChunksLines writes metadata of `chunks` to `w` as JSON Lines, one
+// chunk per line.
+func WriteChunksLines(w io.Writer, chunks []rollingdiff.Chunk) error {
+	enc := json.NewEncoder(w)
+	for _, c := range chunks {
+		if err := enc.Encode(NewChunk(c)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteChangesLines writes `changes` to `w` as JSON Lines, one change per
+// line.
+func WriteChangesLines(w io.Writer, changes []rollingdiff.Change, lit Literals) error {
+	enc := json.NewEncoder(w)
+	for _, c := range changes {
+		if err := enc.Encode(NewChange(c, lit)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
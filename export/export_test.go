@@ -0,0 +1,111 @@
+package export
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/tuommaki/rollingdiff/rollingdiff"
+)
+
+func Test_Changes_Encoding(t *testing.T) {
+	testCases := []struct {
+		name     string
+		change   rollingdiff.Change
+		lit      Literals
+		expected string
+	}{
+		{
+			name:     "delete",
+			change:   rollingdiff.Change{Op: rollingdiff.Delete, From: 3},
+			expected: `{"op":"delete","from":3}`,
+		},
+		{
+			name:     "add summarized",
+			change:   rollingdiff.Change{Op: rollingdiff.Add, To: 0, Bytes: []byte("hello")},
+			expected: `{"op":"add","to":0,"size":5}`,
+		},
+		{
+			name:     "add embedded",
+			change:   rollingdiff.Change{Op: rollingdiff.Add, To: 1, Bytes: []byte("hello")},
+			lit:      Embed,
+			expected: `{"op":"add","to":1,"size":5,"bytes":"aGVsbG8="}`,
+		},
+		{
+			name:     "move",
+			change:   rollingdiff.Change{Op: rollingdiff.Move, From: 0, To: 2},
+			expected: `{"op":"move","from":0,"to":2}`,
+		},
+		{
+			name: "edit embedded",
+			change: rollingdiff.Change{Op: rollingdiff.Edit, From: 1, To: 1, Parts: []rollingdiff.Part{
+				{Offset: 0, Length: 10},
+				{Bytes: []byte("hi")},
+				{Offset: 12, Length: 100},
+			}},
+			lit:      Embed,
+			expected: `{"op":"edit","from":1,"to":1,"parts":[{"op":"copy","offset":0,"length":10},{"op":"insert","offset":0,"length":2,"bytes":"aGk="},{"op":"copy","offset":12,"length":100}]}`,
+		},
+	}
+
+	for i, tc := range testCases {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			t.Logf(tc.name)
+
+			got, err := json.Marshal(NewChange(tc.change, tc.lit))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if string(got) != tc.expected {
+				t.Fatalf("expected %s, got %s", tc.expected, got)
+			}
+		})
+	}
+}
+
+func Test_Chunks_Encoding(t *testing.T) {
+	data := []byte("hello")
+	c := rollingdiff.Chunk{Bytes: data, Index: 2, Offset: 100, Signature: sha256.Sum256(data)}
+
+	got, err := json.Marshal(Chunks([]rollingdiff.Chunk{c}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `[{"index":2,"offset":100,"size":5,"signature":"2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"}]`
+	if string(got) != expected {
+		t.Fatalf("expected %s, got %s", expected, got)
+	}
+}
+
+func Test_WriteChangesLines_Writes_Line_Per_Change(t *testing.T) {
+	changes := []rollingdiff.Change{
+		{Op: rollingdiff.Delete, From: 0},
+		{Op: rollingdiff.Add, To: 0, Bytes: []byte("a")},
+		{Op: rollingdiff.Move, From: 1, To: 2},
+	}
+
+	var buf bytes.Buffer
+	if err := WriteChangesLines(&buf, changes, Summarize); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if len(lines) != len(changes) {
+		t.Fatalf("expected %d lines, got %d", len(changes), len(lines))
+	}
+
+	for i, line := range lines {
+		var c Change
+		if err := json.Unmarshal([]byte(line), &c); err != nil {
+			t.Fatal(err)
+		}
+		if c.Op != changes[i].Op.String() {
+			t.Fatalf("expected op %s on line %d, got %s", changes[i].Op, i, c.Op)
+		}
+	}
+}
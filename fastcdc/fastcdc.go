@@ -2,6 +2,11 @@
 // For original paper, see: https://www.usenix.org/conference/atc16/technical-sessions/presentation/xia
 package fastcdc
 
+import (
+	"fmt"
+	"math/bits"
+)
+
 // Following table is generated with (using crypto/rand):
 //
 // 	max := big.NewInt(0)
@@ -92,41 +97,111 @@ const (
 	maskA uint64 = 0x0000d90303530000
 	maskL uint64 = 0x0000d90003530000
 
-	MinSize int = (1 << 11) // 2^11 = 2KB
-	MaxSize int = (1 << 16) // 2^16 = 64KB
+	MinSize    int = (1 << 11) // 2^11 = 2KB
+	NormalSize int = (1 << 13) // 2^13 = 8KB
+	MaxSize    int = (1 << 16) // 2^16 = 64KB
 )
 
+// Params define chunk size limits. Chunks are cut at content defined
+// boundaries between MinSize and MaxSize, normalized around NormalSize.
+type Params struct {
+	MinSize    int
+	NormalSize int
+	MaxSize    int
+}
+
+// DefaultParams are the chunk size limits used by Compute.
+var DefaultParams = Params{
+	MinSize:    MinSize,
+	NormalSize: NormalSize,
+	MaxSize:    MaxSize,
+}
+
+// Validate checks that the size limits are in order and NormalSize is a
+// power of two.
+func (p Params) Validate() error {
+	if p.MinSize < 64 || p.MinSize > p.NormalSize || p.NormalSize > p.MaxSize {
+		return fmt.Errorf("fastcdc: invalid chunk sizes: min %d, normal %d, max %d", p.MinSize, p.NormalSize, p.MaxSize)
+	}
+
+	if p.NormalSize&(p.NormalSize-1) != 0 {
+		return fmt.Errorf("fastcdc: normal chunk size %d is not a power of two", p.NormalSize)
+	}
+
+	return nil
+}
+
+func (p Params) String() string {
+	return fmt.Sprintf("%d:%d:%d", p.MinSize, p.NormalSize, p.MaxSize)
+}
+
 // Compute calculates chunk boundary over `buf` and returns index of last byte
 // of a chunk.
 func Compute(buf []byte) int {
+	return DefaultParams.Compute(buf)
+}
+
+// Compute calculates chunk boundary over `buf` using chunk size limits of `p`
+// and returns index of last byte of a chunk.
+func (p Params) Compute(buf []byte) int {
 	fp := uint64(0)
-	i := MinSize
+	i := p.MinSize
 	n := len(buf)
-	normalSize := int(1 << 13) // 2^13 = 8KB
+	normalSize := p.NormalSize
+	smallMask, largeMask := p.masks()
 
-	if n <= MinSize {
+	if n <= p.MinSize {
 		return n
 	}
 
-	if n >= MaxSize {
-		n = MaxSize
+	if n >= p.MaxSize {
+		n = p.MaxSize
 	} else if n <= normalSize {
 		normalSize = n
 	}
 
 	for ; i < normalSize; i++ {
 		fp = (fp << 1) + gear[buf[i]]
-		if (fp & maskS) == 0 {
+		if (fp & smallMask) == 0 {
 			return i
 		}
 	}
 
 	for ; i < n; i++ {
 		fp = (fp << 1) + gear[buf[i]]
-		if (fp & maskL) == 0 {
+		if (fp & largeMask) == 0 {
 			return i
 		}
 	}
 
 	return i
 }
+
+// masks returns masks used before and after reaching normal chunk size.
+// Following FastCDC normalization level 2, they have two bits more and two
+// bits less than log2(NormalSize).
+func (p Params) masks() (uint64, uint64) {
+	n := bits.Len(uint(p.NormalSize)) - 1
+
+	// Hand picked masks of default parameters are kept, so that chunk
+	// boundaries stay the same.
+	if n == 13 {
+		return maskS, maskL
+	}
+
+	return spreadMask(n + 2), spreadMask(n - 2)
+}
+
+// spreadMask returns a mask with `n` bits set, spread evenly over the upper
+// 48 bits of the fingerprint.
+func spreadMask(n int) uint64 {
+	if n < 1 {
+		return 0
+	}
+
+	var mask uint64
+	for i := 0; i < n; i++ {
+		mask |= 1 << uint(63-i*48/n)
+	}
+	return mask
+}
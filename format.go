@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+
+	"github.com/tuommaki/rollingdiff/fastcdc"
+	"github.com/tuommaki/rollingdiff/librsync"
+	"github.com/tuommaki/rollingdiff/rollingdiff"
+)
+
+// Native signature and delta files start with a magic number followed by a
+// gob encoded body. Files in librsync format are told apart by their own
+// magic numbers.
+const (
+	sigMagic   uint32 = 0x72640153
+	deltaMagic uint32 = 0x72640144
+)
+
+var (
+	errNotSignature = errors.New("not a signature file")
+	errNotDelta     = errors.New("not a delta file")
+)
+
+type sigFile struct {
+	Params    fastcdc.Params
+	BlockSize int
+	// Digest is SHA-256 of the whole file.
+	Digest [sha256.Size]byte
+	Blocks []rollingdiff.BlockSignature
+}
+
+type deltaFile struct {
+	Params    fastcdc.Params
+	BlockSize int
+	Patch     rollingdiff.Patch
+}
+
+func (f *sigFile) chunker() rollingdiff.Chunker {
+	return rollingdiff.Chunker{Params: f.Params, BlockSize: f.BlockSize}
+}
+
+// chunks returns chunks of the file described by the signature, with their
+// offsets but without content, and the size of the file.
+func (f *sigFile) chunks() ([]rollingdiff.Chunk, int, error) {
+	chunks := make([]rollingdiff.Chunk, len(f.Blocks))
+	size := 0
+	for i, b := range f.Blocks {
+		if b.Index != i || b.Size <= 0 {
+			return nil, 0, fmt.Errorf("malformed file: block %d has index %d and size %d", i, b.Index, b.Size)
+		}
+		chunks[i] = rollingdiff.Chunk{Index: b.Index, Offset: size, Signature: b.Signature}
+		size += b.Size
+	}
+	return chunks, size, nil
+}
+
+func (f *deltaFile) chunker() rollingdiff.Chunker {
+	return rollingdiff.Chunker{Params: f.Params, BlockSize: f.BlockSize}
+}
+
+// chunkOptions selects how files are split and hashed.
+type chunkOptions struct {
+	Params    fastcdc.Params
+	BlockSize int
+	Hash      string
+	Rollsum   string
+}
+
+func (o chunkOptions) chunker() rollingdiff.Chunker {
+	return rollingdiff.Chunker{Params: o.Params, BlockSize: o.BlockSize}
+}
+
+// librsyncMagic returns the signature magic of librsync format selected by
+// the options, or zero for the native format.
+func (o chunkOptions) librsyncMagic() (uint32, error) {
+	if o.Hash == "sha256" {
+		return 0, nil
+	}
+
+	if o.Rollsum != "rsync" && o.Rollsum != "rabinkarp" {
+		return 0, fmt.Errorf("unknown rolling checksum %q", o.Rollsum)
+	}
+	rabinKarp := o.Rollsum == "rabinkarp"
+
+	switch o.Hash {
+	case "md4":
+		if rabinKarp {
+			return librsync.RabinKarpMD4Magic, nil
+		}
+		return librsync.MD4SigMagic, nil
+	case "blake2":
+		if rabinKarp {
+			return librsync.RabinKarpBlake2Magic, nil
+		}
+		return librsync.Blake2SigMagic, nil
+	}
+	return 0, fmt.Errorf("unknown hash %q", o.Hash)
+}
+
+func fileMagic(data []byte) uint32 {
+	if len(data) < 4 {
+		return 0
+	}
+	return binary.BigEndian.Uint32(data)
+}
+
+func encodeFile(magic uint32, v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, magic)
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decodeFile decodes the body of a native file into `v` and validates it.
+func decodeFile(data []byte, v interface{ chunker() rollingdiff.Chunker }) error {
+	if err := gob.NewDecoder(bytes.NewReader(data[4:])).Decode(v); err != nil {
+		return fmt.Errorf("malformed file: %v", err)
+	}
+	if err := v.chunker().Validate(); err != nil {
+		return fmt.Errorf("malformed file: %v", err)
+	}
+	return nil
+}
+
+// makeSignature computes signature file of `data`.
+func makeSignature(data []byte, opts chunkOptions) ([]byte, error) {
+	magic, err := opts.librsyncMagic()
+	if err != nil {
+		return nil, err
+	}
+
+	if magic != 0 {
+		blockLen := opts.BlockSize
+		if blockLen == 0 {
+			blockLen = librsync.DefaultBlockLen
+		}
+
+		sig, err := librsync.NewSignature(data, magic, blockLen, 0)
+		if err != nil {
+			return nil, err
+		}
+
+		var buf bytes.Buffer
+		if _, err := sig.WriteTo(&buf); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+
+	if err := opts.chunker().Validate(); err != nil {
+		return nil, err
+	}
+
+	f := sigFile{
+		Params:    opts.Params,
+		BlockSize: opts.BlockSize,
+		Digest:    sha256.Sum256(data),
+		Blocks:    rollingdiff.BlockSignatures(opts.chunker().Signatures(data)),
+	}
+	return encodeFile(sigMagic, &f)
+}
+
+// makeDelta computes delta file turning data described by signature file
+// `sig` into `data`. Format of the delta follows the signature. With
+// `appendOnly`, data is expected to be appended to, falling back to a full
+// delta if it was not.
+func makeDelta(sig, data []byte, appendOnly bool) ([]byte, error) {
+	switch fileMagic(sig) {
+	case sigMagic:
+	case librsync.MD4SigMagic, librsync.Blake2SigMagic, librsync.RabinKarpMD4Magic, librsync.RabinKarpBlake2Magic:
+		if appendOnly {
+			return nil, errors.New("append mode needs a signature in native format")
+		}
+
+		s, err := librsync.ReadSignature(bytes.NewReader(sig))
+		if err != nil {
+			return nil, err
+		}
+
+		var buf bytes.Buffer
+		if err := librsync.Delta(&buf, s, data); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	default:
+		return nil, errNotSignature
+	}
+
+	var f sigFile
+	if err := decodeFile(sig, &f); err != nil {
+		return nil, err
+	}
+
+	src, size, err := f.chunks()
+	if err != nil {
+		return nil, err
+	}
+	chunker := f.chunker()
+
+	var changes []rollingdiff.Change
+	appended := false
+	if appendOnly {
+		// Data modified elsewhere than at its end gets a full delta.
+		_, changes, err = chunker.AppendDelta(src, size, data)
+		appended = err == nil
+	}
+
+	switch {
+	case appended:
+	case f.BlockSize > 0:
+		changes = rollingdiff.MatchBlocks(f.Blocks, data)
+	default:
+		changes = rollingdiff.Delta(src, chunker.Signatures(data))
+	}
+
+	d := deltaFile{
+		Params:    f.Params,
+		BlockSize: f.BlockSize,
+		Patch: rollingdiff.Patch{
+			Base:    f.Digest,
+			Result:  sha256.Sum256(data),
+			Changes: changes,
+		},
+	}
+	return encodeFile(deltaMagic, &d)
+}
+
+// applyDelta applies delta file `delta` to `old` and returns the new data.
+func applyDelta(old, delta []byte) ([]byte, error) {
+	switch fileMagic(delta) {
+	case deltaMagic:
+	case librsync.DeltaMagic:
+		var buf bytes.Buffer
+		if err := librsync.Patch(&buf, bytes.NewReader(old), bytes.NewReader(delta)); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	default:
+		return nil, errNotDelta
+	}
+
+	var f deltaFile
+	if err := decodeFile(delta, &f); err != nil {
+		return nil, err
+	}
+
+	src := f.chunker().Signatures(old)
+	return f.Patch.Apply(src)
+}
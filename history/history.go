@@ -0,0 +1,332 @@
+// Package history stores versions of a file in a directory as chains of
+// deltas. Every chain starts from a version stored in full, a base, which
+// bounds the number of deltas applied to reconstruct any version.
+package history
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/tuommaki/rollingdiff/rollingdiff"
+)
+
+// DefaultBaseInterval is used when Options.BaseInterval is not set.
+const DefaultBaseInterval = 16
+
+const (
+	// indexName is the name of the file listing versions in a store
+	// directory.
+	indexName = "index"
+	// lastName is the name of the file caching chunks of the last version.
+	lastName = "last"
+)
+
+var (
+	// ErrExist is returned by Create when a store already exists.
+	ErrExist = errors.New("history: store already exists")
+	// ErrNoVersion is returned for versions not in the store.
+	ErrNoVersion = errors.New("history: no such version")
+	// ErrCorrupted is returned when a stored base does not match its
+	// digest, or when the index is not consistent. Corrupted deltas are
+	// reported by rollingdiff.Patch.
+	ErrCorrupted = errors.New("history: stored version is corrupted")
+)
+
+// Options control when versions are stored in full. They are fixed when the
+// store is created.
+type Options struct {
+	Chunker rollingdiff.Chunker
+	// BaseInterval stores every BaseInterval-th version in full, so that at
+	// most BaseInterval-1 deltas are applied to reconstruct a version.
+	BaseInterval int
+	// MaxChainSize, when set, also starts a new base when deltas stored
+	// since the last base would exceed MaxChainSize bytes.
+	MaxChainSize int64
+}
+
+// Version describes a stored version.
+type Version struct {
+	// Number numbers versions starting from 1.
+	Number int
+	Size   int64
+	Digest [sha256.Size]byte
+	// Base is set for versions stored in full. Other versions are stored
+	// as a delta from the previous version.
+	Base bool
+	// Stored is the number of bytes the version takes in the store.
+	Stored int64
+	Time   time.Time
+}
+
+type index struct {
+	Options  Options
+	Versions []Version
+}
+
+// last caches chunks of the last version, with their content, so that the
+// next version is diffed against it without reconstructing and chunking it
+// again.
+type last struct {
+	Number int
+	Chunks []rollingdiff.Chunk
+}
+
+// Store is a version history kept in a directory.
+type Store struct {
+	dir string
+	idx index
+}
+
+// Create creates an empty store in directory `dir`, creating the directory
+// if needed.
+func Create(dir string, opts Options) (*Store, error) {
+	if _, err := os.Stat(filepath.Join(dir, indexName)); err == nil {
+		return nil, fmt.Errorf("%w: %s", ErrExist, dir)
+	}
+
+	if err := opts.Chunker.Validate(); err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return nil, err
+	}
+
+	if opts.BaseInterval <= 0 {
+		opts.BaseInterval = DefaultBaseInterval
+	}
+
+	s := &Store{dir: dir, idx: index{Options: opts}}
+	if err := s.writeIndex(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Open opens an existing store in directory `dir`.
+func Open(dir string) (*Store, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, indexName))
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Store{dir: dir}
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&s.idx); err != nil {
+		return nil, fmt.Errorf("%s: malformed index: %v", dir, err)
+	}
+
+	// Every chain needs a base to start from, and chunking options are used
+	// on data as they are.
+	if s.idx.Options.BaseInterval <= 0 {
+		return nil, fmt.Errorf("%w: %s: invalid base interval %d", ErrCorrupted, dir, s.idx.Options.BaseInterval)
+	}
+	if err := s.idx.Options.Chunker.Validate(); err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", ErrCorrupted, dir, err)
+	}
+	if len(s.idx.Versions) > 0 && !s.idx.Versions[0].Base {
+		return nil, fmt.Errorf("%w: %s: first version is not stored in full", ErrCorrupted, dir)
+	}
+	return s, nil
+}
+
+// Options returns the options the store was created with.
+func (s *Store) Options() Options {
+	return s.idx.Options
+}
+
+// Versions lists stored versions, the oldest first.
+func (s *Store) Versions() []Version {
+	return append([]Version{}, s.idx.Versions...)
+}
+
+// Add stores `data` as the next version. It is stored as a delta from the
+// previous version, unless a new base is due or the delta would not be
+// smaller than `data`.
+func (s *Store) Add(data []byte) (Version, error) {
+	v := Version{
+		Number: len(s.idx.Versions) + 1,
+		Size:   int64(len(data)),
+		Digest: sha256.Sum256(data),
+		Base:   true,
+		Time:   time.Now(),
+	}
+
+	chunks := s.idx.Options.Chunker.Signatures(data)
+
+	content := data
+	if chainLen, chainSize := s.chain(); chainLen > 0 && chainLen < s.idx.Options.BaseInterval {
+		delta, err := s.delta(chunks)
+		if err != nil {
+			return Version{}, err
+		}
+
+		max := s.idx.Options.MaxChainSize
+		if len(delta) < len(data) && (max <= 0 || chainSize+int64(len(delta)) <= max) {
+			content = delta
+			v.Base = false
+		}
+	}
+	v.Stored = int64(len(content))
+
+	if err := ioutil.WriteFile(s.path(v), content, 0666); err != nil {
+		return Version{}, err
+	}
+
+	// A cache left ahead of the index by a failed write below no longer
+	// matches the last version and is not used.
+	if err := s.writeFile(lastName, &last{Number: v.Number, Chunks: chunks}); err != nil {
+		return Version{}, err
+	}
+
+	s.idx.Versions = append(s.idx.Versions, v)
+	if err := s.writeIndex(); err != nil {
+		s.idx.Versions = s.idx.Versions[:len(s.idx.Versions)-1]
+		return Version{}, err
+	}
+
+	return v, nil
+}
+
+// chain returns the number of versions since the last base, including it,
+// and the size of deltas stored after it.
+func (s *Store) chain() (int, int64) {
+	n, size := 0, int64(0)
+	for i := len(s.idx.Versions) - 1; i >= 0; i-- {
+		n++
+		if s.idx.Versions[i].Base {
+			break
+		}
+		size += s.idx.Versions[i].Stored
+	}
+	return n, size
+}
+
+// lastChunks returns chunks of the last version, from the cache if it
+// matches the last version, and otherwise by reconstructing it.
+func (s *Store) lastChunks() ([]rollingdiff.Chunk, error) {
+	v := s.idx.Versions[len(s.idx.Versions)-1]
+
+	var l last
+	data, err := ioutil.ReadFile(filepath.Join(s.dir, lastName))
+	if err == nil && gob.NewDecoder(bytes.NewReader(data)).Decode(&l) == nil &&
+		l.Number == v.Number && rollingdiff.Digest(l.Chunks) == v.Digest {
+		return l.Chunks, nil
+	}
+
+	prev, err := s.Get(v.Number)
+	if err != nil {
+		return nil, err
+	}
+	return s.idx.Options.Chunker.Signatures(prev), nil
+}
+
+// delta encodes a patch from the last version to chunks `dst`.
+func (s *Store) delta(dst []rollingdiff.Chunk) ([]byte, error) {
+	src, err := s.lastChunks()
+	if err != nil {
+		return nil, err
+	}
+
+	patch := rollingdiff.NewPatch(src, dst)
+
+	patch.Changes, err = rollingdiff.Refine(src, patch.Changes)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(&patch); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Chain returns versions read to reconstruct version `n`: the closest base
+// at or before it, followed by the deltas up to it.
+func (s *Store) Chain(n int) ([]Version, error) {
+	if n < 1 || n > len(s.idx.Versions) {
+		return nil, fmt.Errorf("%w: %d", ErrNoVersion, n)
+	}
+
+	base := n
+	for !s.idx.Versions[base-1].Base {
+		base--
+		if base == 0 {
+			return nil, fmt.Errorf("%w: no base before version %d", ErrCorrupted, n)
+		}
+	}
+	return append([]Version{}, s.idx.Versions[base-1:n]...), nil
+}
+
+// Get reconstructs version `n`.
+func (s *Store) Get(n int) ([]byte, error) {
+	chain, err := s.Chain(n)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := ioutil.ReadFile(s.path(chain[0]))
+	if err != nil {
+		return nil, err
+	}
+	if sha256.Sum256(data) != chain[0].Digest {
+		return nil, fmt.Errorf("%w: version %d", ErrCorrupted, chain[0].Number)
+	}
+
+	chunker := s.idx.Options.Chunker
+	for _, v := range chain[1:] {
+		delta, err := ioutil.ReadFile(s.path(v))
+		if err != nil {
+			return nil, err
+		}
+
+		var patch rollingdiff.Patch
+		if err := gob.NewDecoder(bytes.NewReader(delta)).Decode(&patch); err != nil {
+			return nil, fmt.Errorf("%w: version %d: %v", ErrCorrupted, v.Number, err)
+		}
+
+		data, err = patch.Apply(chunker.Signatures(data))
+		if err != nil {
+			return nil, fmt.Errorf("version %d: %w", v.Number, err)
+		}
+	}
+
+	return data, nil
+}
+
+// path returns the path of the file storing `v`.
+func (s *Store) path(v Version) string {
+	ext := "delta"
+	if v.Base {
+		ext = "base"
+	}
+	return filepath.Join(s.dir, fmt.Sprintf("%06d.%s", v.Number, ext))
+}
+
+// writeIndex replaces the index, so that an interrupted write leaves the
+// previous one intact.
+func (s *Store) writeIndex() error {
+	return s.writeFile(indexName, &s.idx)
+}
+
+// writeFile replaces file `name` of the store with `v` encoded, so that an
+// interrupted write leaves the previous one intact.
+func (s *Store) writeFile(name string, v interface{}) error {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return err
+	}
+
+	tmp := filepath.Join(s.dir, name+".tmp")
+	if err := ioutil.WriteFile(tmp, buf.Bytes(), 0666); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(s.dir, name))
+}
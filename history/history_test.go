@@ -0,0 +1,200 @@
+package history
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/tuommaki/rollingdiff/fastcdc"
+	"github.com/tuommaki/rollingdiff/internal/testutil"
+)
+
+// versions returns `n` versions of data, each with a small edit of the
+// previous one.
+func versions(t *testing.T, n int) [][]byte {
+	t.Helper()
+
+	data := testutil.RandomBytes(t, 1, 8*fastcdc.MaxSize)
+	rng := testutil.Rand(t, 2)
+
+	var all [][]byte
+	for i := 0; i < n; i++ {
+		data = append([]byte{}, data...)
+		rng.Read(data[rng.Intn(len(data)-100):][:100])
+		all = append(all, data)
+	}
+	return all
+}
+
+func Test_Store_Reconstructs_Every_Version(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "history")
+	s, err := Create(dir, Options{BaseInterval: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	all := versions(t, 25)
+	for i, data := range all {
+		v, err := s.Add(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expected := i%10 == 0
+		if v.Number != i+1 || v.Base != expected {
+			t.Fatalf("expected version %d with base %v, got %d with base %v", i+1, expected, v.Number, v.Base)
+		}
+		if !v.Base && v.Stored >= v.Size/10 {
+			t.Fatalf("expected delta of version %d smaller than %d bytes, got %d", v.Number, v.Size/10, v.Stored)
+		}
+	}
+
+	// Reopened store reads versions from disk.
+	s, err = Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(s.Versions()); n != len(all) {
+		t.Fatalf("expected %d versions, got %d", len(all), n)
+	}
+
+	for i, expected := range all {
+		data, err := s.Get(i + 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, expected) {
+			t.Fatalf("expected content of version %d", i+1)
+		}
+	}
+
+	chain, err := s.Chain(15)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chain) != 5 || chain[0].Number != 11 || !chain[0].Base {
+		t.Fatalf("expected chain of 5 versions from base 11, got %+v", chain)
+	}
+}
+
+func Test_Store_Starts_Base_When_Chain_Grows_Too_Large(t *testing.T) {
+	s, err := Create(t.TempDir(), Options{MaxChainSize: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, data := range versions(t, 3) {
+		v, err := s.Add(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !v.Base {
+			t.Fatalf("expected version %d to be stored in full", v.Number)
+		}
+	}
+}
+
+func Test_Store_Errors(t *testing.T) {
+	dir := t.TempDir()
+	s, err := Create(dir, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Create(dir, Options{}); !errors.Is(err, ErrExist) {
+		t.Fatalf("expected ErrExist, got %v", err)
+	}
+
+	v, err := s.Add([]byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.Get(2); !errors.Is(err, ErrNoVersion) {
+		t.Fatalf("expected ErrNoVersion, got %v", err)
+	}
+
+	if err := ioutil.WriteFile(s.path(v), []byte("world"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Get(1); !errors.Is(err, ErrCorrupted) {
+		t.Fatalf("expected ErrCorrupted, got %v", err)
+	}
+}
+
+func Test_Store_Adds_Delta_From_Cached_Last_Version(t *testing.T) {
+	dir := t.TempDir()
+	s, err := Create(dir, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	all := versions(t, 3)
+	v, err := s.Add(all[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The previous version is not read back to diff against it.
+	if err := os.Remove(s.path(v)); err != nil {
+		t.Fatal(err)
+	}
+	if v, err = s.Add(all[1]); err != nil {
+		t.Fatal(err)
+	}
+	if v.Base {
+		t.Fatalf("expected version %d to be stored as a delta", v.Number)
+	}
+
+	// Without the cache, the previous version is reconstructed.
+	if err := os.Remove(filepath.Join(dir, lastName)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Add(all[2]); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected os.ErrNotExist, got %v", err)
+	}
+}
+
+func Test_Open_Rejects_Inconsistent_Index(t *testing.T) {
+	testCases := []struct {
+		name   string
+		modify func(idx *index)
+	}{
+		{name: "first version not a base", modify: func(idx *index) { idx.Versions[0].Base = false }},
+		{name: "zero base interval", modify: func(idx *index) { idx.Options.BaseInterval = 0 }},
+		{name: "invalid chunk sizes", modify: func(idx *index) {
+			idx.Options.Chunker.Params = fastcdc.Params{MinSize: -5, NormalSize: 1024, MaxSize: 4096}
+		}},
+		{name: "negative block size", modify: func(idx *index) { idx.Options.Chunker.BlockSize = -1 }},
+	}
+
+	for i, tc := range testCases {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			t.Logf(tc.name)
+
+			dir := t.TempDir()
+			s, err := Create(dir, Options{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, data := range versions(t, 2) {
+				if _, err := s.Add(data); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			tc.modify(&s.idx)
+			if err := s.writeIndex(); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := Open(dir); !errors.Is(err, ErrCorrupted) {
+				t.Fatalf("expected ErrCorrupted, got %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,327 @@
+package httpsync
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/tuommaki/rollingdiff/patch"
+	"github.com/tuommaki/rollingdiff/rollingdiff"
+)
+
+// ErrDigestMismatch is returned when downloaded or assembled data does not
+// match its digest.
+var ErrDigestMismatch = errors.New("httpsync: digest mismatch")
+
+// Stats describe a completed fetch.
+type Stats struct {
+	ReusedBytes     int
+	DownloadedBytes int
+	Downloads       int
+}
+
+// Client fetches files served by Handler.
+type Client struct {
+	// URL is the location Handler is mounted at.
+	URL string
+	// HTTPClient is used for requests. http.DefaultClient is used if nil.
+	HTTPClient *http.Client
+	// Parallel is the number of concurrent chunk downloads. One is used if
+	// zero.
+	Parallel int
+}
+
+// Index downloads the index of the served file.
+func (c *Client) Index(ctx context.Context) (Index, error) {
+	var idx Index
+
+	body, err := c.get(ctx, IndexPath)
+	if err != nil {
+		return idx, err
+	}
+	defer body.Close()
+
+	if err := json.NewDecoder(body).Decode(&idx); err != nil {
+		return idx, err
+	}
+
+	if err := idx.Validate(); err != nil {
+		return idx, err
+	}
+
+	return idx, nil
+}
+
+// Fetch assembles the served file reusing chunks found in `old` and
+// downloading the rest.
+func (c *Client) Fetch(ctx context.Context, old []byte) ([]byte, Stats, error) {
+	var stats Stats
+
+	idx, err := c.Index(ctx)
+	if err != nil {
+		return nil, stats, err
+	}
+
+	local := localChunks(idx, old)
+
+	var missing []string
+	for _, ch := range idx.Chunks {
+		if _, exists := local[ch.Signature]; !exists {
+			local[ch.Signature] = nil
+			missing = append(missing, ch.Signature)
+		}
+	}
+
+	err = c.download(ctx, missing, func(sig string, data []byte) error {
+		local[sig] = data
+		stats.Downloads++
+		stats.DownloadedBytes += len(data)
+		return nil
+	})
+	if err != nil {
+		return nil, stats, err
+	}
+
+	data, err := assemble(idx, local)
+	if err != nil {
+		return nil, stats, err
+	}
+	stats.ReusedBytes = len(data) - stats.DownloadedBytes
+
+	return data, stats, nil
+}
+
+// FetchFile is like Fetch, but writes the file to `path`. An interrupted
+// fetch to the same path is resumed, downloading only the chunks that were not
+// written yet.
+func (c *Client) FetchFile(ctx context.Context, old []byte, path string) (Stats, error) {
+	var stats Stats
+
+	idx, err := c.Index(ctx)
+	if err != nil {
+		return stats, err
+	}
+
+	w, err := resume(path, idx)
+	if err != nil {
+		return stats, err
+	}
+	defer w.Close()
+
+	local := localChunks(idx, old)
+
+	pending := make(map[string][]int)
+	var missing []string
+	for _, i := range w.Pending() {
+		sig := idx.Chunks[i].Signature
+		if data, exists := local[sig]; exists {
+			if err := w.Write(i, data); err != nil {
+				return stats, err
+			}
+			stats.ReusedBytes += len(data)
+			continue
+		}
+
+		if _, exists := pending[sig]; !exists {
+			missing = append(missing, sig)
+		}
+		pending[sig] = append(pending[sig], i)
+	}
+
+	err = c.download(ctx, missing, func(sig string, data []byte) error {
+		stats.Downloads++
+		stats.DownloadedBytes += len(data)
+		for _, i := range pending[sig] {
+			if err := w.Write(i, data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return stats, err
+	}
+
+	return stats, w.Commit()
+}
+
+// download fetches chunks with given signatures concurrently, verifies their
+// content and passes them to `fn`. Calls to `fn` are serialized.
+func (c *Client) download(ctx context.Context, signatures []string, fn func(signature string, data []byte) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	parallel := c.Parallel
+	if parallel < 1 {
+		parallel = 1
+	}
+
+	type result struct {
+		signature string
+		data      []byte
+		err       error
+	}
+
+	jobs := make(chan string)
+	results := make(chan result)
+
+	var wg sync.WaitGroup
+	for i := 0; i < parallel; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for sig := range jobs {
+				data, err := c.chunk(ctx, sig)
+				results <- result{signature: sig, data: data, err: err}
+			}
+		}()
+	}
+
+	go func() {
+		defer close(jobs)
+		for _, sig := range signatures {
+			select {
+			case jobs <- sig:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	var firstErr error
+	for r := range results {
+		if firstErr != nil {
+			continue
+		}
+
+		err := r.err
+		if err == nil {
+			err = fn(r.signature, r.data)
+		}
+
+		if err != nil {
+			firstErr = err
+			cancel()
+		}
+	}
+
+	return firstErr
+}
+
+func (c *Client) chunk(ctx context.Context, signature string) ([]byte, error) {
+	body, err := c.get(ctx, ChunksPath+signature)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := verifyChunk(signature, data); err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
+
+func (c *Client) get(ctx context.Context, path string) (io.ReadCloser, error) {
+	resp, err := get(ctx, c.HTTPClient, strings.TrimSuffix(c.URL, "/")+path, "")
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// resume starts or continues writing file described by `idx` to `path`.
+func resume(path string, idx Index) (*patch.Writer, error) {
+	targets := make([]patch.Target, len(idx.Chunks))
+	for i, ch := range idx.Chunks {
+		sig, err := hex.DecodeString(ch.Signature)
+		if err != nil || len(sig) != sha256.Size {
+			return nil, fmt.Errorf("httpsync: invalid signature of chunk %d: %q", i, ch.Signature)
+		}
+
+		targets[i] = patch.Target{Offset: ch.Offset, Size: ch.Size}
+		copy(targets[i].Signature[:], sig)
+	}
+
+	return patch.Resume(path, targets)
+}
+
+// localChunks splits `old` into chunks following parameters of `idx` and
+// returns their content by hex encoded signature.
+func localChunks(idx Index, old []byte) map[string][]byte {
+	local := make(map[string][]byte)
+	for _, ch := range (rollingdiff.Chunker{Params: idx.Params}).Signatures(old) {
+		local[hex.EncodeToString(ch.Signature[:])] = ch.Bytes
+	}
+	return local
+}
+
+// assemble concatenates chunks listed in `idx` and verifies the result.
+func assemble(idx Index, chunks map[string][]byte) ([]byte, error) {
+	data := make([]byte, 0, idx.Size)
+	for _, ch := range idx.Chunks {
+		data = append(data, chunks[ch.Signature]...)
+	}
+
+	digest := sha256.Sum256(data)
+	if hex.EncodeToString(digest[:]) != idx.Digest {
+		return nil, ErrDigestMismatch
+	}
+
+	return data, nil
+}
+
+func verifyChunk(signature string, data []byte) error {
+	digest := sha256.Sum256(data)
+	if hex.EncodeToString(digest[:]) != signature {
+		return fmt.Errorf("chunk %s: %w", signature, ErrDigestMismatch)
+	}
+	return nil
+}
+
+// get issues a GET request for `url`, optionally limited to byte range
+// `rng`. Response is returned only on success.
+func get(ctx context.Context, hc *http.Client, url, rng string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if rng != "" {
+		req.Header.Set("Range", rng)
+	}
+
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+
+	resp, err := hc.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		resp.Body.Close()
+		return nil, fmt.Errorf("httpsync: GET %s: %s", url, resp.Status)
+	}
+
+	return resp, nil
+}
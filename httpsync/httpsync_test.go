@@ -0,0 +1,207 @@
+package httpsync
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/tuommaki/rollingdiff/fastcdc"
+	"github.com/tuommaki/rollingdiff/internal/testutil"
+	"github.com/tuommaki/rollingdiff/rollingdiff"
+)
+
+func newServer(t *testing.T, data []byte, chunkRequests *int32) *httptest.Server {
+	t.Helper()
+
+	h, err := NewHandler(data, rollingdiff.Chunker{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/files/new/", http.StripPrefix("/files/new", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, ChunksPath) {
+			atomic.AddInt32(chunkRequests, 1)
+		}
+		h.ServeHTTP(w, r)
+	})))
+
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func Test_Fetch_Downloads_Only_Missing_Chunks(t *testing.T) {
+	old := testutil.RandomBytes(t, 1, 16*fastcdc.MaxSize)
+
+	data := append([]byte{}, old[:4*fastcdc.MaxSize]...)
+	data = append(data, testutil.RandomBytes(t, 2, 5000)...)
+	data = append(data, old[6*fastcdc.MaxSize:]...)
+
+	var requests int32
+	srv := newServer(t, data, &requests)
+
+	c := &Client{URL: srv.URL + "/files/new/", Parallel: 4}
+	got, stats, err := c.Fetch(context.Background(), old)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(got, data) {
+		t.Fatalf("expected fetched data to equal served data")
+	}
+
+	if int(requests) != stats.Downloads {
+		t.Fatalf("expected %d chunk requests, got %d", stats.Downloads, requests)
+	}
+
+	if stats.DownloadedBytes >= len(data)/4 {
+		t.Fatalf("expected most data to be reused, got %d downloaded bytes of %d", stats.DownloadedBytes, len(data))
+	}
+
+	if stats.ReusedBytes+stats.DownloadedBytes != len(data) {
+		t.Fatalf("expected reused + downloaded bytes == %d, got %d + %d", len(data), stats.ReusedBytes, stats.DownloadedBytes)
+	}
+}
+
+func Test_Fetch_Without_Old_Data(t *testing.T) {
+	data := testutil.RandomBytes(t, 1, 8*fastcdc.MaxSize)
+
+	var requests int32
+	srv := newServer(t, data, &requests)
+
+	idx, _ := NewIndex(data, rollingdiff.Chunker{})
+
+	c := &Client{URL: srv.URL + "/files/new", Parallel: 3}
+	got, stats, err := c.Fetch(context.Background(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(got, data) {
+		t.Fatalf("expected fetched data to equal served data")
+	}
+
+	if stats.Downloads != len(idx.Chunks) || stats.DownloadedBytes != len(data) {
+		t.Fatalf("expected all %d chunks to be downloaded, got %d", len(idx.Chunks), stats.Downloads)
+	}
+}
+
+func Test_Fetch_Detects_Corrupted_Chunk(t *testing.T) {
+	data := testutil.RandomBytes(t, 1, 4*fastcdc.MaxSize)
+
+	h, err := NewHandler(data, rollingdiff.Chunker{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, ChunksPath) {
+			w.Write([]byte("garbage"))
+			return
+		}
+		h.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	c := &Client{URL: srv.URL, Parallel: 2}
+	if _, _, err := c.Fetch(context.Background(), nil); !errors.Is(err, ErrDigestMismatch) {
+		t.Fatalf("expected ErrDigestMismatch, got %v", err)
+	}
+}
+
+func Test_Handler_Unknown_Chunk(t *testing.T) {
+	h, err := NewHandler(testutil.RandomBytes(t, 1, 1024), rollingdiff.Chunker{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, ChunksPath+"00", nil))
+
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("expected status %d, got %d", http.StatusNotFound, rec.Code)
+	}
+}
+
+func Test_FetchFile_Resumes_Interrupted_Fetch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "file")
+	data := testutil.RandomBytes(t, 1, 16*fastcdc.MaxSize)
+
+	h, err := NewHandler(data, rollingdiff.Chunker{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Fail every chunk request after the first few.
+	var requests, limit int32 = 0, 4
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, ChunksPath) && atomic.AddInt32(&requests, 1) > atomic.LoadInt32(&limit) {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		h.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	c := &Client{URL: srv.URL}
+	if _, err := c.FetchFile(context.Background(), nil, path); err == nil {
+		t.Fatalf("expected first fetch to fail")
+	}
+
+	atomic.StoreInt32(&requests, 0)
+	atomic.StoreInt32(&limit, 1000)
+
+	stats, err := c.FetchFile(context.Background(), nil, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	idx, _ := NewIndex(data, rollingdiff.Chunker{})
+	if stats.Downloads != len(idx.Chunks)-4 {
+		t.Fatalf("expected %d downloads on resume, got %d", len(idx.Chunks)-4, stats.Downloads)
+	}
+
+	got, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("expected fetched file to equal served data")
+	}
+}
+
+func Test_RangeClient_FetchFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "file")
+	old := testutil.RandomBytes(t, 1, 16*fastcdc.MaxSize)
+	data := append(append([]byte{}, old[:8*fastcdc.MaxSize]...), testutil.RandomBytes(t, 2, 3000)...)
+	data = append(data, old[9*fastcdc.MaxSize:]...)
+
+	var requests int32
+	srv := newStaticServer(t, data, &requests)
+
+	c := &RangeClient{FileURL: srv.URL + "/file.bin", IndexURL: srv.URL + "/file.bin.index"}
+	stats, err := c.FetchFile(context.Background(), old, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stats.Downloads != 1 {
+		t.Fatalf("expected single range request, got %d", stats.Downloads)
+	}
+
+	got, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("expected fetched file to equal served data")
+	}
+}
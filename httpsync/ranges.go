@@ -0,0 +1,207 @@
+package httpsync
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+)
+
+// RangeClient reconstructs a file published on any static HTTP server,
+// zsync style. Along with the file, its Index must be published as JSON.
+// Chunks not available locally are downloaded with HTTP range requests.
+type RangeClient struct {
+	// FileURL is the location of the file.
+	FileURL string
+	// IndexURL is the location of the JSON encoded Index of the file.
+	IndexURL string
+	// HTTPClient is used for requests. http.DefaultClient is used if nil.
+	HTTPClient *http.Client
+	// MaxGap is the number of bytes of already available data that may be
+	// downloaded again in order to coalesce two missing ranges into one
+	// request.
+	MaxGap int
+}
+
+// byteRange is a span of the file [start, end) covering chunks first..last.
+type byteRange struct {
+	start, end  int
+	first, last int
+}
+
+// Index downloads the published index of the file.
+func (c *RangeClient) Index(ctx context.Context) (Index, error) {
+	var idx Index
+
+	resp, err := get(ctx, c.HTTPClient, c.IndexURL, "")
+	if err != nil {
+		return idx, err
+	}
+	defer resp.Body.Close()
+
+	if err := json.NewDecoder(resp.Body).Decode(&idx); err != nil {
+		return idx, err
+	}
+
+	if err := idx.Validate(); err != nil {
+		return idx, err
+	}
+
+	return idx, nil
+}
+
+// Fetch reconstructs the file reusing chunks found in `old` and downloading
+// the rest. In returned Stats, Downloads is the number of range requests
+// made.
+func (c *RangeClient) Fetch(ctx context.Context, old []byte) ([]byte, Stats, error) {
+	var stats Stats
+
+	idx, err := c.Index(ctx)
+	if err != nil {
+		return nil, stats, err
+	}
+
+	local := localChunks(idx, old)
+
+	available := func(i int) bool {
+		_, exists := local[idx.Chunks[i].Signature]
+		return exists
+	}
+
+	for _, r := range c.missingRanges(idx, available) {
+		data, err := c.fetchRange(ctx, r)
+		if err != nil {
+			return nil, stats, err
+		}
+		stats.Downloads++
+		stats.DownloadedBytes += len(data)
+
+		for _, ch := range idx.Chunks[r.first : r.last+1] {
+			content := data[ch.Offset-r.start : ch.Offset-r.start+ch.Size]
+			if err := verifyChunk(ch.Signature, content); err != nil {
+				return nil, stats, err
+			}
+			local[ch.Signature] = content
+		}
+	}
+
+	data, err := assemble(idx, local)
+	if err != nil {
+		return nil, stats, err
+	}
+	stats.ReusedBytes = len(data) - stats.DownloadedBytes
+
+	return data, stats, nil
+}
+
+// FetchFile is like Fetch, but writes the file to `path`. An interrupted
+// fetch to the same path is resumed, requesting only the ranges that were not
+// written yet.
+func (c *RangeClient) FetchFile(ctx context.Context, old []byte, path string) (Stats, error) {
+	var stats Stats
+
+	idx, err := c.Index(ctx)
+	if err != nil {
+		return stats, err
+	}
+
+	w, err := resume(path, idx)
+	if err != nil {
+		return stats, err
+	}
+	defer w.Close()
+
+	local := localChunks(idx, old)
+	for _, i := range w.Pending() {
+		if data, exists := local[idx.Chunks[i].Signature]; exists {
+			if err := w.Write(i, data); err != nil {
+				return stats, err
+			}
+			stats.ReusedBytes += len(data)
+		}
+	}
+
+	// Whatever is still pending must be downloaded. Chunks with equal content
+	// are fetched only once.
+	fetched := make(map[string][]byte)
+	for _, r := range c.missingRanges(idx, w.Done) {
+		data, err := c.fetchRange(ctx, r)
+		if err != nil {
+			return stats, err
+		}
+		stats.Downloads++
+		stats.DownloadedBytes += len(data)
+
+		for i, ch := range idx.Chunks[r.first : r.last+1] {
+			content := data[ch.Offset-r.start : ch.Offset-r.start+ch.Size]
+			if err := verifyChunk(ch.Signature, content); err != nil {
+				return stats, err
+			}
+			fetched[ch.Signature] = content
+			if err := w.Write(r.first+i, content); err != nil {
+				return stats, err
+			}
+		}
+	}
+
+	for _, i := range w.Pending() {
+		if err := w.Write(i, fetched[idx.Chunks[i].Signature]); err != nil {
+			return stats, err
+		}
+	}
+
+	return stats, w.Commit()
+}
+
+// missingRanges computes coalesced byte ranges covering chunks for which
+// `available` returns false. Chunks with equal content are covered once.
+func (c *RangeClient) missingRanges(idx Index, available func(i int) bool) []byteRange {
+	var ranges []byteRange
+	scheduled := make(map[string]bool)
+
+	for i, ch := range idx.Chunks {
+		if available(i) || scheduled[ch.Signature] {
+			continue
+		}
+		scheduled[ch.Signature] = true
+
+		if n := len(ranges); n > 0 && ch.Offset-ranges[n-1].end <= c.MaxGap {
+			ranges[n-1].end = ch.Offset + ch.Size
+			ranges[n-1].last = i
+			continue
+		}
+
+		ranges = append(ranges, byteRange{
+			start: ch.Offset,
+			end:   ch.Offset + ch.Size,
+			first: i,
+			last:  i,
+		})
+	}
+
+	return ranges
+}
+
+func (c *RangeClient) fetchRange(ctx context.Context, r byteRange) ([]byte, error) {
+	resp, err := get(ctx, c.HTTPClient, c.FileURL, fmt.Sprintf("bytes=%d-%d", r.start, r.end-1))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK {
+		// Server does not support ranges and sent the whole file instead.
+		if _, err := io.CopyN(ioutil.Discard, resp.Body, int64(r.start)); err != nil {
+			return nil, err
+		}
+	}
+
+	data := make([]byte, r.end-r.start)
+	if _, err := io.ReadFull(resp.Body, data); err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
@@ -0,0 +1,140 @@
+package httpsync
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/tuommaki/rollingdiff/fastcdc"
+	"github.com/tuommaki/rollingdiff/internal/testutil"
+	"github.com/tuommaki/rollingdiff/rollingdiff"
+)
+
+func newStaticServer(t *testing.T, data []byte, rangeRequests *int32) *httptest.Server {
+	t.Helper()
+
+	idx, _ := NewIndex(data, rollingdiff.Chunker{})
+	index, err := json.Marshal(idx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/file.bin", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Range") != "" {
+			atomic.AddInt32(rangeRequests, 1)
+		}
+		http.ServeContent(w, r, "file.bin", time.Time{}, bytes.NewReader(data))
+	})
+	mux.HandleFunc("/file.bin.index", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(index)
+	})
+
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func Test_RangeClient_Fetch(t *testing.T) {
+	old := testutil.RandomBytes(t, 1, 32*fastcdc.MaxSize)
+
+	// Two separate modifications.
+	data := append([]byte{}, old[:4*fastcdc.MaxSize]...)
+	data = append(data, testutil.RandomBytes(t, 2, 5000)...)
+	data = append(data, old[5*fastcdc.MaxSize:20*fastcdc.MaxSize]...)
+	data = append(data, testutil.RandomBytes(t, 3, 7000)...)
+	data = append(data, old[21*fastcdc.MaxSize:]...)
+
+	var requests int32
+	srv := newStaticServer(t, data, &requests)
+
+	c := &RangeClient{FileURL: srv.URL + "/file.bin", IndexURL: srv.URL + "/file.bin.index"}
+	got, stats, err := c.Fetch(context.Background(), old)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(got, data) {
+		t.Fatalf("expected fetched data to equal served data")
+	}
+
+	if stats.Downloads != 2 || int(requests) != 2 {
+		t.Fatalf("expected two coalesced range requests, got %d (%d served)", stats.Downloads, requests)
+	}
+
+	if stats.DownloadedBytes >= len(data)/4 {
+		t.Fatalf("expected most data to be reused, got %d downloaded bytes of %d", stats.DownloadedBytes, len(data))
+	}
+}
+
+func Test_RangeClient_Coalesces_Ranges_Within_Gap(t *testing.T) {
+	old := testutil.RandomBytes(t, 1, 32*fastcdc.MaxSize)
+
+	data := append([]byte{}, old[:4*fastcdc.MaxSize]...)
+	data = append(data, testutil.RandomBytes(t, 2, 5000)...)
+	data = append(data, old[5*fastcdc.MaxSize:20*fastcdc.MaxSize]...)
+	data = append(data, testutil.RandomBytes(t, 3, 7000)...)
+	data = append(data, old[21*fastcdc.MaxSize:]...)
+
+	var requests int32
+	srv := newStaticServer(t, data, &requests)
+
+	c := &RangeClient{FileURL: srv.URL + "/file.bin", IndexURL: srv.URL + "/file.bin.index", MaxGap: len(data)}
+	got, stats, err := c.Fetch(context.Background(), old)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(got, data) {
+		t.Fatalf("expected fetched data to equal served data")
+	}
+
+	if stats.Downloads != 1 {
+		t.Fatalf("expected single range request, got %d", stats.Downloads)
+	}
+}
+
+func Test_RangeClient_Without_Range_Support(t *testing.T) {
+	old := testutil.RandomBytes(t, 1, 8*fastcdc.MaxSize)
+	data := append(testutil.RandomBytes(t, 2, 3000), old...)
+
+	idx, _ := NewIndex(data, rollingdiff.Chunker{})
+	index, _ := json.Marshal(idx)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/index" {
+			w.Write(index)
+			return
+		}
+		// Ignore Range header altogether.
+		w.Write(data)
+	}))
+	defer srv.Close()
+
+	c := &RangeClient{FileURL: srv.URL + "/file", IndexURL: srv.URL + "/index"}
+	got, _, err := c.Fetch(context.Background(), old)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(got, data) {
+		t.Fatalf("expected fetched data to equal served data")
+	}
+}
+
+func Test_Index_Validate(t *testing.T) {
+	idx, _ := NewIndex(testutil.RandomBytes(t, 1, 4*fastcdc.MaxSize), rollingdiff.Chunker{})
+	if err := idx.Validate(); err != nil {
+		t.Fatalf("expected valid index, got %v", err)
+	}
+
+	idx.Chunks[1].Offset--
+	if err := idx.Validate(); err == nil {
+		t.Fatalf("expected error for inconsistent offsets")
+	}
+}
@@ -0,0 +1,136 @@
+// Package httpsync distributes files over HTTP so that clients already having
+// an older version only download the chunks they lack.
+package httpsync
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/tuommaki/rollingdiff/fastcdc"
+	"github.com/tuommaki/rollingdiff/rollingdiff"
+)
+
+// Paths served by Handler, relative to its mount point.
+const (
+	IndexPath  = "/index"
+	ChunksPath = "/chunks/"
+)
+
+// IndexChunk describes a single chunk in an Index.
+type IndexChunk struct {
+	Signature string `json:"signature"`
+	Offset    int    `json:"offset"`
+	Size      int    `json:"size"`
+}
+
+// Index describes the chunks a file consists of. Its JSON encoding can also
+// be published next to a static file for use with RangeClient.
+type Index struct {
+	Params fastcdc.Params `json:"params"`
+	Size   int            `json:"size"`
+	Digest string         `json:"digest"`
+	Chunks []IndexChunk   `json:"chunks"`
+}
+
+// NewIndex creates index of `data`, split into chunks with `chunker`.
+func NewIndex(data []byte, chunker rollingdiff.Chunker) (Index, []rollingdiff.Chunk) {
+	if chunker.Params == (fastcdc.Params{}) {
+		chunker.Params = fastcdc.DefaultParams
+	}
+
+	chunks := chunker.Signatures(data)
+	digest := sha256.Sum256(data)
+
+	idx := Index{
+		Params: chunker.Params,
+		Size:   len(data),
+		Digest: hex.EncodeToString(digest[:]),
+		Chunks: make([]IndexChunk, len(chunks)),
+	}
+	for i, c := range chunks {
+		idx.Chunks[i] = IndexChunk{
+			Signature: hex.EncodeToString(c.Signature[:]),
+			Offset:    c.Offset,
+			Size:      len(c.Bytes),
+		}
+	}
+
+	return idx, chunks
+}
+
+// Validate checks that the chunks of the index are consecutive and cover the
+// whole file.
+func (idx Index) Validate() error {
+	if err := idx.Params.Validate(); err != nil {
+		return err
+	}
+
+	offset := 0
+	for i, ch := range idx.Chunks {
+		if ch.Offset != offset || ch.Size <= 0 {
+			return fmt.Errorf("httpsync: invalid index: chunk %d at offset %d with size %d, expected offset %d", i, ch.Offset, ch.Size, offset)
+		}
+		offset += ch.Size
+	}
+
+	if offset != idx.Size {
+		return fmt.Errorf("httpsync: invalid index: chunks cover %d bytes of %d", offset, idx.Size)
+	}
+
+	return nil
+}
+
+// Handler serves an index of a file and its individual chunks by their
+// hex encoded signatures.
+type Handler struct {
+	index  []byte
+	chunks map[string][]byte
+}
+
+// NewHandler returns a Handler serving `data`, split into chunks with
+// `chunker`.
+func NewHandler(data []byte, chunker rollingdiff.Chunker) (*Handler, error) {
+	idx, chunks := NewIndex(data, chunker)
+
+	index, err := json.Marshal(idx)
+	if err != nil {
+		return nil, err
+	}
+
+	h := &Handler{
+		index:  index,
+		chunks: make(map[string][]byte, len(chunks)),
+	}
+	for i, c := range chunks {
+		h.chunks[idx.Chunks[i].Signature] = c.Bytes
+	}
+
+	return h, nil
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	switch {
+	case r.URL.Path == IndexPath:
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(h.index)
+	case strings.HasPrefix(r.URL.Path, ChunksPath):
+		chunk, exists := h.chunks[strings.TrimPrefix(r.URL.Path, ChunksPath)]
+		if !exists {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write(chunk)
+	default:
+		http.NotFound(w, r)
+	}
+}
@@ -0,0 +1,77 @@
+package rollsum
+
+// Match is a block found in data.
+type Match struct {
+	Offset int
+	Length int
+	// Block is the block as returned by the lookup function.
+	Block int
+}
+
+// Find scans `data` byte by byte for blocks of `sizes`, given in order of
+// preference, rolling a checksum made by `newSum` over a window of each
+// size. At every offset, `lookup` is called with the checksum and content of
+// each window, and returns the block the window holds, or -1 if none. After
+// a match, the search continues past the matched window.
+//
+// With `shrink`, windows reaching past the end of `data` are shortened to
+// end with it, so that a shorter last block can be found, as librsync does.
+// Otherwise they are not looked up.
+func Find(data []byte, sizes []int, shrink bool, newSum func() Sum, lookup func(weak uint32, window []byte) int) []Match {
+	window := func(pos, size int) int {
+		if n := len(data) - pos; n < size {
+			if shrink {
+				return n
+			}
+			return 0
+		}
+		return size
+	}
+
+	sums := make([]Sum, len(sizes))
+	for k := range sums {
+		sums[k] = newSum()
+	}
+	restart := func(pos int) {
+		for k, size := range sizes {
+			sums[k].Reset()
+			sums[k].Update(data[pos : pos+window(pos, size)])
+		}
+	}
+
+	var matches []Match
+	restart(0)
+	for pos := 0; pos < len(data); {
+		matched := Match{Block: -1}
+		for k, size := range sizes {
+			n := window(pos, size)
+			if n == 0 {
+				continue
+			}
+			if b := lookup(sums[k].Digest(), data[pos:pos+n]); b >= 0 {
+				matched = Match{Offset: pos, Length: n, Block: b}
+				break
+			}
+		}
+
+		if matched.Block >= 0 {
+			matches = append(matches, matched)
+			pos += matched.Length
+			restart(pos)
+			continue
+		}
+
+		for k, size := range sizes {
+			switch n := window(pos, size); {
+			case n == 0:
+			case pos+n < len(data):
+				sums[k].Rotate(data[pos], data[pos+n])
+			default:
+				sums[k].Rollout(data[pos])
+			}
+		}
+		pos++
+	}
+
+	return matches
+}
@@ -0,0 +1,96 @@
+// Package rollsum implements weak rolling checksums and the rsync style
+// search for blocks at any offset shared by the rollingdiff and librsync
+// packages.
+package rollsum
+
+// Sum is a weak checksum of a window that can be moved by one byte at a
+// time.
+type Sum interface {
+	// Reset empties the window.
+	Reset()
+	// Update appends `buf` to the window.
+	Update(buf []byte)
+	// Rotate drops `out` from the start of the window and appends `in`.
+	Rotate(out, in byte)
+	// Rollout drops `out` from the start of the window.
+	Rollout(out byte)
+	Digest() uint32
+}
+
+// Rsync is the rsync checksum, also used by librsync signatures with MD4
+// and BLAKE2 strong sums.
+type Rsync struct {
+	count  uint32
+	s1, s2 uint16
+}
+
+const rsyncCharOffset = 31
+
+func (s *Rsync) Reset() {
+	*s = Rsync{}
+}
+
+func (s *Rsync) Update(buf []byte) {
+	for _, c := range buf {
+		s.s1 += uint16(c) + rsyncCharOffset
+		s.s2 += s.s1
+	}
+	s.count += uint32(len(buf))
+}
+
+func (s *Rsync) Rotate(out, in byte) {
+	s.s1 += uint16(in) - uint16(out)
+	s.s2 += s.s1 - uint16(s.count)*(uint16(out)+rsyncCharOffset)
+}
+
+func (s *Rsync) Rollout(out byte) {
+	s.s1 -= uint16(out) + rsyncCharOffset
+	s.s2 -= uint16(s.count) * (uint16(out) + rsyncCharOffset)
+	s.count--
+}
+
+func (s *Rsync) Digest() uint32 {
+	return uint32(s.s2)<<16 | uint32(s.s1)
+}
+
+// RabinKarp is the polynomial checksum of librsync signatures introduced in
+// librsync 2.2. Its zero value is not an empty window; call Reset first.
+type RabinKarp struct {
+	hash uint32
+	// mult is rabinKarpMult to the power of the window size.
+	mult uint32
+}
+
+const (
+	rabinKarpSeed = 1
+	rabinKarpMult = 0x08104225
+	// rabinKarpInvM is the multiplicative inverse of rabinKarpMult.
+	rabinKarpInvM = 0x98f009ad
+	// rabinKarpAdj is the correction for the seed, rabinKarpSeed *
+	// (rabinKarpMult - 1).
+	rabinKarpAdj = 0x08104224
+)
+
+func (s *RabinKarp) Reset() {
+	*s = RabinKarp{hash: rabinKarpSeed, mult: 1}
+}
+
+func (s *RabinKarp) Update(buf []byte) {
+	for _, c := range buf {
+		s.hash = s.hash*rabinKarpMult + uint32(c)
+		s.mult *= rabinKarpMult
+	}
+}
+
+func (s *RabinKarp) Rotate(out, in byte) {
+	s.hash = s.hash*rabinKarpMult + uint32(in) - s.mult*(uint32(out)+rabinKarpAdj)
+}
+
+func (s *RabinKarp) Rollout(out byte) {
+	s.mult *= rabinKarpInvM
+	s.hash -= s.mult * (uint32(out) + rabinKarpAdj)
+}
+
+func (s *RabinKarp) Digest() uint32 {
+	return s.hash
+}
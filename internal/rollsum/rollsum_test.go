@@ -0,0 +1,94 @@
+package rollsum
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/tuommaki/rollingdiff/internal/testutil"
+)
+
+func Test_Rollsum_Rolling_Equals_Fresh(t *testing.T) {
+	data := testutil.RandomBytes(t, 1, 1000)
+	const window = 64
+
+	for _, newSum := range []func() Sum{
+		func() Sum { return &Rsync{} },
+		func() Sum { return &RabinKarp{} },
+	} {
+		rolling, fresh := newSum(), newSum()
+		rolling.Reset()
+		rolling.Update(data[:window])
+
+		for pos := 1; pos < len(data); pos++ {
+			end := pos + window
+			if end <= len(data) {
+				rolling.Rotate(data[pos-1], data[end-1])
+			} else {
+				end = len(data)
+				rolling.Rollout(data[pos-1])
+			}
+
+			fresh.Reset()
+			fresh.Update(data[pos:end])
+			if rolling.Digest() != fresh.Digest() {
+				t.Fatalf("%T at %d: expected %#x, got %#x", fresh, pos, fresh.Digest(), rolling.Digest())
+			}
+		}
+	}
+
+	if mult := uint32(rabinKarpMult); mult*rabinKarpInvM != 1 {
+		t.Fatalf("expected rabinKarpInvM to be inverse of rabinKarpMult")
+	}
+}
+
+func Test_Find_Matches_Blocks_At_Any_Offset(t *testing.T) {
+	old := testutil.RandomBytes(t, 1, 1000)
+	rng := testutil.Rand(t, 2)
+	const size = 64
+
+	// Blocks of old data, the last one shorter, each shifted by inserted
+	// data.
+	var data []byte
+	var blocks [][]byte
+	var expected []Match
+	index := make(map[uint32]int)
+	for off := 0; off < len(old); off += size {
+		end := off + size
+		if end > len(old) {
+			end = len(old)
+		}
+		block := old[off:end]
+
+		var sum Rsync
+		sum.Update(block)
+		index[sum.Digest()] = len(blocks)
+
+		inserted := make([]byte, 3)
+		rng.Read(inserted)
+		data = append(data, inserted...)
+		expected = append(expected, Match{Offset: len(data), Length: len(block), Block: len(blocks)})
+		data = append(data, block...)
+		blocks = append(blocks, block)
+	}
+
+	lookup := func(weak uint32, window []byte) int {
+		if i, exists := index[weak]; exists && bytes.Equal(blocks[i], window) {
+			return i
+		}
+		return -1
+	}
+
+	for _, shrink := range []bool{true, false} {
+		matches := Find(data, []int{size}, shrink, func() Sum { return &Rsync{} }, lookup)
+
+		// The shorter last block is only found in shrinking windows.
+		want := expected
+		if !shrink {
+			want = expected[:len(expected)-1]
+		}
+		if !reflect.DeepEqual(matches, want) {
+			t.Fatalf("expected matches %v with shrink %v, got %v", want, shrink, matches)
+		}
+	}
+}
@@ -0,0 +1,36 @@
+// Package testutil provides helpers shared by tests of the packages of this
+// module.
+package testutil
+
+import (
+	"flag"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+// Seed is the seed of random test data, set with -seed to reproduce a failed
+// run. Tests needing several independent streams of data add small offsets
+// to it.
+var Seed = flag.Int64("seed", time.Now().Unix(), "seed for rng")
+
+// Rand returns a random number generator seeded with Seed + `offset`. The
+// seed is logged, so that failures can be reproduced.
+func Rand(t testing.TB, offset int64) *rand.Rand {
+	t.Helper()
+	t.Logf("Rand(%d): seed == %d\n", offset, *Seed)
+
+	return rand.New(rand.NewSource(*Seed + offset))
+}
+
+// RandomBytes returns `n` random bytes generated with seed Seed + `offset`.
+func RandomBytes(t testing.TB, offset int64, n int) []byte {
+	t.Helper()
+	t.Logf("RandomBytes(%d, %d): seed == %d\n", offset, n, *Seed)
+
+	rng := rand.New(rand.NewSource(*Seed + offset))
+
+	buf := make([]byte, n)
+	rng.Read(buf)
+	return buf
+}
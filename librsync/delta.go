@@ -0,0 +1,276 @@
+package librsync
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/tuommaki/rollingdiff/internal/rollsum"
+)
+
+// Command of a delta file. It either carries literal Data, or copies Length
+// bytes from Offset of the old file.
+type Command struct {
+	Data   []byte
+	Offset int64
+	Length int64
+}
+
+// Delta command opcodes.
+const (
+	opEnd            = 0x00
+	opLiteralMax     = 0x40
+	opLiteralN1      = 0x41
+	opLiteralN8      = 0x44
+	opCopyN1N1       = 0x45
+	opCopyN8N8       = 0x54
+	maxImmediateSize = opLiteralMax
+)
+
+// Match scans `data` byte by byte for blocks of the old file described by
+// the signature, rsync style, and returns commands rebuilding `data` from the
+// old file. Blocks are found at any offset, not only at multiples of the
+// block length.
+func (s *Signature) Match(data []byte) []Command {
+	index := make(map[uint32][]int, len(s.Blocks))
+	for i, b := range s.Blocks {
+		index[b.Weak] = append(index[b.Weak], i)
+	}
+
+	var cmds []Command
+	emitLiteral := func(lit []byte) {
+		if len(lit) > 0 {
+			cmds = append(cmds, Command{Data: lit})
+		}
+	}
+	emitCopy := func(offset, length int64) {
+		if n := len(cmds); n > 0 && cmds[n-1].Data == nil && cmds[n-1].Offset+cmds[n-1].Length == offset {
+			cmds[n-1].Length += length
+			return
+		}
+		cmds = append(cmds, Command{Offset: offset, Length: length})
+	}
+
+	// Length of the last block is not known, but its checksums match only a
+	// window of the same length.
+	matches := rollsum.Find(data, []int{s.BlockLen}, true, s.rollsum, func(weak uint32, window []byte) int {
+		var strong []byte
+		for _, i := range index[weak] {
+			if strong == nil {
+				strong = s.strong(window)
+			}
+			if bytes.Equal(strong, s.Blocks[i].Strong) {
+				return i
+			}
+		}
+		return -1
+	})
+
+	literal := 0
+	for _, m := range matches {
+		emitLiteral(data[literal:m.Offset])
+		emitCopy(int64(m.Block)*int64(s.BlockLen), int64(m.Length))
+		literal = m.Offset + m.Length
+	}
+	emitLiteral(data[literal:])
+
+	return cmds
+}
+
+// Delta writes a delta file rebuilding `data` from the old file described by
+// `sig` to `w`.
+func Delta(w io.Writer, sig *Signature, data []byte) error {
+	return WriteDelta(w, sig.Match(data))
+}
+
+// WriteDelta writes `cmds` as a delta file in librsync format.
+func WriteDelta(w io.Writer, cmds []Command) error {
+	bw := bufio.NewWriter(w)
+
+	var buf [17]byte
+	binary.BigEndian.PutUint32(buf[:], DeltaMagic)
+	bw.Write(buf[:4])
+
+	for _, c := range cmds {
+		if c.Data != nil {
+			if len(c.Data) == 0 {
+				continue
+			}
+
+			if len(c.Data) <= maxImmediateSize {
+				bw.WriteByte(byte(len(c.Data)))
+			} else {
+				width, code := intWidth(uint64(len(c.Data)))
+				buf[0] = byte(opLiteralN1 + code)
+				putInt(buf[1:1+width], uint64(len(c.Data)))
+				bw.Write(buf[:1+width])
+			}
+			bw.Write(c.Data)
+			continue
+		}
+
+		if c.Offset < 0 || c.Length <= 0 {
+			return fmt.Errorf("%w: copy of %d bytes at %d", ErrFormat, c.Length, c.Offset)
+		}
+
+		offsetWidth, offsetCode := intWidth(uint64(c.Offset))
+		lengthWidth, lengthCode := intWidth(uint64(c.Length))
+		buf[0] = byte(opCopyN1N1 + 4*offsetCode + lengthCode)
+		putInt(buf[1:1+offsetWidth], uint64(c.Offset))
+		putInt(buf[1+offsetWidth:1+offsetWidth+lengthWidth], uint64(c.Length))
+		bw.Write(buf[:1+offsetWidth+lengthWidth])
+	}
+
+	bw.WriteByte(opEnd)
+	return bw.Flush()
+}
+
+// intWidth returns the smallest of 1, 2, 4 and 8 bytes able to hold `n`,
+// along with its code in opcodes.
+func intWidth(n uint64) (width, code int) {
+	switch {
+	case n <= 0xff:
+		return 1, 0
+	case n <= 0xffff:
+		return 2, 1
+	case n <= 0xffffffff:
+		return 4, 2
+	}
+	return 8, 3
+}
+
+func putInt(buf []byte, n uint64) {
+	for i := len(buf) - 1; i >= 0; i-- {
+		buf[i] = byte(n)
+		n >>= 8
+	}
+}
+
+// deltaReader reads commands of a delta file one by one.
+type deltaReader struct {
+	r *bufio.Reader
+}
+
+func newDeltaReader(r io.Reader) (*deltaReader, error) {
+	br := bufio.NewReader(r)
+
+	var magic [4]byte
+	if _, err := io.ReadFull(br, magic[:]); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrFormat, err)
+	}
+	if m := binary.BigEndian.Uint32(magic[:]); m != DeltaMagic {
+		return nil, fmt.Errorf("%w: %#x is not a delta", ErrMagic, m)
+	}
+
+	return &deltaReader{r: br}, nil
+}
+
+func (d *deltaReader) int(width int) (int64, error) {
+	var buf [8]byte
+	if _, err := io.ReadFull(d.r, buf[:width]); err != nil {
+		return 0, fmt.Errorf("%w: truncated command", ErrFormat)
+	}
+
+	var n uint64
+	for _, b := range buf[:width] {
+		n = n<<8 | uint64(b)
+	}
+	if n > 1<<62 {
+		return 0, fmt.Errorf("%w: integer out of range", ErrFormat)
+	}
+	return int64(n), nil
+}
+
+// next reads the next command. Literal data is left in the reader, with
+// Length of the returned command set to its size. At the end of the delta,
+// io.EOF is returned.
+func (d *deltaReader) next() (cmd Command, literal bool, err error) {
+	op, err := d.r.ReadByte()
+	if err != nil {
+		return cmd, false, fmt.Errorf("%w: missing end of delta", ErrFormat)
+	}
+
+	switch {
+	case op == opEnd:
+		return cmd, false, io.EOF
+	case op <= opLiteralMax:
+		cmd.Length = int64(op)
+		return cmd, true, nil
+	case op <= opLiteralN8:
+		cmd.Length, err = d.int(1 << (op - opLiteralN1))
+		return cmd, true, err
+	case op <= opCopyN8N8:
+		code := op - opCopyN1N1
+		if cmd.Offset, err = d.int(1 << (code / 4)); err != nil {
+			return cmd, false, err
+		}
+		cmd.Length, err = d.int(1 << (code % 4))
+		return cmd, false, err
+	}
+
+	return cmd, false, fmt.Errorf("%w: reserved opcode %#x", ErrFormat, op)
+}
+
+// ReadDelta reads all commands of a delta file in librsync format.
+func ReadDelta(r io.Reader) ([]Command, error) {
+	d, err := newDeltaReader(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var cmds []Command
+	for {
+		cmd, literal, err := d.next()
+		if err == io.EOF {
+			return cmds, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if literal {
+			var buf bytes.Buffer
+			if _, err := io.CopyN(&buf, d.r, cmd.Length); err != nil {
+				return nil, fmt.Errorf("%w: truncated literal", ErrFormat)
+			}
+			cmd = Command{Data: buf.Bytes()}
+		}
+		cmds = append(cmds, cmd)
+	}
+}
+
+// Patch applies the delta file read from `delta` to the old file `basis`,
+// writing the new file to `w`.
+func Patch(w io.Writer, basis io.ReaderAt, delta io.Reader) error {
+	d, err := newDeltaReader(delta)
+	if err != nil {
+		return err
+	}
+
+	for {
+		cmd, literal, err := d.next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if literal {
+			if _, err := io.CopyN(w, d.r, cmd.Length); err == io.EOF {
+				return fmt.Errorf("%w: truncated literal", ErrFormat)
+			} else if err != nil {
+				return err
+			}
+			continue
+		}
+
+		if _, err := io.CopyN(w, io.NewSectionReader(basis, cmd.Offset, cmd.Length), cmd.Length); err == io.EOF {
+			return fmt.Errorf("%w: copy beyond end of basis", ErrFormat)
+		} else if err != nil {
+			return err
+		}
+	}
+}
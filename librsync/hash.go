@@ -0,0 +1,155 @@
+package librsync
+
+import (
+	"encoding/binary"
+	"math/bits"
+)
+
+// Strong checksums used by librsync. Neither is available in the standard
+// library, and only one-shot hashing of blocks is needed.
+
+// md4Sum computes MD4 (RFC 1320) of `data`.
+func md4Sum(data []byte) [16]byte {
+	h := [4]uint32{0x67452301, 0xefcdab89, 0x98badcfe, 0x10325476}
+
+	// Padding: a single set bit, zeros and the length in bits.
+	n := len(data)
+	padded := make([]byte, (n+8)/64*64+64)
+	copy(padded, data)
+	padded[n] = 0x80
+	binary.LittleEndian.PutUint64(padded[len(padded)-8:], uint64(n)*8)
+
+	var x [16]uint32
+	for block := padded; len(block) > 0; block = block[64:] {
+		for i := range x {
+			x[i] = binary.LittleEndian.Uint32(block[4*i:])
+		}
+
+		a, b, c, d := h[0], h[1], h[2], h[3]
+
+		for i := 0; i < 16; i++ {
+			f := (b & c) | (^b & d)
+			a, b, c, d = d, bits.RotateLeft32(a+f+x[i], md4Shift1[i%4]), b, c
+		}
+		for i := 0; i < 16; i++ {
+			g := (b & c) | (b & d) | (c & d)
+			a, b, c, d = d, bits.RotateLeft32(a+g+x[md4Order2[i]]+0x5a827999, md4Shift2[i%4]), b, c
+		}
+		for i := 0; i < 16; i++ {
+			f := b ^ c ^ d
+			a, b, c, d = d, bits.RotateLeft32(a+f+x[md4Order3[i]]+0x6ed9eba1, md4Shift3[i%4]), b, c
+		}
+
+		h[0] += a
+		h[1] += b
+		h[2] += c
+		h[3] += d
+	}
+
+	var sum [16]byte
+	for i, v := range h {
+		binary.LittleEndian.PutUint32(sum[4*i:], v)
+	}
+	return sum
+}
+
+var (
+	md4Shift1 = [4]int{3, 7, 11, 19}
+	md4Shift2 = [4]int{3, 5, 9, 13}
+	md4Shift3 = [4]int{3, 9, 11, 15}
+	md4Order2 = [16]int{0, 4, 8, 12, 1, 5, 9, 13, 2, 6, 10, 14, 3, 7, 11, 15}
+	md4Order3 = [16]int{0, 8, 4, 12, 2, 10, 6, 14, 1, 9, 5, 13, 3, 11, 7, 15}
+)
+
+var blake2bIV = [8]uint64{
+	0x6a09e667f3bcc908, 0xbb67ae8584caa73b, 0x3c6ef372fe94f82b, 0xa54ff53a5f1d36f1,
+	0x510e527fade682d1, 0x9b05688c2b3e6c1f, 0x1f83d9abfb41bd6b, 0x5be0cd19137e2179,
+}
+
+var blake2bSigma = [10][16]byte{
+	{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15},
+	{14, 10, 4, 8, 9, 15, 13, 6, 1, 12, 0, 2, 11, 7, 5, 3},
+	{11, 8, 12, 0, 5, 2, 15, 13, 10, 14, 3, 6, 7, 1, 9, 4},
+	{7, 9, 3, 1, 13, 12, 11, 14, 2, 6, 5, 10, 4, 0, 15, 8},
+	{9, 0, 5, 7, 2, 4, 10, 15, 14, 1, 11, 12, 6, 8, 3, 13},
+	{2, 12, 6, 10, 0, 11, 8, 3, 4, 13, 7, 5, 15, 14, 1, 9},
+	{12, 5, 1, 15, 14, 13, 4, 10, 0, 7, 6, 3, 9, 2, 8, 11},
+	{13, 11, 7, 14, 12, 1, 3, 9, 5, 0, 15, 4, 8, 6, 2, 10},
+	{6, 15, 14, 9, 11, 3, 0, 8, 12, 2, 13, 7, 1, 4, 10, 5},
+	{10, 2, 8, 4, 7, 6, 1, 5, 15, 11, 9, 14, 3, 12, 13, 0},
+}
+
+// blake2b256 computes unkeyed BLAKE2b (RFC 7693) of `data` with 32 bytes of
+// output.
+func blake2b256(data []byte) [32]byte {
+	const size = 32
+
+	h := blake2bIV
+	h[0] ^= 0x01010000 ^ size
+
+	var t uint64
+	for {
+		// The last block, possibly empty, is processed with the final flag.
+		last := len(data) <= 128
+		var block [128]byte
+		n := copy(block[:], data)
+		data = data[n:]
+		t += uint64(n)
+
+		blake2bCompress(&h, &block, t, last)
+		if last {
+			break
+		}
+	}
+
+	var sum [64]byte
+	for i, v := range h {
+		binary.LittleEndian.PutUint64(sum[8*i:], v)
+	}
+
+	var out [size]byte
+	copy(out[:], sum[:])
+	return out
+}
+
+func blake2bCompress(h *[8]uint64, block *[128]byte, t uint64, last bool) {
+	var m [16]uint64
+	for i := range m {
+		m[i] = binary.LittleEndian.Uint64(block[8*i:])
+	}
+
+	var v [16]uint64
+	copy(v[:8], h[:])
+	copy(v[8:], blake2bIV[:])
+	v[12] ^= t
+	if last {
+		v[14] = ^v[14]
+	}
+
+	g := func(a, b, c, d int, x, y uint64) {
+		v[a] += v[b] + x
+		v[d] = bits.RotateLeft64(v[d]^v[a], -32)
+		v[c] += v[d]
+		v[b] = bits.RotateLeft64(v[b]^v[c], -24)
+		v[a] += v[b] + y
+		v[d] = bits.RotateLeft64(v[d]^v[a], -16)
+		v[c] += v[d]
+		v[b] = bits.RotateLeft64(v[b]^v[c], -63)
+	}
+
+	for r := 0; r < 12; r++ {
+		s := &blake2bSigma[r%10]
+		g(0, 4, 8, 12, m[s[0]], m[s[1]])
+		g(1, 5, 9, 13, m[s[2]], m[s[3]])
+		g(2, 6, 10, 14, m[s[4]], m[s[5]])
+		g(3, 7, 11, 15, m[s[6]], m[s[7]])
+		g(0, 5, 10, 15, m[s[8]], m[s[9]])
+		g(1, 6, 11, 12, m[s[10]], m[s[11]])
+		g(2, 7, 8, 13, m[s[12]], m[s[13]])
+		g(3, 4, 9, 14, m[s[14]], m[s[15]])
+	}
+
+	for i := range h {
+		h[i] ^= v[i] ^ v[i+8]
+	}
+}
@@ -0,0 +1,186 @@
+// Package librsync reads and writes signature and delta files compatible
+// with librsync and its rdiff tool, and computes deltas by matching fixed
+// size blocks of the old file at any offset of the new one.
+package librsync
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/tuommaki/rollingdiff/internal/rollsum"
+)
+
+// Magic numbers at the start of librsync files.
+const (
+	DeltaMagic           uint32 = 0x72730236
+	MD4SigMagic          uint32 = 0x72730136
+	Blake2SigMagic       uint32 = 0x72730137
+	RabinKarpMD4Magic    uint32 = 0x72730146
+	RabinKarpBlake2Magic uint32 = 0x72730147
+)
+
+// DefaultBlockLen is the block length used by rdiff unless told otherwise.
+const DefaultBlockLen = 2048
+
+var (
+	// ErrMagic is returned when a file does not start with an expected magic
+	// number.
+	ErrMagic = errors.New("librsync: bad magic number")
+	// ErrFormat is returned for malformed files.
+	ErrFormat = errors.New("librsync: malformed file")
+)
+
+// Block is the signature of a single block of the old file.
+type Block struct {
+	Weak   uint32
+	Strong []byte
+}
+
+// Signature describes the old file as a list of block signatures.
+type Signature struct {
+	// Magic selects the weak and strong checksums.
+	Magic uint32
+	// BlockLen is the length of all blocks but the last one.
+	BlockLen int
+	// StrongLen is the number of bytes of the strong checksum kept.
+	StrongLen int
+	Blocks    []Block
+}
+
+// maxStrongLen returns the length of full strong checksum of `magic`, or
+// zero if the magic is not a signature magic.
+func maxStrongLen(magic uint32) int {
+	switch magic {
+	case MD4SigMagic, RabinKarpMD4Magic:
+		return 16
+	case Blake2SigMagic, RabinKarpBlake2Magic:
+		return 32
+	}
+	return 0
+}
+
+// NewSignature computes the signature of `data` with `magic` checksums,
+// blocks of `blockLen` bytes and strong checksums truncated to `strongLen`
+// bytes. Zero `strongLen` keeps full strong checksums.
+func NewSignature(data []byte, magic uint32, blockLen, strongLen int) (*Signature, error) {
+	s := &Signature{Magic: magic, BlockLen: blockLen, StrongLen: strongLen}
+	if strongLen == 0 {
+		s.StrongLen = maxStrongLen(magic)
+	}
+
+	if err := s.validate(); err != nil {
+		return nil, err
+	}
+
+	weak := s.rollsum()
+	for off := 0; off < len(data); off += blockLen {
+		end := off + blockLen
+		if end > len(data) {
+			end = len(data)
+		}
+		block := data[off:end]
+
+		weak.Reset()
+		weak.Update(block)
+		s.Blocks = append(s.Blocks, Block{Weak: weak.Digest(), Strong: s.strong(block)})
+	}
+
+	return s, nil
+}
+
+func (s *Signature) validate() error {
+	max := maxStrongLen(s.Magic)
+	if max == 0 {
+		return fmt.Errorf("%w: %#x is not a signature", ErrMagic, s.Magic)
+	}
+	if s.BlockLen <= 0 || s.StrongLen <= 0 || s.StrongLen > max {
+		return fmt.Errorf("%w: block length %d, strong sum length %d", ErrFormat, s.BlockLen, s.StrongLen)
+	}
+	return nil
+}
+
+func (s *Signature) rollsum() rollsum.Sum {
+	var sum rollsum.Sum = &rollsum.Rsync{}
+	if s.Magic == RabinKarpMD4Magic || s.Magic == RabinKarpBlake2Magic {
+		sum = &rollsum.RabinKarp{}
+	}
+	sum.Reset()
+	return sum
+}
+
+// strong computes truncated strong checksum of `block`.
+func (s *Signature) strong(block []byte) []byte {
+	if s.Magic == MD4SigMagic || s.Magic == RabinKarpMD4Magic {
+		sum := md4Sum(block)
+		return append([]byte{}, sum[:s.StrongLen]...)
+	}
+
+	sum := blake2b256(block)
+	return append([]byte{}, sum[:s.StrongLen]...)
+}
+
+// WriteTo writes the signature in librsync format.
+func (s *Signature) WriteTo(w io.Writer) (int64, error) {
+	if err := s.validate(); err != nil {
+		return 0, err
+	}
+
+	buf := make([]byte, 12, 12+len(s.Blocks)*(4+s.StrongLen))
+	binary.BigEndian.PutUint32(buf[0:], s.Magic)
+	binary.BigEndian.PutUint32(buf[4:], uint32(s.BlockLen))
+	binary.BigEndian.PutUint32(buf[8:], uint32(s.StrongLen))
+
+	for i, b := range s.Blocks {
+		if len(b.Strong) != s.StrongLen {
+			return 0, fmt.Errorf("%w: block %d has strong sum of %d bytes", ErrFormat, i, len(b.Strong))
+		}
+
+		var weak [4]byte
+		binary.BigEndian.PutUint32(weak[:], b.Weak)
+		buf = append(buf, weak[:]...)
+		buf = append(buf, b.Strong...)
+	}
+
+	n, err := w.Write(buf)
+	return int64(n), err
+}
+
+// ReadSignature reads a signature in librsync format from `r`.
+func ReadSignature(r io.Reader) (*Signature, error) {
+	br := bufio.NewReader(r)
+
+	var header [12]byte
+	if _, err := io.ReadFull(br, header[:]); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrFormat, err)
+	}
+
+	s := &Signature{
+		Magic:     binary.BigEndian.Uint32(header[0:]),
+		BlockLen:  int(binary.BigEndian.Uint32(header[4:])),
+		StrongLen: int(binary.BigEndian.Uint32(header[8:])),
+	}
+	if err := s.validate(); err != nil {
+		return nil, err
+	}
+
+	for {
+		record := make([]byte, 4+s.StrongLen)
+		_, err := io.ReadFull(br, record)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: truncated block %d", ErrFormat, len(s.Blocks))
+		}
+
+		s.Blocks = append(s.Blocks, Block{
+			Weak:   binary.BigEndian.Uint32(record),
+			Strong: record[4:],
+		})
+	}
+
+	return s, nil
+}
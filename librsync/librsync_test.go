@@ -0,0 +1,128 @@
+package librsync
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/tuommaki/rollingdiff/internal/testutil"
+)
+
+func Test_Strong_Checksums(t *testing.T) {
+	testCases := []struct {
+		name     string
+		sum      func([]byte) []byte
+		input    string
+		expected string
+	}{
+		{name: "md4 empty", sum: func(b []byte) []byte { s := md4Sum(b); return s[:] }, input: "", expected: "31d6cfe0d16ae931b73c59d7e0c089c0"},
+		{name: "md4 abc", sum: func(b []byte) []byte { s := md4Sum(b); return s[:] }, input: "abc", expected: "a448017aaf21d8525fc10ae87aa6729d"},
+		{name: "md4 message digest", sum: func(b []byte) []byte { s := md4Sum(b); return s[:] }, input: "message digest", expected: "d9130a8164549fe818874806e1c7014b"},
+		{name: "blake2b empty", sum: func(b []byte) []byte { s := blake2b256(b); return s[:] }, input: "", expected: "0e5751c026e543b2e8ab2eb06099daa1d1e5df47778f7787faab45cdf12fe3a8"},
+		{name: "blake2b abc", sum: func(b []byte) []byte { s := blake2b256(b); return s[:] }, input: "abc", expected: "bddd813c634239723171ef3fee98579b94964e3bb1cb3e427262c8c068d52319"},
+	}
+
+	for i, tc := range testCases {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			t.Logf(tc.name)
+
+			if got := hex.EncodeToString(tc.sum([]byte(tc.input))); got != tc.expected {
+				t.Fatalf("expected %s, got %s", tc.expected, got)
+			}
+		})
+	}
+}
+
+func Test_Signature_Roundtrip(t *testing.T) {
+	sig, err := NewSignature(testutil.RandomBytes(t, 1, 10000), Blake2SigMagic, 1024, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(sig.Blocks) != 10 {
+		t.Fatalf("expected 10 blocks, got %d", len(sig.Blocks))
+	}
+
+	var buf bytes.Buffer
+	if _, err := sig.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	if expected := 12 + 10*(4+8); buf.Len() != expected {
+		t.Fatalf("expected %d bytes, got %d", expected, buf.Len())
+	}
+
+	got, err := ReadSignature(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(got, sig) {
+		t.Fatalf("expected read signature to equal written one")
+	}
+
+	if _, err := ReadSignature(bytes.NewReader([]byte{0x72, 0x73, 0x02, 0x36, 0, 0, 0, 1, 0, 0, 0, 1})); !errors.Is(err, ErrMagic) {
+		t.Fatalf("expected ErrMagic, got %v", err)
+	}
+}
+
+func Test_Delta_Patch_Roundtrip(t *testing.T) {
+	old := testutil.RandomBytes(t, 1, 100000)
+
+	// Insert few bytes in the middle, so that the rest of the data is
+	// shifted by an amount unrelated to the block length.
+	data := append(append(append([]byte{}, old[:40000]...), "inserted"...), old[40000:]...)
+
+	for _, magic := range []uint32{MD4SigMagic, Blake2SigMagic, RabinKarpMD4Magic, RabinKarpBlake2Magic} {
+		sig, err := NewSignature(old, magic, DefaultBlockLen, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var delta bytes.Buffer
+		if err := Delta(&delta, sig, data); err != nil {
+			t.Fatal(err)
+		}
+
+		if delta.Len() > 2*DefaultBlockLen {
+			t.Fatalf("%#x: expected small delta, got %d bytes", magic, delta.Len())
+		}
+
+		var result bytes.Buffer
+		if err := Patch(&result, bytes.NewReader(old), &delta); err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(result.Bytes(), data) {
+			t.Fatalf("%#x: expected patched data to equal new data", magic)
+		}
+	}
+}
+
+func Test_Delta_Commands_Roundtrip(t *testing.T) {
+	cmds := []Command{
+		{Data: []byte("short")},
+		{Offset: 0, Length: 10},
+		{Data: testutil.RandomBytes(t, 1, 70000)},
+		{Offset: 1 << 33, Length: 300},
+		{Data: testutil.RandomBytes(t, 2, 64)},
+		{Offset: 70000, Length: 1 << 20},
+	}
+
+	var buf bytes.Buffer
+	if err := WriteDelta(&buf, cmds); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := ReadDelta(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(got, cmds) {
+		t.Fatalf("expected read commands to equal written ones")
+	}
+}
@@ -1,36 +1,231 @@
 package main
 
 import (
+	"errors"
+	"flag"
 	"fmt"
-	"io/ioutil"
 	"os"
+	"strconv"
+	"strings"
 
-	"github.com/tuommaki/rollingdiff/rollingdiff"
+	"github.com/tuommaki/rollingdiff/dedup"
+	"github.com/tuommaki/rollingdiff/fastcdc"
+	"github.com/tuommaki/rollingdiff/tree"
 )
 
+const usage = `usage: %[1]s signature [flags] FILE SIGFILE
+       %[1]s delta [flags] SIGFILE NEWFILE DELTAFILE
+       %[1]s patch OLDFILE DELTAFILE OUTFILE
+       %[1]s stats [flags] OLDFILE NEWFILE
+       %[1]s verify [-repair OUTFILE] SIGFILE FILE
+       %[1]s report [flags] OLDFILE NEWFILE HTMLFILE
+       %[1]s watch [flags] FILE OUTDIR|-
+       %[1]s history add [flags] DIR FILE
+       %[1]s history list DIR
+       %[1]s history extract DIR VERSION OUTFILE
+       %[1]s analyze [-params min:normal:max]... [-top n] PATH...
+       %[1]s [diff] [flags] OLDFILE|OLDDIR NEWFILE|NEWDIR
+
+Files given as - are read from stdin or written to stdout. Run a command
+with -h to list its flags. Exit status is 0 if diff finds no differences or
+verify finds no damage, 1 if they do, and 2 on errors.
+`
+
+var (
+	// errUsage is returned for invalid command lines, after the problem has
+	// been reported.
+	errUsage = errors.New("invalid usage")
+	// errDiffer is returned by diff when its inputs differ.
+	errDiffer = errors.New("inputs differ")
+)
+
+// Exit statuses follow diff(1).
+const (
+	exitSame   = 0
+	exitDiffer = 1
+	exitError  = 2
+)
+
+var commands = map[string]func(args []string) error{
+	"signature": signatureCmd,
+	"diff":      diffCmd,
+	"delta":     deltaCmd,
+	"patch":     patchCmd,
+	"stats":     statsCmd,
+	"verify":    verifyCmd,
+	"report":    reportCmd,
+	"watch":     watchCmd,
+	"history":   historyCmd,
+	"analyze":   analyzeCmd,
+}
+
 func main() {
-	if len(os.Args) < 3 {
-		fmt.Println("usage: " + os.Args[0] + " <oldfile> <newfile>")
-		os.Exit(1)
+	err := run(os.Args[1:])
+	if err != nil && !errors.Is(err, errDiffer) && !errors.Is(err, errUsage) {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", os.Args[0], err)
+	}
+	os.Exit(exitStatus(err))
+}
+
+// exitStatus returns the exit status for error `err` returned by run.
+func exitStatus(err error) int {
+	switch {
+	case err == nil:
+		return exitSame
+	case errors.Is(err, errDiffer):
+		return exitDiffer
+	default:
+		return exitError
+	}
+}
+
+func run(args []string) error {
+	if len(args) == 0 {
+		fmt.Fprintf(os.Stderr, usage, os.Args[0])
+		return errUsage
+	}
+
+	if cmd, exists := commands[args[0]]; exists {
+		return cmd(args[1:])
 	}
 
-	oldData, err := ioutil.ReadFile(os.Args[1])
+	return diffCmd(args)
+}
+
+func diffTrees(oldDir, newDir string, quiet bool) error {
+	oldTree, err := tree.Take(oldDir)
+	if err != nil {
+		return err
+	}
+
+	newTree, err := tree.Take(newDir)
 	if err != nil {
-		panic(err)
+		return err
+	}
+
+	d := tree.Compare(oldTree, newTree)
+	if d.Empty() {
+		return nil
+	}
+
+	if quiet {
+		return errDiffer
+	}
+
+	for _, e := range d.Added {
+		fmt.Printf("added: %s (%v)\n", e.Path, e.Mode)
+	}
+	for _, e := range d.Removed {
+		fmt.Printf("removed: %s (%v)\n", e.Path, e.Mode)
+	}
+	for _, fd := range d.Renamed {
+		fmt.Printf("renamed: %s -> %s, len(changes): %d\n", fd.OldPath, fd.NewPath, len(fd.Changes))
+	}
+	for _, fd := range d.Modified {
+		fmt.Printf("modified: %s (%v -> %v), len(changes): %d\n", fd.NewPath, fd.OldMode, fd.NewMode, len(fd.Changes))
+	}
+
+	return errDiffer
+}
+
+func isDir(path string) bool {
+	fi, err := os.Stat(path)
+	return err == nil && fi.IsDir()
+}
+
+// newFlagSet returns a flag set for command `name` taking positional
+// arguments described by `args`.
+func newFlagSet(name, args string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %s %s [flags] %s\n", os.Args[0], name, args)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// parseArgs parses `args` with `fs` and checks that `n` positional
+// arguments are left.
+func parseArgs(fs *flag.FlagSet, args []string, n int) error {
+	if err := fs.Parse(args); err != nil {
+		return errUsage
+	}
+
+	if n >= 0 && fs.NArg() != n {
+		fs.Usage()
+		return errUsage
+	}
+
+	return nil
+}
+
+func parseParams(value string) (fastcdc.Params, error) {
+	parts := strings.Split(value, ":")
+	if len(parts) != 3 {
+		return fastcdc.Params{}, fmt.Errorf("expected min:normal:max, got %q", value)
+	}
+
+	var sizes [3]int
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil {
+			return fastcdc.Params{}, err
+		}
+		sizes[i] = n
+	}
+
+	p := fastcdc.Params{MinSize: sizes[0], NormalSize: sizes[1], MaxSize: sizes[2]}
+	if err := p.Validate(); err != nil {
+		return fastcdc.Params{}, err
+	}
+
+	return p, nil
+}
+
+// paramsList collects repeated -params flags.
+type paramsList []fastcdc.Params
+
+func (l *paramsList) String() string {
+	var s []string
+	for _, p := range *l {
+		s = append(s, p.String())
 	}
+	return strings.Join(s, ",")
+}
 
-	newData, err := ioutil.ReadFile(os.Args[2])
+func (l *paramsList) Set(value string) error {
+	p, err := parseParams(value)
 	if err != nil {
-		panic(err)
+		return err
+	}
+
+	*l = append(*l, p)
+	return nil
+}
+
+func analyzeCmd(args []string) error {
+	var params paramsList
+
+	fs := newFlagSet("analyze", "PATH...")
+	fs.Var(&params, "params", "chunk size limits as min:normal:max, can be repeated")
+	top := fs.Int("top", 10, "number of most repeated chunks to list")
+	if err := parseArgs(fs, args, -1); err != nil {
+		return err
 	}
 
-	oldChunks := rollingdiff.Signatures(oldData)
-	newChunks := rollingdiff.Signatures(newData)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return errUsage
+	}
 
-	changes := rollingdiff.Delta(oldChunks, newChunks)
+	if len(params) == 0 {
+		params = append(params, fastcdc.DefaultParams)
+	}
 
-	fmt.Printf("len(changes): %d\n", len(changes))
-	for i, c := range changes {
-		fmt.Printf("%d: %#v\n", i, c)
+	reports, err := dedup.Analyze(fs.Args(), params, *top)
+	if err != nil {
+		return err
 	}
+
+	return dedup.WriteReports(os.Stdout, reports)
 }
@@ -0,0 +1,389 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/tuommaki/rollingdiff/fastcdc"
+	"github.com/tuommaki/rollingdiff/internal/testutil"
+	"github.com/tuommaki/rollingdiff/rollingdiff"
+)
+
+func writeFile(t *testing.T, path string, data []byte) {
+	t.Helper()
+
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readFile(t *testing.T, path string) []byte {
+	t.Helper()
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// withStdio runs `fn` with `stdin` as standard input and returns what it
+// wrote to standard output.
+func withStdio(t *testing.T, stdin []byte, fn func()) []byte {
+	t.Helper()
+
+	dir := t.TempDir()
+	in, out := filepath.Join(dir, "stdin"), filepath.Join(dir, "stdout")
+	writeFile(t, in, stdin)
+
+	inFile, err := os.Open(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer inFile.Close()
+
+	outFile, err := os.Create(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer outFile.Close()
+
+	oldStdin, oldStdout := os.Stdin, os.Stdout
+	os.Stdin, os.Stdout = inFile, outFile
+	defer func() { os.Stdin, os.Stdout = oldStdin, oldStdout }()
+
+	fn()
+
+	return readFile(t, out)
+}
+
+// testFiles writes two versions of a file to a temporary directory.
+func testFiles(t *testing.T) (string, string, []byte) {
+	t.Helper()
+
+	oldData := testutil.RandomBytes(t, 1, 8*fastcdc.MaxSize)
+	newData := append(append(append([]byte{}, oldData[:3*fastcdc.MaxSize]...), testutil.RandomBytes(t, 2, 5000)...), oldData[4*fastcdc.MaxSize:]...)
+
+	dir := t.TempDir()
+	oldPath, newPath := filepath.Join(dir, "old"), filepath.Join(dir, "new")
+	writeFile(t, oldPath, oldData)
+	writeFile(t, newPath, newData)
+
+	return oldPath, newPath, newData
+}
+
+func Test_Signature_Delta_Patch_Roundtrip(t *testing.T) {
+	testCases := []struct {
+		name  string
+		flags []string
+	}{
+		{name: "sha256 chunks", flags: []string{"-hash", "sha256"}},
+		{name: "sha256 fixed size blocks", flags: []string{"-hash", "sha256", "-block", "1000"}},
+		{name: "blake2 with rabinkarp", flags: []string{"-hash", "blake2"}},
+		{name: "blake2 with rsync", flags: []string{"-hash", "blake2", "-rollsum", "rsync"}},
+		{name: "md4 with rabinkarp", flags: []string{"-hash", "md4"}},
+		{name: "md4 with rsync", flags: []string{"-hash", "md4", "-rollsum", "rsync"}},
+	}
+
+	for i, tc := range testCases {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			t.Logf(tc.name)
+
+			oldPath, newPath, newData := testFiles(t)
+			dir := filepath.Dir(oldPath)
+			sig, delta, out := filepath.Join(dir, "sig"), filepath.Join(dir, "delta"), filepath.Join(dir, "out")
+
+			args := append(append([]string{"signature"}, tc.flags...), oldPath, sig)
+			if err := run(args); err != nil {
+				t.Fatal(err)
+			}
+			if err := run([]string{"delta", sig, newPath, delta}); err != nil {
+				t.Fatal(err)
+			}
+			if err := run([]string{"patch", oldPath, delta, out}); err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(readFile(t, out), newData) {
+				t.Fatalf("expected patched file to equal new file")
+			}
+
+			if d := len(readFile(t, delta)); d >= len(newData)/2 {
+				t.Fatalf("expected delta smaller than %d bytes, got %d", len(newData)/2, d)
+			}
+		})
+	}
+}
+
+func Test_Patch_Through_Stdin_And_Stdout(t *testing.T) {
+	oldPath, newPath, newData := testFiles(t)
+	sig := filepath.Join(filepath.Dir(oldPath), "sig")
+
+	if err := run([]string{"signature", oldPath, sig}); err != nil {
+		t.Fatal(err)
+	}
+
+	delta := withStdio(t, readFile(t, newPath), func() {
+		if err := run([]string{"delta", sig, "-", "-"}); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	out := withStdio(t, delta, func() {
+		if err := run([]string{"patch", oldPath, "-", "-"}); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	if !bytes.Equal(out, newData) {
+		t.Fatalf("expected patched output to equal new file")
+	}
+
+	err := run([]string{"delta", "-", "-", "-"})
+	if status := exitStatus(err); status != exitError {
+		t.Fatalf("expected exit status %d reading stdin twice, got %d (%v)", exitError, status, err)
+	}
+}
+
+func Test_Diff_Exit_Status(t *testing.T) {
+	oldPath, newPath, _ := testFiles(t)
+	missing := filepath.Join(filepath.Dir(oldPath), "missing")
+
+	testCases := []struct {
+		name     string
+		args     []string
+		expected int
+	}{
+		{name: "same files", args: []string{"diff", oldPath, oldPath}, expected: exitSame},
+		{name: "same files, quiet", args: []string{"diff", "-quiet", oldPath, oldPath}, expected: exitSame},
+		{name: "different files", args: []string{"diff", newPath, oldPath}, expected: exitDiffer},
+		{name: "different files, quiet", args: []string{"diff", "-quiet", oldPath, newPath}, expected: exitDiffer},
+		{name: "diff as default command", args: []string{oldPath, newPath}, expected: exitDiffer},
+		{name: "missing file", args: []string{"diff", oldPath, missing}, expected: exitError},
+		{name: "missing file, quiet", args: []string{"diff", "-quiet", missing, oldPath}, expected: exitError},
+		{name: "invalid usage", args: []string{"diff", oldPath}, expected: exitError},
+	}
+
+	for i, tc := range testCases {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			t.Logf(tc.name)
+
+			var err error
+			withStdio(t, nil, func() {
+				// Usage is written to stderr, which is silenced as well.
+				stderr := os.Stderr
+				os.Stderr = os.Stdout
+				defer func() { os.Stderr = stderr }()
+
+				err = run(tc.args)
+			})
+
+			if status := exitStatus(err); status != tc.expected {
+				t.Fatalf("expected exit status %d, got %d (%v)", tc.expected, status, err)
+			}
+		})
+	}
+}
+
+func Test_Stats_Output(t *testing.T) {
+	oldPath, newPath, newData := testFiles(t)
+
+	for _, hash := range []string{"sha256", "blake2", "md4"} {
+		out := withStdio(t, nil, func() {
+			if err := run([]string{"stats", "-hash", hash, "-output", "json", oldPath, newPath}); err != nil {
+				t.Fatal(err)
+			}
+		})
+
+		var st deltaStats
+		if err := json.Unmarshal(out, &st); err != nil {
+			t.Fatal(err)
+		}
+		if st.NewSize != len(newData) || st.ReusedBytes+st.AddedBytes != st.NewSize {
+			t.Fatalf("expected %d new bytes reused or added with %s, got %+v", len(newData), hash, st)
+		}
+	}
+}
+
+func Test_Verify_And_Repair(t *testing.T) {
+	oldPath, _, _ := testFiles(t)
+	dir := filepath.Dir(oldPath)
+	sig, damaged, repaired := filepath.Join(dir, "sig"), filepath.Join(dir, "damaged"), filepath.Join(dir, "repaired")
+
+	if err := run([]string{"signature", oldPath, sig}); err != nil {
+		t.Fatal(err)
+	}
+	oldData := readFile(t, oldPath)
+
+	flipped := append([]byte{}, oldData...)
+	flipped[fastcdc.MaxSize]++
+
+	// Swapping whole chunks keeps their boundaries, so they are found again.
+	chunks := rollingdiff.Signatures(oldData)
+	swapped := append([]byte{}, chunks[0].Bytes...)
+	swapped = append(append(swapped, chunks[2].Bytes...), chunks[1].Bytes...)
+	for _, c := range chunks[3:] {
+		swapped = append(swapped, c.Bytes...)
+	}
+
+	testCases := []struct {
+		name     string
+		data     []byte
+		expected []string
+		repaired bool
+	}{
+		{name: "intact file", data: oldData, repaired: true},
+		{name: "corrupted chunk", data: flipped, expected: []string{"corrupted", "digest mismatch", "cannot repair"}},
+		{name: "appended data", data: append(append([]byte{}, oldData...), "hello"...), expected: []string{"orphaned"}, repaired: true},
+		{name: "swapped chunks", data: swapped, expected: []string{"corrupted"}, repaired: true},
+		{name: "truncated file", data: oldData[:len(oldData)/2], expected: []string{"corrupted", "missing", "digest mismatch", "cannot repair"}},
+	}
+
+	for i, tc := range testCases {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			t.Logf(tc.name)
+
+			writeFile(t, damaged, tc.data)
+			os.Remove(repaired)
+
+			var err error
+			out := withStdio(t, nil, func() {
+				err = run([]string{"verify", "-repair", repaired, sig, damaged})
+			})
+
+			expected := exitSame
+			if len(tc.expected) > 0 {
+				expected = exitDiffer
+			}
+			if status := exitStatus(err); status != expected {
+				t.Fatalf("expected exit status %d, got %d (%v)", expected, status, err)
+			}
+			for _, s := range tc.expected {
+				if !bytes.Contains(out, []byte(s+":")) {
+					t.Fatalf("expected %q reported, got %q", s, out)
+				}
+			}
+
+			_, statErr := os.Stat(repaired)
+			if tc.repaired != (statErr == nil) {
+				t.Fatalf("expected repaired file written %v, got %v", tc.repaired, statErr)
+			}
+			if tc.repaired && !bytes.Equal(readFile(t, repaired), oldData) {
+				t.Fatalf("expected repaired file to equal original file")
+			}
+		})
+	}
+}
+
+func Test_Verify_Reports_Digest_Mismatch(t *testing.T) {
+	oldPath, _, _ := testFiles(t)
+	sigPath := filepath.Join(filepath.Dir(oldPath), "sig")
+
+	// Every chunk matches, but the digest of the whole file does not.
+	sig, err := makeSignature(readFile(t, oldPath), chunkOptions{Hash: "sha256"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var f sigFile
+	if err := decodeFile(sig, &f); err != nil {
+		t.Fatal(err)
+	}
+	f.Digest[0]++
+	if sig, err = encodeFile(sigMagic, &f); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, sigPath, sig)
+
+	var status int
+	out := withStdio(t, nil, func() {
+		status = exitStatus(run([]string{"verify", sigPath, oldPath}))
+	})
+	if status != exitDiffer || !bytes.HasPrefix(out, []byte("digest mismatch:")) {
+		t.Fatalf("expected exit status %d and digest mismatch reported, got %d and %q", exitDiffer, status, out)
+	}
+}
+
+func Test_Rejects_Invalid_Chunking_In_Files(t *testing.T) {
+	oldPath, newPath, _ := testFiles(t)
+	dir := filepath.Dir(oldPath)
+
+	sig, err := encodeFile(sigMagic, &sigFile{BlockSize: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	delta, err := encodeFile(deltaMagic, &deltaFile{Params: fastcdc.Params{MinSize: -5, NormalSize: 8192, MaxSize: 65536}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sigPath, deltaPath := filepath.Join(dir, "sig"), filepath.Join(dir, "delta")
+	writeFile(t, sigPath, sig)
+	writeFile(t, deltaPath, delta)
+
+	testCases := []struct {
+		name string
+		args []string
+	}{
+		{name: "signature with negative block size", args: []string{"delta", sigPath, newPath, filepath.Join(dir, "out")}},
+		{name: "delta with negative min size", args: []string{"patch", oldPath, deltaPath, filepath.Join(dir, "out")}},
+		{name: "stats of negative block size", args: []string{"stats", "-block", "-1", oldPath, newPath}},
+	}
+
+	for i, tc := range testCases {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			t.Logf(tc.name)
+
+			var err error
+			withStdio(t, nil, func() {
+				err = run(tc.args)
+			})
+			if status := exitStatus(err); status != exitError {
+				t.Fatalf("expected exit status %d, got %d (%v)", exitError, status, err)
+			}
+		})
+	}
+}
+
+func Test_Rejects_Malformed_Signature_Blocks(t *testing.T) {
+	oldPath, newPath, _ := testFiles(t)
+	dir := filepath.Dir(oldPath)
+
+	testCases := []struct {
+		name   string
+		blocks []rollingdiff.BlockSignature
+	}{
+		{name: "negative size", blocks: []rollingdiff.BlockSignature{{Index: 0, Size: 100}, {Index: 1, Size: -50}}},
+		{name: "zero size", blocks: []rollingdiff.BlockSignature{{Index: 0, Size: 0}}},
+		{name: "index out of place", blocks: []rollingdiff.BlockSignature{{Index: 1, Size: 100}}},
+	}
+
+	for i, tc := range testCases {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			t.Logf(tc.name)
+
+			sig, err := encodeFile(sigMagic, &sigFile{Blocks: tc.blocks})
+			if err != nil {
+				t.Fatal(err)
+			}
+			sigPath := filepath.Join(dir, "sig")
+			writeFile(t, sigPath, sig)
+
+			for _, args := range [][]string{
+				{"delta", "-append", sigPath, newPath, filepath.Join(dir, "delta")},
+				{"verify", sigPath, newPath},
+			} {
+				var err error
+				withStdio(t, nil, func() {
+					err = run(args)
+				})
+				if status := exitStatus(err); status != exitError {
+					t.Fatalf("expected exit status %d from %s, got %d (%v)", exitError, args[0], status, err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,11 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package patch
+
+import "os"
+
+// chown is a no-op on platforms without Unix file ownership.
+func chown(f *os.File, fi os.FileInfo) error {
+	return nil
+}
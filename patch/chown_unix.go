@@ -0,0 +1,25 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package patch
+
+import (
+	"os"
+	"syscall"
+)
+
+// chown gives `f` the owner and group of the file described by `fi`.
+func chown(f *os.File, fi os.FileInfo) error {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil
+	}
+
+	err := f.Chown(int(st.Uid), int(st.Gid))
+	if os.IsPermission(err) {
+		// Only privileged users may give files away. The file is then owned
+		// by whoever is patching it, as with any newly written file.
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,589 @@
+package patch
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/tuommaki/rollingdiff/rollingdiff"
+)
+
+// Suffixes of the files kept next to the file while it is patched in place.
+const (
+	// SpillSuffix is the suffix of the file holding data that in-place
+	// patching had to set aside.
+	SpillSuffix = ".spill"
+	// InPlaceJournalSuffix is the suffix of the journal of in-place
+	// patching. It differs from JournalSuffix of Writer, whose journal has
+	// another format.
+	InPlaceJournalSuffix = ".inplace-journal"
+)
+
+// ErrInterrupted is returned by InPlace when an interrupted in-place patch of
+// the same file exists. It must be finished with ResumeInPlace first.
+var ErrInterrupted = errors.New("patch: interrupted in-place patch exists")
+
+type stepKind int
+
+const (
+	// stepCopy copies data within the file.
+	stepCopy stepKind = iota
+	// stepSpilled writes data saved to the spill file.
+	stepSpilled
+	// stepLiteral writes literal data of an Add change.
+	stepLiteral
+)
+
+// step writes a single chunk of the result.
+type step struct {
+	Kind stepKind
+	// From is the source offset in the file for stepCopy, or in the spill
+	// file for stepSpilled.
+	From int64
+	// SpillFrom is the offset in the file a stepSpilled chunk is saved from.
+	SpillFrom int64
+	To        int64
+	Size      int
+	Signature [sha256.Size]byte
+	// Target is the index of the result chunk.
+	Target int
+	// Bytes is the content of a stepLiteral made by an Edit change. Base
+	// chunk of the edit may be overwritten before an interrupted patch is
+	// resumed, so the content is kept in the journal.
+	Bytes []byte
+}
+
+// plan is an ordering of writes, such that no region of the file is
+// overwritten before it has been read by every step needing it.
+type plan struct {
+	OldSize int64
+	NewSize int64
+	Steps   []step
+	// Kept are chunks already in place. They are not written, only
+	// verified before anything else is.
+	Kept []step
+}
+
+// spillDone is recorded in the journal once spill file has been written.
+const spillDone = ^uint64(0)
+
+// stepDone is called after every completed step. Tests use it to simulate
+// interruption.
+var stepDone = func(i int) error { return nil }
+
+// InPlace applies `changes` to the file at `path` without building the new
+// content in memory or on the side. `src` must describe current content of
+// the file, as returned by rollingdiff.Signatures; only offsets, sizes and
+// signatures of the chunks are used, the data is read from the file itself.
+// Every chunk of `src` kept in the result is verified before the file is
+// modified, including ones that stay in place.
+//
+// Writes are ordered so that no region is overwritten before it is read.
+// Chunks involved in cyclic dependencies, or overlapping their own
+// destination, are first saved to a spill file next to the patched file.
+// Progress is recorded in a journal, so that a crash in the middle of
+// patching can be recovered with ResumeInPlace.
+func InPlace(path string, src []rollingdiff.Chunk, changes []rollingdiff.Change) error {
+	if _, err := os.Stat(path + InPlaceJournalSuffix); err == nil {
+		return ErrInterrupted
+	}
+
+	resolved, edited, err := resolveEdits(path, src, changes)
+	if err != nil {
+		return err
+	}
+
+	segments, err := rollingdiff.Layout(src, resolved)
+	if err != nil {
+		return err
+	}
+
+	p := newPlan(src, segments)
+	for i, st := range p.Steps {
+		if st.Kind == stepLiteral {
+			p.Steps[i].Bytes = edited[st.Target]
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(&p); err != nil {
+		return err
+	}
+
+	journal, err := os.OpenFile(path+InPlaceJournalSuffix, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	defer journal.Close()
+
+	var length [8]byte
+	binary.BigEndian.PutUint64(length[:], uint64(buf.Len()))
+	if _, err := journal.Write(append(length[:], buf.Bytes()...)); err != nil {
+		return err
+	}
+	if err := journal.Sync(); err != nil {
+		return err
+	}
+
+	return execute(path, journal, p, 0, false, changes)
+}
+
+// ResumeInPlace finishes an in-place patch of the file at `path` that was
+// interrupted. The same `changes` that were given to InPlace must be passed.
+func ResumeInPlace(path string, changes []rollingdiff.Change) error {
+	journal, err := os.OpenFile(path+InPlaceJournalSuffix, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer journal.Close()
+
+	data, err := io.ReadAll(journal)
+	if err != nil {
+		return err
+	}
+
+	if len(data) < 8 {
+		// Crashed while writing the plan; nothing was modified yet.
+		journal.Close()
+		return os.Remove(path + InPlaceJournalSuffix)
+	}
+
+	n := binary.BigEndian.Uint64(data[:8])
+	if uint64(len(data)-8) < n {
+		journal.Close()
+		return os.Remove(path + InPlaceJournalSuffix)
+	}
+
+	var p plan
+	if err := gob.NewDecoder(bytes.NewReader(data[8 : 8+n])).Decode(&p); err != nil {
+		return fmt.Errorf("patch: corrupted journal: %w", err)
+	}
+
+	// Records are appended in order: spill completion first, followed by
+	// indexes of completed steps. Torn record at the end is ignored.
+	records := data[8+n:]
+	spilled := false
+	done := 0
+	for ; len(records) >= 8; records = records[8:] {
+		r := binary.BigEndian.Uint64(records[:8])
+		switch {
+		case r == spillDone && !spilled && done == 0:
+			spilled = true
+		case r == uint64(done):
+			done++
+		default:
+			return fmt.Errorf("patch: corrupted journal: unexpected record %d", r)
+		}
+	}
+
+	// Position for further records.
+	if _, err := journal.Seek(int64(8+n)+int64(8*done), io.SeekStart); err != nil {
+		return err
+	}
+	if spilled {
+		if _, err := journal.Seek(8, io.SeekCurrent); err != nil {
+			return err
+		}
+	}
+
+	return execute(path, journal, p, done, spilled, changes)
+}
+
+// resolveEdits returns `changes` with Edit changes turned into Add changes,
+// reading source chunks they copy from out of the file at `path`. Content
+// made by edits is also returned by result chunk index.
+func resolveEdits(path string, src []rollingdiff.Chunk, changes []rollingdiff.Change) ([]rollingdiff.Change, map[int][]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	edited := make(map[int][]byte)
+	resolved := make([]rollingdiff.Change, len(changes))
+	for i, c := range changes {
+		resolved[i] = c
+		if c.Op != rollingdiff.Edit {
+			continue
+		}
+
+		size := 0
+		for _, p := range c.Parts {
+			if p.Bytes == nil && p.Offset+p.Length > size {
+				size = p.Offset + p.Length
+			}
+		}
+
+		// Read as many chunks as the edit copies from.
+		base := make([]rollingdiff.Chunk, len(src))
+		for j, covered := c.From, 0; j >= 0 && j < len(src) && covered < size; j++ {
+			data, err := readVerified(f, int64(src[j].Offset), step{
+				Size:      len(src[j].Bytes),
+				Signature: src[j].Signature,
+				Target:    c.To,
+			})
+			if err != nil {
+				return nil, nil, err
+			}
+
+			base[j].Bytes = data
+			covered += len(data)
+		}
+
+		content, err := c.Content(base)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		resolved[i] = rollingdiff.Change{Op: rollingdiff.Add, To: c.To, Bytes: content}
+		edited[c.To] = content
+	}
+
+	return resolved, edited, nil
+}
+
+// newPlan orders writes of `segments` over the file described by `src`.
+func newPlan(src []rollingdiff.Chunk, segments []rollingdiff.Segment) plan {
+	var p plan
+	for _, c := range src {
+		p.OldSize += int64(len(c.Bytes))
+	}
+
+	var copies, literals []step
+	for i, s := range segments {
+		p.NewSize += int64(len(s.Chunk.Bytes))
+
+		st := step{
+			To:        int64(s.Chunk.Offset),
+			Size:      len(s.Chunk.Bytes),
+			Signature: s.Chunk.Signature,
+			Target:    i,
+		}
+
+		if s.Source < 0 {
+			st.Kind = stepLiteral
+			literals = append(literals, st)
+			continue
+		}
+
+		st.From = int64(src[s.Source].Offset)
+		if st.From == st.To {
+			p.Kept = append(p.Kept, st)
+			continue
+		}
+		copies = append(copies, st)
+	}
+
+	p.Steps = append(orderCopies(copies), literals...)
+	return p
+}
+
+// orderCopies orders copies so that data is read before it gets overwritten.
+// Copies that cannot be ordered are turned into spilled ones.
+func orderCopies(copies []step) []step {
+	// Sources of copies never overlap, so they can be searched by offset.
+	bySource := make([]int, len(copies))
+	for i := range bySource {
+		bySource[i] = i
+	}
+	sort.Slice(bySource, func(i, j int) bool {
+		return copies[bySource[i]].From < copies[bySource[j]].From
+	})
+
+	// Copies overlapping their own destination are always spilled.
+	spilled := make([]bool, len(copies))
+	for i, c := range copies {
+		spilled[i] = overlaps(c.From, c.Size, c.To, c.Size)
+	}
+
+	// Copy A must precede copy B when A reads from where B writes.
+	successors := make([][]int, len(copies))
+	inDegree := make([]int, len(copies))
+	for b, c := range copies {
+		first := sort.Search(len(bySource), func(k int) bool {
+			a := copies[bySource[k]]
+			return a.From+int64(a.Size) > c.To
+		})
+
+		for k := first; k < len(bySource); k++ {
+			a := bySource[k]
+			if copies[a].From >= c.To+int64(c.Size) {
+				break
+			}
+			if a == b || spilled[a] {
+				continue
+			}
+			successors[a] = append(successors[a], b)
+			inDegree[b]++
+		}
+	}
+
+	var order, ready []int
+	scheduled := make([]bool, len(copies))
+	for i := range copies {
+		if inDegree[i] == 0 {
+			ready = append(ready, i)
+		}
+	}
+
+	for len(order) < len(copies) {
+		if len(ready) == 0 {
+			// Every remaining copy waits for another one: break the cycle
+			// by saving the smallest one aside, which frees the region it
+			// reads from.
+			victim := -1
+			for i := range copies {
+				if !scheduled[i] && !spilled[i] && (victim < 0 || copies[i].Size < copies[victim].Size) {
+					victim = i
+				}
+			}
+
+			spilled[victim] = true
+			for _, s := range successors[victim] {
+				inDegree[s]--
+				if inDegree[s] == 0 {
+					ready = append(ready, s)
+				}
+			}
+			successors[victim] = nil
+			continue
+		}
+
+		i := ready[0]
+		ready = ready[1:]
+		scheduled[i] = true
+		order = append(order, i)
+
+		if spilled[i] {
+			// Spilled copies read from the spill file; whatever they
+			// delayed must have been released already.
+			continue
+		}
+
+		for _, s := range successors[i] {
+			inDegree[s]--
+			if inDegree[s] == 0 {
+				ready = append(ready, s)
+			}
+		}
+	}
+
+	var spillSize int64
+	ordered := make([]step, len(order))
+	for k, i := range order {
+		ordered[k] = copies[i]
+		if spilled[i] {
+			ordered[k].Kind = stepSpilled
+			ordered[k].SpillFrom = copies[i].From
+			ordered[k].From = spillSize
+			spillSize += int64(copies[i].Size)
+		}
+	}
+	return ordered
+}
+
+// execute runs steps of `p` starting from step `done`.
+func execute(path string, journal *os.File, p plan, done int, spilled bool, changes []rollingdiff.Change) error {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	spillFile, err := os.OpenFile(path+SpillSuffix, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer spillFile.Close()
+
+	record := func(records ...uint64) error {
+		buf := make([]byte, 8*len(records))
+		for i, r := range records {
+			binary.BigEndian.PutUint64(buf[8*i:], r)
+		}
+		if _, err := journal.Write(buf); err != nil {
+			return err
+		}
+		return journal.Sync()
+	}
+
+	if !spilled {
+		if err := prepare(f, spillFile, p); err != nil {
+			// Nothing has been modified, so the patch can be abandoned.
+			spillFile.Close()
+			journal.Close()
+			os.Remove(path + SpillSuffix)
+			os.Remove(path + InPlaceJournalSuffix)
+			return err
+		}
+		if err := record(spillDone); err != nil {
+			return err
+		}
+	}
+
+	// Growing the file first makes room for the new content. Shrinking is
+	// left to the end, since data beyond the new size may still be needed.
+	if fi, err := f.Stat(); err != nil {
+		return err
+	} else if fi.Size() < p.NewSize {
+		if err := f.Truncate(p.NewSize); err != nil {
+			return err
+		}
+	}
+
+	literals := make(map[int][]byte)
+	for _, c := range changes {
+		if c.Op == rollingdiff.Add {
+			literals[c.To] = c.Bytes
+		}
+	}
+
+	// Steps are synced and recorded in batches, and steps of an unrecorded
+	// batch are run again after an interruption. Their sources need to stay
+	// intact until then, so a batch ends before a step overwriting any of
+	// them.
+	var batch []uint64
+	batchBytes := 0
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		// Data must be on disk before the journal claims so.
+		if err := f.Sync(); err != nil {
+			return err
+		}
+		if err := record(batch...); err != nil {
+			return err
+		}
+		batch, batchBytes = batch[:0], 0
+		return nil
+	}
+
+	for i := done; i < len(p.Steps); i++ {
+		st := p.Steps[i]
+
+		for _, j := range batch {
+			b := p.Steps[j]
+			if b.Kind == stepCopy && overlaps(b.From, b.Size, st.To, st.Size) {
+				if err := flush(); err != nil {
+					return err
+				}
+				break
+			}
+		}
+
+		var data []byte
+		switch st.Kind {
+		case stepCopy:
+			data, err = readVerified(f, st.From, st)
+		case stepSpilled:
+			data, err = readVerified(spillFile, st.From, st)
+		case stepLiteral:
+			data = st.Bytes
+			if data == nil {
+				data = literals[st.Target]
+			}
+			if len(data) != st.Size || sha256.Sum256(data) != st.Signature {
+				err = fmt.Errorf("chunk %d: %w", st.Target, ErrChunkMismatch)
+			}
+		}
+		if err != nil {
+			return err
+		}
+
+		if _, err := f.WriteAt(data, st.To); err != nil {
+			return err
+		}
+
+		batch = append(batch, uint64(i))
+		batchBytes += st.Size
+		if batchBytes >= syncBytes {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+
+		if err := stepDone(i); err != nil {
+			return err
+		}
+	}
+
+	if err := flush(); err != nil {
+		return err
+	}
+
+	if err := f.Truncate(p.NewSize); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+
+	spillFile.Close()
+	if err := os.Remove(path + SpillSuffix); err != nil {
+		return err
+	}
+
+	journal.Close()
+	return os.Remove(path + InPlaceJournalSuffix)
+}
+
+// prepare verifies that the file is still the one `p` was made for and saves
+// data of spilled steps to `spillFile`.
+func prepare(f, spillFile *os.File, p plan) error {
+	if fi, err := f.Stat(); err != nil {
+		return err
+	} else if fi.Size() != p.OldSize {
+		return fmt.Errorf("patch: file size %d, expected %d: %w", fi.Size(), p.OldSize, ErrChunkMismatch)
+	}
+
+	for _, st := range p.Kept {
+		if _, err := readVerified(f, st.From, st); err != nil {
+			return err
+		}
+	}
+
+	for _, st := range p.Steps {
+		switch st.Kind {
+		case stepCopy:
+			if _, err := readVerified(f, st.From, st); err != nil {
+				return err
+			}
+		case stepSpilled:
+			data, err := readVerified(f, st.SpillFrom, st)
+			if err != nil {
+				return err
+			}
+			if _, err := spillFile.WriteAt(data, st.From); err != nil {
+				return err
+			}
+		}
+	}
+
+	return spillFile.Sync()
+}
+
+// overlaps reports whether ranges of `aSize` bytes at `aFrom` and `bSize`
+// bytes at `bFrom` overlap.
+func overlaps(aFrom int64, aSize int, bFrom int64, bSize int) bool {
+	return aFrom < bFrom+int64(bSize) && bFrom < aFrom+int64(aSize)
+}
+
+func readVerified(r io.ReaderAt, offset int64, st step) ([]byte, error) {
+	data := make([]byte, st.Size)
+	if _, err := r.ReadAt(data, offset); err != nil {
+		return nil, err
+	}
+
+	if sha256.Sum256(data) != st.Signature {
+		return nil, fmt.Errorf("chunk %d: %w", st.Target, ErrChunkMismatch)
+	}
+
+	return data, nil
+}
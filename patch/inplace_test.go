@@ -0,0 +1,267 @@
+package patch
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/tuommaki/rollingdiff/fastcdc"
+	"github.com/tuommaki/rollingdiff/internal/testutil"
+	"github.com/tuommaki/rollingdiff/rollingdiff"
+)
+
+func concat(parts ...[]byte) []byte {
+	var buf []byte
+	for _, p := range parts {
+		buf = append(buf, p...)
+	}
+	return buf
+}
+
+func Test_InPlace(t *testing.T) {
+	a := testutil.RandomBytes(t, 1, 4*fastcdc.MaxSize)
+	b := testutil.RandomBytes(t, 2, 4*fastcdc.MaxSize)
+	c := testutil.RandomBytes(t, 3, 2*fastcdc.MaxSize)
+	lit := testutil.RandomBytes(t, 4, 3000)
+
+	testCases := []struct {
+		name    string
+		oldData []byte
+		newData []byte
+		spills  bool
+	}{
+		{name: "no changes", oldData: concat(a, b), newData: concat(a, b)},
+		{name: "append", oldData: concat(a, b), newData: concat(a, b, lit)},
+		{name: "insert at the beginning", oldData: concat(a, b), newData: concat(lit, a, b), spills: true},
+		{name: "delete from the beginning", oldData: concat(lit, a, b), newData: concat(a, b), spills: true},
+		{name: "swap", oldData: concat(a, b), newData: concat(b, a), spills: true},
+		{name: "rotate and replace", oldData: concat(a, b, c), newData: concat(c, lit, a, lit)},
+		{name: "truncate", oldData: concat(a, b, c), newData: concat(b)},
+		{name: "empty result", oldData: concat(a), newData: nil},
+		{name: "from empty", oldData: nil, newData: concat(lit, c)},
+	}
+
+	for i, tc := range testCases {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			t.Logf(tc.name)
+
+			path := filepath.Join(t.TempDir(), "file")
+			if err := ioutil.WriteFile(path, tc.oldData, 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			src := rollingdiff.Signatures(tc.oldData)
+			changes := rollingdiff.Delta(src, rollingdiff.Signatures(tc.newData))
+
+			if tc.spills {
+				segments, err := rollingdiff.Layout(src, changes)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				spills := false
+				for _, st := range newPlan(src, segments).Steps {
+					spills = spills || st.Kind == stepSpilled
+				}
+				if !spills {
+					t.Fatalf("expected plan to spill data")
+				}
+			}
+
+			if err := InPlace(path, src, changes); err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(readFile(t, path), tc.newData) {
+				t.Fatalf("expected patched file to equal new data")
+			}
+
+			for _, suffix := range []string{InPlaceJournalSuffix, SpillSuffix} {
+				if _, err := os.Stat(path + suffix); !os.IsNotExist(err) {
+					t.Fatalf("expected %s file to be removed, got %v", suffix, err)
+				}
+			}
+		})
+	}
+}
+
+func Test_InPlace_Resumes_After_Interruption(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "file")
+
+	a := testutil.RandomBytes(t, 1, 4*fastcdc.MaxSize)
+	b := testutil.RandomBytes(t, 2, 4*fastcdc.MaxSize)
+	oldData := concat(a, b)
+	newData := concat(b, testutil.RandomBytes(t, 3, 3000), a)
+
+	if err := ioutil.WriteFile(path, oldData, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	src := rollingdiff.Signatures(oldData)
+	changes := rollingdiff.Delta(src, rollingdiff.Signatures(newData))
+
+	errCrash := errors.New("crash")
+	stepDone = func(i int) error {
+		if i == 3 {
+			return errCrash
+		}
+		return nil
+	}
+	defer func() { stepDone = func(int) error { return nil } }()
+
+	if err := InPlace(path, src, changes); !errors.Is(err, errCrash) {
+		t.Fatalf("expected simulated crash, got %v", err)
+	}
+	stepDone = func(int) error { return nil }
+
+	if err := InPlace(path, src, changes); !errors.Is(err, ErrInterrupted) {
+		t.Fatalf("expected ErrInterrupted, got %v", err)
+	}
+
+	// Simulate torn journal record written during the crash.
+	f, err := os.OpenFile(path+InPlaceJournalSuffix, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte{0, 0, 0})
+	f.Close()
+
+	if err := ResumeInPlace(path, changes); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(readFile(t, path), newData) {
+		t.Fatalf("expected patched file to equal new data")
+	}
+}
+
+func Test_InPlace_Resumes_After_Interruption_At_Any_Step(t *testing.T) {
+	oldData := testutil.RandomBytes(t, 1, 16*fastcdc.MaxSize)
+	// Shifting the data makes most copies overwrite sources of others.
+	newData := concat(testutil.RandomBytes(t, 2, 3000), oldData[:8*fastcdc.MaxSize], testutil.RandomBytes(t, 3, 5000), oldData[8*fastcdc.MaxSize:])
+
+	src := rollingdiff.Signatures(oldData)
+	changes := rollingdiff.Delta(src, rollingdiff.Signatures(newData))
+
+	errCrash := errors.New("crash")
+	defer func() { stepDone = func(int) error { return nil } }()
+
+	for crash := 0; ; crash++ {
+		path := filepath.Join(t.TempDir(), "file")
+		if err := ioutil.WriteFile(path, oldData, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		stepDone = func(i int) error {
+			if i == crash {
+				return errCrash
+			}
+			return nil
+		}
+
+		err := InPlace(path, src, changes)
+		stepDone = func(int) error { return nil }
+		if err == nil {
+			// Crash point is past the last step.
+			break
+		}
+		if !errors.Is(err, errCrash) {
+			t.Fatalf("expected simulated crash at step %d, got %v", crash, err)
+		}
+
+		if err := ResumeInPlace(path, changes); err != nil {
+			t.Fatalf("resuming after crash at step %d: %v", crash, err)
+		}
+		if !bytes.Equal(readFile(t, path), newData) {
+			t.Fatalf("expected patched file to equal new data after crash at step %d", crash)
+		}
+	}
+}
+
+func Test_InPlace_Rejects_Different_File(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "file")
+
+	oldData := testutil.RandomBytes(t, 1, 4*fastcdc.MaxSize)
+	newData := concat(testutil.RandomBytes(t, 2, 3000), oldData)
+
+	src := rollingdiff.Signatures(oldData)
+	changes := rollingdiff.Delta(src, rollingdiff.Signatures(newData))
+
+	// Same size, different content.
+	if err := ioutil.WriteFile(path, testutil.RandomBytes(t, 3, len(oldData)), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := InPlace(path, src, changes); !errors.Is(err, ErrChunkMismatch) {
+		t.Fatalf("expected ErrChunkMismatch, got %v", err)
+	}
+
+	if _, err := os.Stat(path + InPlaceJournalSuffix); !os.IsNotExist(err) {
+		t.Fatalf("expected journal to be removed, got %v", err)
+	}
+}
+
+func Test_InPlace_Rejects_File_Differing_Where_Data_Stays(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "file")
+
+	oldData := testutil.RandomBytes(t, 1, 4*fastcdc.MaxSize)
+	newData := concat(oldData, testutil.RandomBytes(t, 2, 3000))
+
+	src := rollingdiff.Signatures(oldData)
+	changes := rollingdiff.Delta(src, rollingdiff.Signatures(newData))
+
+	// The first chunk stays in place, and only data after it is written.
+	stale := append([]byte{}, oldData...)
+	stale[0] = ^stale[0]
+	if err := ioutil.WriteFile(path, stale, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := InPlace(path, src, changes); !errors.Is(err, ErrChunkMismatch) {
+		t.Fatalf("expected ErrChunkMismatch, got %v", err)
+	}
+
+	if !bytes.Equal(readFile(t, path), stale) {
+		t.Fatalf("expected file to be left as it was")
+	}
+}
+
+func Test_InPlace_Applies_Edits(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "file")
+
+	oldData := testutil.RandomBytes(t, 1, 8*fastcdc.MaxSize)
+	mid := len(oldData) / 2
+	newData := concat(oldData[:mid], []byte("hello, world"), oldData[mid:], oldData[:fastcdc.MaxSize])
+
+	if err := ioutil.WriteFile(path, oldData, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	src := rollingdiff.Signatures(oldData)
+	changes, err := rollingdiff.Refine(src, rollingdiff.Delta(src, rollingdiff.Signatures(newData)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	edits := 0
+	for _, c := range changes {
+		if c.Op == rollingdiff.Edit {
+			edits++
+		}
+	}
+	if edits == 0 {
+		t.Fatalf("expected refined delta to contain edits")
+	}
+
+	if err := InPlace(path, src, changes); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(readFile(t, path), newData) {
+		t.Fatalf("expected patched file to equal new data")
+	}
+}
@@ -0,0 +1,196 @@
+package patch
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/tuommaki/rollingdiff/rollingdiff"
+)
+
+// ErrDigestMismatch is returned when content written to disk does not read
+// back as it was written.
+var ErrDigestMismatch = errors.New("patch: written file does not match expected digest")
+
+// Options controls atomic replacement of files.
+type Options struct {
+	// BackupSuffix, if not empty, keeps the previous version of the file
+	// next to it, with the suffix appended to its name.
+	BackupSuffix string
+}
+
+// Replace atomically replaces content of the file at `path` with `data`.
+// Content is written to a temporary file in the same directory, read back
+// and verified, synced to disk and renamed over the original, so that
+// readers see either the old or the new content, never a mix. Mode and,
+// where supported, ownership of the original file are preserved, and a
+// symbolic link is replaced at its target. If the file does not exist, it is
+// created with permissions 0666 before umask, as os.Create does.
+func Replace(path string, data []byte, opts Options) error {
+	return replace(path, bytes.NewReader(data), sha256.Sum256(data), opts)
+}
+
+// ApplyAtomic applies patch `p` to `src` chunks, as Patch.Apply does, and
+// atomically replaces the file at `path` with the result. Neither a wrong
+// base nor a result other than the one the patch expects is installed, and
+// the written file is verified against that expected result.
+func ApplyAtomic(path string, src []rollingdiff.Chunk, p rollingdiff.Patch, opts Options) error {
+	data, err := p.Apply(src)
+	if err != nil {
+		return err
+	}
+
+	return replace(path, bytes.NewReader(data), p.Result, opts)
+}
+
+// preservedMode are the mode bits carried over from the replaced file.
+const preservedMode = os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky
+
+func replace(path string, r io.Reader, digest [sha256.Size]byte, opts Options) error {
+	if target, err := filepath.EvalSymlinks(path); err == nil {
+		path = target
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	dir, name := filepath.Split(path)
+	if dir == "" {
+		dir = "."
+	}
+
+	orig, err := os.Stat(path)
+	exists := err == nil
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	// New files get their permissions from the umask. Existing ones get
+	// theirs once the content is written.
+	perm := os.FileMode(0666)
+	if exists {
+		perm = 0600
+	}
+	tmp, err := createTemp(dir, "."+name+".tmp", perm)
+	if err != nil {
+		return err
+	}
+
+	// Temporary file is removed unless it has been renamed in place.
+	renamed := false
+	defer func() {
+		tmp.Close()
+		if !renamed {
+			os.Remove(tmp.Name())
+		}
+	}()
+
+	if _, err := io.Copy(tmp, r); err != nil {
+		return err
+	}
+
+	if err := tmp.Sync(); err != nil {
+		return err
+	}
+
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, tmp); err != nil {
+		return err
+	}
+	if !bytes.Equal(h.Sum(nil), digest[:]) {
+		return ErrDigestMismatch
+	}
+
+	if exists {
+		// Changing owner may clear setuid and setgid bits, so mode is set
+		// after it.
+		if err := chown(tmp, orig); err != nil {
+			return err
+		}
+		if err := tmp.Chmod(orig.Mode() & preservedMode); err != nil {
+			return err
+		}
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if exists && opts.BackupSuffix != "" {
+		if err := backup(path, path+opts.BackupSuffix); err != nil {
+			return err
+		}
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	renamed = true
+
+	return syncDir(dir)
+}
+
+// backup makes `dst` a copy of `src`, replacing any earlier backup. A hard
+// link is used if possible.
+func backup(src, dst string) error {
+	if err := os.Remove(dst); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+
+	fi, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+
+	data, err := ioutil.ReadFile(src)
+	if err != nil {
+		return err
+	}
+
+	if err := Replace(dst, data, Options{}); err != nil {
+		return err
+	}
+
+	return os.Chmod(dst, fi.Mode()&preservedMode)
+}
+
+// createTemp creates a new file in `dir` with a name starting with
+// `prefix`, like ioutil.TempFile, but with permissions `perm` before umask.
+func createTemp(dir, prefix string, perm os.FileMode) (*os.File, error) {
+	var err error
+	for i := 0; i < 10000; i++ {
+		name := filepath.Join(dir, prefix+strconv.FormatUint(uint64(rand.Uint32()), 10))
+
+		var f *os.File
+		f, err = os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, perm)
+		if !os.IsExist(err) {
+			return f, err
+		}
+	}
+	return nil, err
+}
+
+// syncDir makes a rename within directory `dir` durable. Not all platforms
+// support syncing directories, so failure to do so is ignored.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	d.Sync()
+	return nil
+}
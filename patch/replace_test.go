@@ -0,0 +1,189 @@
+package patch
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/tuommaki/rollingdiff/fastcdc"
+	"github.com/tuommaki/rollingdiff/internal/testutil"
+	"github.com/tuommaki/rollingdiff/rollingdiff"
+)
+
+func Test_ApplyAtomic_Keeps_Backup_And_Mode(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "file")
+
+	oldData := testutil.RandomBytes(t, 1, 4*fastcdc.MaxSize)
+	newData := concat(oldData[:fastcdc.MaxSize], testutil.RandomBytes(t, 2, 3000), oldData[2*fastcdc.MaxSize:])
+
+	if err := ioutil.WriteFile(path, oldData, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(path, 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	src := rollingdiff.Signatures(oldData)
+	p := rollingdiff.NewPatch(src, rollingdiff.Signatures(newData))
+
+	if err := ApplyAtomic(path, src, p, Options{BackupSuffix: ".orig"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(readFile(t, path), newData) {
+		t.Fatalf("expected patched file to equal new data")
+	}
+	if !bytes.Equal(readFile(t, path+".orig"), oldData) {
+		t.Fatalf("expected backup to equal old data")
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0640 {
+		t.Fatalf("expected mode %v, got %v", os.FileMode(0640), fi.Mode().Perm())
+	}
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("expected only file and its backup in directory, got %d entries", len(entries))
+	}
+}
+
+func Test_ApplyAtomic_Rejects_Unexpected_Result(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "file")
+
+	oldData := testutil.RandomBytes(t, 1, 4*fastcdc.MaxSize)
+	newData := concat(oldData, testutil.RandomBytes(t, 2, 3000))
+	if err := ioutil.WriteFile(path, oldData, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	src := rollingdiff.Signatures(oldData)
+	p := rollingdiff.NewPatch(src, rollingdiff.Signatures(newData))
+
+	// Changes of the patch no longer make the result it expects.
+	wrong := p
+	wrong.Result = sha256.Sum256([]byte("hello"))
+	if err := ApplyAtomic(path, src, wrong, Options{}); !errors.Is(err, rollingdiff.ErrResultMismatch) {
+		t.Fatalf("expected rollingdiff.ErrResultMismatch, got %v", err)
+	}
+
+	// Chunks of other data than the patch is made for.
+	other := rollingdiff.Signatures(testutil.RandomBytes(t, 3, len(oldData)))
+	if err := ApplyAtomic(path, other, p, Options{}); !errors.Is(err, rollingdiff.ErrBaseMismatch) {
+		t.Fatalf("expected rollingdiff.ErrBaseMismatch, got %v", err)
+	}
+
+	if !bytes.Equal(readFile(t, path), oldData) {
+		t.Fatalf("expected file to be left as it was")
+	}
+}
+
+func Test_Replace_Creates_File(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "file")
+	data := testutil.RandomBytes(t, 1, 1000)
+
+	if err := Replace(path, data, Options{BackupSuffix: ".orig"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(readFile(t, path), data) {
+		t.Fatalf("expected file to equal data")
+	}
+
+	if _, err := os.Stat(path + ".orig"); !os.IsNotExist(err) {
+		t.Fatalf("expected no backup of non-existent file, got %v", err)
+	}
+}
+
+func Test_Replace_Creates_File_With_Umask_Permissions(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "file")
+
+	// Reference file gets permissions the same way as os.Create does.
+	ref := filepath.Join(dir, "ref")
+	if err := ioutil.WriteFile(ref, nil, 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Replace(path, testutil.RandomBytes(t, 1, 1000), Options{}); err != nil {
+		t.Fatal(err)
+	}
+
+	expected, got := stat(t, ref).Mode(), stat(t, path).Mode()
+	if got != expected {
+		t.Fatalf("expected mode %v, got %v", expected, got)
+	}
+}
+
+func Test_Replace_Keeps_Setuid_Bit(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("no setuid bit on windows")
+	}
+
+	path := filepath.Join(t.TempDir(), "file")
+	if err := ioutil.WriteFile(path, testutil.RandomBytes(t, 1, 1000), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(path, os.ModeSetuid|0750); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Replace(path, testutil.RandomBytes(t, 2, 1000), Options{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if mode := stat(t, path).Mode(); mode != os.ModeSetuid|0750 {
+		t.Fatalf("expected mode %v, got %v", os.ModeSetuid|0750, mode)
+	}
+}
+
+func Test_Replace_Follows_Symlink(t *testing.T) {
+	dir := t.TempDir()
+	target := filepath.Join(dir, "target")
+	link := filepath.Join(dir, "link")
+
+	if err := ioutil.WriteFile(target, testutil.RandomBytes(t, 1, 1000), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(target, link); err != nil {
+		t.Skipf("symbolic links not supported: %v", err)
+	}
+
+	data := testutil.RandomBytes(t, 2, 1000)
+	if err := Replace(link, data, Options{}); err != nil {
+		t.Fatal(err)
+	}
+
+	fi, err := os.Lstat(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode()&os.ModeSymlink == 0 {
+		t.Fatalf("expected link to remain a symbolic link, got mode %v", fi.Mode())
+	}
+	if !bytes.Equal(readFile(t, target), data) {
+		t.Fatalf("expected target of link to equal data")
+	}
+}
+
+func stat(t *testing.T, path string) os.FileInfo {
+	t.Helper()
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fi
+}
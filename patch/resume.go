@@ -0,0 +1,334 @@
+// Package patch writes results of delta application and file reconstruction
+// to disk.
+package patch
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/tuommaki/rollingdiff/rollingdiff"
+)
+
+// Suffixes of the files kept next to the destination while a reconstruction
+// is in progress.
+const (
+	PartSuffix    = ".part"
+	JournalSuffix = ".journal"
+)
+
+const journalHeader = "rollingdiff-journal v1 "
+
+// syncBytes is the amount of data written between syncs of the written file
+// and its journal. Work done since the last sync is repeated after an
+// interruption.
+const syncBytes = 8 << 20
+
+// ErrChunkMismatch is returned when data written for a chunk does not match
+// its signature.
+var ErrChunkMismatch = errors.New("patch: chunk does not match its signature")
+
+// Target describes a chunk of the file being reconstructed.
+type Target struct {
+	Offset    int
+	Size      int
+	Signature [sha256.Size]byte
+}
+
+// Targets describes `chunks` as reconstruction targets.
+func Targets(chunks []rollingdiff.Chunk) []Target {
+	targets := make([]Target, len(chunks))
+	for i, c := range chunks {
+		targets[i] = Target{
+			Offset:    c.Offset,
+			Size:      len(c.Bytes),
+			Signature: c.Signature,
+		}
+	}
+	return targets
+}
+
+// Writer reconstructs a file chunk by chunk, and only needs content of the
+// chunk being written, which makes it suitable for files of any size.
+// Content is written into a temporary file next to the destination, and
+// completed chunks are recorded in a journal once they are synced to disk,
+// every few megabytes. When reconstruction of the same targets is resumed
+// after an interruption, chunks recorded in the journal are verified against
+// their signatures and skipped if intact.
+type Writer struct {
+	path    string
+	part    *os.File
+	journal *os.File
+	targets []Target
+	done    []bool
+	closed  bool
+
+	// unsynced are written chunks not yet recorded in the journal.
+	unsynced      []int
+	unsyncedBytes int
+}
+
+// Resume starts or continues reconstruction of `path` consisting of
+// `targets`. Targets must be consecutive, starting from offset zero.
+func Resume(path string, targets []Target) (*Writer, error) {
+	offset := 0
+	for i, t := range targets {
+		if t.Offset != offset || t.Size < 0 {
+			return nil, fmt.Errorf("patch: target %d at offset %d, expected %d", i, t.Offset, offset)
+		}
+		offset += t.Size
+	}
+
+	part, err := os.OpenFile(path+PartSuffix, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	journal, err := os.OpenFile(path+JournalSuffix, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		part.Close()
+		return nil, err
+	}
+
+	w := &Writer{
+		path:    path,
+		part:    part,
+		journal: journal,
+		targets: targets,
+		done:    make([]bool, len(targets)),
+	}
+
+	if err := w.recover(); err != nil {
+		w.Close()
+		return nil, err
+	}
+
+	return w, nil
+}
+
+// Pending returns indexes of targets that are still to be written.
+func (w *Writer) Pending() []int {
+	var pending []int
+	for i, done := range w.done {
+		if !done {
+			pending = append(pending, i)
+		}
+	}
+	return pending
+}
+
+// Done reports whether target `i` has been written.
+func (w *Writer) Done(i int) bool {
+	return w.done[i]
+}
+
+// Write verifies that `data` matches target `i` and writes it to its place.
+// It is recorded in the journal with the next sync.
+func (w *Writer) Write(i int, data []byte) error {
+	t := w.targets[i]
+	if len(data) != t.Size || sha256.Sum256(data) != t.Signature {
+		return fmt.Errorf("target %d: %w", i, ErrChunkMismatch)
+	}
+
+	if w.done[i] {
+		return nil
+	}
+
+	if _, err := w.part.WriteAt(data, int64(t.Offset)); err != nil {
+		return err
+	}
+
+	w.done[i] = true
+	w.unsynced = append(w.unsynced, i)
+	w.unsyncedBytes += len(data)
+	if w.unsyncedBytes >= syncBytes {
+		return w.Sync()
+	}
+	return nil
+}
+
+// Sync makes written chunks durable and records them in the journal.
+func (w *Writer) Sync() error {
+	if len(w.unsynced) == 0 {
+		return nil
+	}
+
+	// Data must be on disk before the journal claims so.
+	if err := w.part.Sync(); err != nil {
+		return err
+	}
+
+	var records []byte
+	for _, i := range w.unsynced {
+		records = strconv.AppendInt(records, int64(i), 10)
+		records = append(records, '\n')
+	}
+	if _, err := w.journal.Write(records); err != nil {
+		return err
+	}
+	if err := w.journal.Sync(); err != nil {
+		return err
+	}
+
+	w.unsynced = w.unsynced[:0]
+	w.unsyncedBytes = 0
+	return nil
+}
+
+// Commit finishes the reconstruction by moving the temporary file to its
+// destination and removing the journal. All targets must have been written.
+func (w *Writer) Commit() error {
+	if pending := w.Pending(); len(pending) > 0 {
+		return fmt.Errorf("patch: %d targets not written", len(pending))
+	}
+
+	size := 0
+	if n := len(w.targets); n > 0 {
+		size = w.targets[n-1].Offset + w.targets[n-1].Size
+	}
+
+	if err := w.part.Truncate(int64(size)); err != nil {
+		return err
+	}
+	if err := w.part.Sync(); err != nil {
+		return err
+	}
+
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(w.path+PartSuffix, w.path); err != nil {
+		return err
+	}
+
+	return os.Remove(w.path + JournalSuffix)
+}
+
+// Close syncs written chunks and releases the files held by the writer,
+// leaving them in place for resuming later. Closing again does nothing.
+func (w *Writer) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+
+	err := w.Sync()
+	if perr := w.part.Close(); err == nil {
+		err = perr
+	}
+	if jerr := w.journal.Close(); err == nil {
+		err = jerr
+	}
+	return err
+}
+
+// recover reads the journal and marks intact chunks as done. Journal of
+// different targets is discarded.
+func (w *Writer) recover() error {
+	header := journalHeader + w.identity() + "\n"
+
+	r := bufio.NewReader(w.journal)
+	line, err := r.ReadString('\n')
+	if err != nil && err != io.EOF {
+		return err
+	}
+
+	if line != header {
+		return w.reset(header)
+	}
+
+	for {
+		line, err := r.ReadString('\n')
+		if err == io.EOF {
+			// Incomplete last record, if any, is ignored.
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		i, err := strconv.Atoi(strings.TrimSuffix(line, "\n"))
+		if err != nil || i < 0 || i >= len(w.targets) {
+			continue
+		}
+
+		t := w.targets[i]
+		data := make([]byte, t.Size)
+		if _, err := w.part.ReadAt(data, int64(t.Offset)); err != nil && err != io.EOF {
+			return err
+		}
+
+		if sha256.Sum256(data) == t.Signature {
+			w.done[i] = true
+		}
+	}
+
+	// Continue appending after what was read.
+	_, err = w.journal.Seek(0, io.SeekEnd)
+	return err
+}
+
+func (w *Writer) reset(header string) error {
+	if err := w.part.Truncate(0); err != nil {
+		return err
+	}
+	if err := w.journal.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := w.journal.WriteAt([]byte(header), 0); err != nil {
+		return err
+	}
+	if _, err := w.journal.Seek(int64(len(header)), io.SeekStart); err != nil {
+		return err
+	}
+	return w.journal.Sync()
+}
+
+// identity is a digest of the target list, tying journal to it.
+func (w *Writer) identity() string {
+	h := sha256.New()
+	var buf [8]byte
+	for _, t := range w.targets {
+		binary.BigEndian.PutUint64(buf[:], uint64(t.Size))
+		h.Write(buf[:])
+		h.Write(t.Signature[:])
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// ApplyResumable applies `changes` to `src` chunks, as rollingdiff.Apply
+// does, writing the result to `path`. If an earlier attempt to apply the same
+// delta was interrupted, chunks it completed are not written again.
+//
+// Content of `src` and of the changes is held in memory, as it is for
+// rollingdiff.Apply, so this suits files that fit in memory. Files too large
+// for that are reconstructed with Writer directly, reading the content of
+// each pending chunk only when it is written.
+func ApplyResumable(path string, src []rollingdiff.Chunk, changes []rollingdiff.Change) error {
+	chunks, err := rollingdiff.ApplyChunks(src, changes)
+	if err != nil {
+		return err
+	}
+
+	w, err := Resume(path, Targets(chunks))
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+
+	for _, i := range w.Pending() {
+		if err := w.Write(i, chunks[i].Bytes); err != nil {
+			return err
+		}
+	}
+
+	return w.Commit()
+}
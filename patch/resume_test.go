@@ -0,0 +1,172 @@
+package patch
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/tuommaki/rollingdiff/fastcdc"
+	"github.com/tuommaki/rollingdiff/internal/testutil"
+	"github.com/tuommaki/rollingdiff/rollingdiff"
+)
+
+func readFile(t *testing.T, path string) []byte {
+	t.Helper()
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func Test_Writer_Resumes_After_Interruption(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "file")
+	data := testutil.RandomBytes(t, 1, 8*fastcdc.MaxSize)
+	chunks := rollingdiff.Signatures(data)
+
+	w, err := Resume(path, Targets(chunks))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	half := len(chunks) / 2
+	for i := 0; i < half; i++ {
+		if err := w.Write(i, chunks[i].Bytes); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Simulate interruption.
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Damage one of the completed chunks on disk.
+	f, err := os.OpenFile(path+PartSuffix, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte{^chunks[1].Bytes[0]}, int64(chunks[1].Offset)); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	w, err = Resume(path, Targets(chunks))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pending := w.Pending()
+	if len(pending) != len(chunks)-half+1 || pending[0] != 1 {
+		t.Fatalf("expected chunk 1 and chunks from %d on to be pending, got %v", half, pending)
+	}
+
+	for _, i := range pending {
+		if err := w.Write(i, chunks[i].Bytes); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := w.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(readFile(t, path), data) {
+		t.Fatalf("expected written file to equal data")
+	}
+
+	for _, suffix := range []string{PartSuffix, JournalSuffix} {
+		if _, err := os.Stat(path + suffix); !os.IsNotExist(err) {
+			t.Fatalf("expected %s to be removed, got %v", path+suffix, err)
+		}
+	}
+}
+
+func Test_Writer_Records_Chunks_In_Journal_On_Sync(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "file")
+	chunks := rollingdiff.Signatures(testutil.RandomBytes(t, 1, 4*fastcdc.MaxSize))
+
+	w, err := Resume(path, Targets(chunks))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	// A single small chunk does not make the writer sync.
+	if err := w.Write(0, chunks[0].Bytes); err != nil {
+		t.Fatal(err)
+	}
+	header := len(readFile(t, path+JournalSuffix))
+
+	if err := w.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(readFile(t, path+JournalSuffix)); n != header+len("0\n") {
+		t.Fatalf("expected journal of %d bytes after sync, got %d", header+len("0\n"), n)
+	}
+}
+
+func Test_Writer_Discards_Journal_Of_Other_Targets(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "file")
+	chunks := rollingdiff.Signatures(testutil.RandomBytes(t, 1, 4*fastcdc.MaxSize))
+	otherChunks := rollingdiff.Signatures(testutil.RandomBytes(t, 2, 4*fastcdc.MaxSize))
+
+	w, err := Resume(path, Targets(chunks))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Write(0, chunks[0].Bytes); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	w, err = Resume(path, Targets(otherChunks))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	if len(w.Pending()) != len(otherChunks) {
+		t.Fatalf("expected all %d chunks to be pending, got %d", len(otherChunks), len(w.Pending()))
+	}
+}
+
+func Test_Writer_Rejects_Wrong_Content(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "file")
+	chunks := rollingdiff.Signatures(testutil.RandomBytes(t, 1, 4*fastcdc.MaxSize))
+
+	w, err := Resume(path, Targets(chunks))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	if err := w.Write(0, chunks[1].Bytes); err == nil {
+		t.Fatalf("expected error when writing wrong content")
+	}
+
+	if err := w.Commit(); err == nil {
+		t.Fatalf("expected error when committing incomplete file")
+	}
+}
+
+func Test_ApplyResumable(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "file")
+
+	oldData := testutil.RandomBytes(t, 1, 8*fastcdc.MaxSize)
+	newData := append(testutil.RandomBytes(t, 2, 3000), oldData[fastcdc.MaxSize:]...)
+
+	oldChunks := rollingdiff.Signatures(oldData)
+	changes := rollingdiff.Delta(oldChunks, rollingdiff.Signatures(newData))
+
+	if err := ApplyResumable(path, oldChunks, changes); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(readFile(t, path), newData) {
+		t.Fatalf("expected written file to equal new data")
+	}
+}
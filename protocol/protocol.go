@@ -0,0 +1,266 @@
+// Package protocol implements rsync style synchronization of a single file
+// between two processes connected by a bidirectional stream.
+//
+// The exchange goes as follows:
+//
+//  1. Receiver, holding the old version of the data, sends its chunk
+//     signatures together with the chunking parameters it used. With fixed
+//     size blocks, signatures include sizes and weak checksums of blocks.
+//  2. Sender chunks the new version of the data with the same parameters,
+//     or searches it for the blocks at any offset, computes the delta
+//     against received signatures and streams the
+//     changes, including literal data of added chunks, followed by the size
+//     and SHA-256 digest of the new version.
+//  3. Receiver applies the changes to its old data, verifies the result and
+//     replies with the digest of what it produced.
+//
+// Messages are encoded with encoding/gob.
+package protocol
+
+import (
+	"crypto/sha256"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/tuommaki/rollingdiff/fastcdc"
+	"github.com/tuommaki/rollingdiff/rollingdiff"
+)
+
+// Version of the protocol. Peers with different versions refuse to talk to
+// each other.
+const Version = 2
+
+var (
+	// ErrVersion is returned when the peer speaks another protocol version.
+	ErrVersion = errors.New("protocol: version mismatch")
+
+	// ErrDigestMismatch is returned when the reconstructed data does not
+	// match the data of the sender.
+	ErrDigestMismatch = errors.New("protocol: digest mismatch")
+
+	// ErrRejected is returned when the sender refuses the request of the
+	// receiver.
+	ErrRejected = errors.New("protocol: rejected by sender")
+
+	// ErrMalformed is returned for messages that cannot be valid.
+	ErrMalformed = errors.New("protocol: malformed message")
+)
+
+// MaxChanges is the largest number of changes accepted in a single
+// transfer.
+const MaxChanges = 1 << 26
+
+// preallocChanges bounds space reserved for changes before they are
+// received, so that a count sent by the peer cannot make the receiver
+// allocate more than it has actually been sent.
+const preallocChanges = 1 << 12
+
+// signature is a chunk without its content. Size and Weak are set for fixed
+// size blocks only.
+type signature struct {
+	Index     int
+	Size      int
+	Weak      uint32
+	Signature [sha256.Size]byte
+}
+
+type hello struct {
+	Version    int
+	Params     fastcdc.Params
+	BlockSize  int
+	Signatures []signature
+}
+
+type header struct {
+	Version int
+	Changes int
+	// Error tells why the sender refused the request, if it did.
+	Error string
+}
+
+type trailer struct {
+	Size   int
+	Digest [sha256.Size]byte
+}
+
+type confirm struct {
+	Digest [sha256.Size]byte
+}
+
+// Stats describe a completed transfer.
+type Stats struct {
+	Changes      int
+	LiteralBytes int
+}
+
+// Receive runs the receiving side of the protocol over `rw`. Data of the old
+// version is given in `old` and the reconstructed new version is returned.
+func Receive(rw io.ReadWriter, old []byte) ([]byte, error) {
+	return ReceiveWith(rw, old, rollingdiff.Chunker{})
+}
+
+// ReceiveWith is like Receive, but chunks the data with `chunker`. Sender
+// follows the chunking parameters of the receiver, and searches for fixed
+// size blocks at any offset when BlockSize is set.
+func ReceiveWith(rw io.ReadWriter, old []byte, chunker rollingdiff.Chunker) ([]byte, error) {
+	enc := gob.NewEncoder(rw)
+	dec := gob.NewDecoder(rw)
+
+	if chunker.Params == (fastcdc.Params{}) {
+		chunker.Params = fastcdc.DefaultParams
+	}
+
+	oldChunks := chunker.Signatures(old)
+
+	h := hello{
+		Version:    Version,
+		Params:     chunker.Params,
+		BlockSize:  chunker.BlockSize,
+		Signatures: make([]signature, len(oldChunks)),
+	}
+	if chunker.BlockSize > 0 {
+		for i, b := range rollingdiff.BlockSignatures(oldChunks) {
+			h.Signatures[i] = signature{Index: b.Index, Size: b.Size, Weak: b.Weak, Signature: b.Signature}
+		}
+	} else {
+		for i, c := range oldChunks {
+			h.Signatures[i] = signature{Index: c.Index, Signature: c.Signature}
+		}
+	}
+
+	if err := enc.Encode(&h); err != nil {
+		return nil, err
+	}
+
+	var hdr header
+	if err := dec.Decode(&hdr); err != nil {
+		return nil, err
+	}
+	if hdr.Version != Version {
+		return nil, fmt.Errorf("%w: got %d, want %d", ErrVersion, hdr.Version, Version)
+	}
+	if hdr.Error != "" {
+		return nil, fmt.Errorf("%w: %s", ErrRejected, hdr.Error)
+	}
+	if hdr.Changes < 0 || hdr.Changes > MaxChanges {
+		return nil, fmt.Errorf("%w: %d changes", ErrMalformed, hdr.Changes)
+	}
+
+	prealloc := hdr.Changes
+	if prealloc > preallocChanges {
+		prealloc = preallocChanges
+	}
+	changes := make([]rollingdiff.Change, 0, prealloc)
+	for i := 0; i < hdr.Changes; i++ {
+		var c rollingdiff.Change
+		if err := dec.Decode(&c); err != nil {
+			return nil, err
+		}
+		changes = append(changes, c)
+	}
+
+	var tr trailer
+	if err := dec.Decode(&tr); err != nil {
+		return nil, err
+	}
+
+	data, err := rollingdiff.Apply(oldChunks, changes)
+	if err != nil {
+		// Empty digest never matches, which tells the sender to give up.
+		enc.Encode(&confirm{})
+		return nil, err
+	}
+
+	// Reply with the digest even when it does not match, so that the sender
+	// learns about the failure as well.
+	c := confirm{Digest: sha256.Sum256(data)}
+	if err := enc.Encode(&c); err != nil {
+		return nil, err
+	}
+
+	if len(data) != tr.Size || c.Digest != tr.Digest {
+		return nil, ErrDigestMismatch
+	}
+
+	return data, nil
+}
+
+// Send runs the sending side of the protocol over `rw`, transferring `data`
+// to the receiver.
+func Send(rw io.ReadWriter, data []byte) (Stats, error) {
+	var stats Stats
+
+	enc := gob.NewEncoder(rw)
+	dec := gob.NewDecoder(rw)
+
+	var h hello
+	if err := dec.Decode(&h); err != nil {
+		return stats, err
+	}
+
+	if h.Version != Version {
+		// Let the receiver know as well, instead of leaving it waiting.
+		enc.Encode(&header{Version: Version})
+		return stats, fmt.Errorf("%w: got %d, want %d", ErrVersion, h.Version, Version)
+	}
+
+	chunker := rollingdiff.Chunker{Params: h.Params, BlockSize: h.BlockSize}
+	if err := h.Params.Validate(); err != nil {
+		enc.Encode(&header{Version: Version, Error: err.Error()})
+		return stats, err
+	}
+	if err := chunker.Validate(); err != nil {
+		enc.Encode(&header{Version: Version, Error: err.Error()})
+		return stats, err
+	}
+
+	var changes []rollingdiff.Change
+	if chunker.BlockSize > 0 {
+		blocks := make([]rollingdiff.BlockSignature, len(h.Signatures))
+		for i, s := range h.Signatures {
+			blocks[i] = rollingdiff.BlockSignature{Index: s.Index, Size: s.Size, Weak: s.Weak, Signature: s.Signature}
+		}
+		changes = rollingdiff.MatchBlocks(blocks, data)
+	} else {
+		oldChunks := make([]rollingdiff.Chunk, len(h.Signatures))
+		for i, s := range h.Signatures {
+			oldChunks[i] = rollingdiff.Chunk{Index: s.Index, Signature: s.Signature}
+		}
+		changes = rollingdiff.Delta(oldChunks, chunker.Signatures(data))
+	}
+	if len(changes) > MaxChanges {
+		err := fmt.Errorf("%w: %d changes", ErrMalformed, len(changes))
+		enc.Encode(&header{Version: Version, Error: err.Error()})
+		return stats, err
+	}
+
+	if err := enc.Encode(&header{Version: Version, Changes: len(changes)}); err != nil {
+		return stats, err
+	}
+
+	for i := range changes {
+		if err := enc.Encode(&changes[i]); err != nil {
+			return stats, err
+		}
+		stats.Changes++
+		stats.LiteralBytes += len(changes[i].Bytes)
+	}
+
+	digest := sha256.Sum256(data)
+	if err := enc.Encode(&trailer{Size: len(data), Digest: digest}); err != nil {
+		return stats, err
+	}
+
+	var c confirm
+	if err := dec.Decode(&c); err != nil {
+		return stats, err
+	}
+
+	if c.Digest != digest {
+		return stats, ErrDigestMismatch
+	}
+
+	return stats, nil
+}
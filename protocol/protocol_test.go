@@ -0,0 +1,177 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/tuommaki/rollingdiff/fastcdc"
+	"github.com/tuommaki/rollingdiff/internal/testutil"
+	"github.com/tuommaki/rollingdiff/rollingdiff"
+)
+
+type result struct {
+	data []byte
+	err  error
+}
+
+func transfer(t *testing.T, old, data []byte, chunker rollingdiff.Chunker) ([]byte, Stats) {
+	t.Helper()
+
+	sender, receiver := net.Pipe()
+	defer sender.Close()
+	defer receiver.Close()
+
+	done := make(chan result, 1)
+	go func() {
+		data, err := ReceiveWith(receiver, old, chunker)
+		done <- result{data: data, err: err}
+	}()
+
+	stats, err := Send(sender, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := <-done
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+
+	return r.data, stats
+}
+
+func Test_Transfer_Modified_Data(t *testing.T) {
+	old := testutil.RandomBytes(t, 1, 16*fastcdc.MaxSize)
+
+	data := append([]byte{}, old[:4*fastcdc.MaxSize]...)
+	data = append(data, testutil.RandomBytes(t, 2, 5000)...)
+	data = append(data, old[8*fastcdc.MaxSize:]...)
+	data = append(data, old[5*fastcdc.MaxSize:6*fastcdc.MaxSize]...)
+
+	got, stats := transfer(t, old, data, rollingdiff.Chunker{})
+
+	if !bytes.Equal(got, data) {
+		t.Fatalf("expected received data to equal sent data")
+	}
+
+	if stats.LiteralBytes >= len(data)/2 {
+		t.Fatalf("expected most of the data to be reused, got %d literal bytes of %d", stats.LiteralBytes, len(data))
+	}
+}
+
+func Test_Transfer_To_Empty_Receiver(t *testing.T) {
+	data := testutil.RandomBytes(t, 1, 4*fastcdc.MaxSize)
+
+	got, stats := transfer(t, nil, data, rollingdiff.Chunker{})
+
+	if !bytes.Equal(got, data) {
+		t.Fatalf("expected received data to equal sent data")
+	}
+
+	if stats.LiteralBytes != len(data) {
+		t.Fatalf("expected all data to be sent as literals, got %d != %d", stats.LiteralBytes, len(data))
+	}
+}
+
+func Test_Transfer_Empty_Data(t *testing.T) {
+	got, _ := transfer(t, testutil.RandomBytes(t, 1, fastcdc.MaxSize), nil, rollingdiff.Chunker{})
+
+	if len(got) != 0 {
+		t.Fatalf("expected empty result, got %d bytes", len(got))
+	}
+}
+
+func Test_Transfer_With_Receiver_Params(t *testing.T) {
+	old := testutil.RandomBytes(t, 1, 4*fastcdc.MaxSize)
+	data := append(append([]byte{}, old...), testutil.RandomBytes(t, 2, 100)...)
+	chunker := rollingdiff.Chunker{Params: fastcdc.Params{MinSize: 256, NormalSize: 1024, MaxSize: 4096}}
+
+	got, stats := transfer(t, old, data, chunker)
+
+	if !bytes.Equal(got, data) {
+		t.Fatalf("expected received data to equal sent data")
+	}
+
+	if stats.LiteralBytes > 4096+100 {
+		t.Fatalf("expected at most one small chunk of literals, got %d bytes", stats.LiteralBytes)
+	}
+}
+
+func Test_Transfer_With_Fixed_Size_Blocks(t *testing.T) {
+	old := testutil.RandomBytes(t, 1, 4*fastcdc.MaxSize)
+
+	// Data shifted by an insert is found only by searching for blocks.
+	data := append(append([]byte{}, old[:1000]...), testutil.RandomBytes(t, 2, 100)...)
+	data = append(data, old[1000:]...)
+
+	got, stats := transfer(t, old, data, rollingdiff.Chunker{BlockSize: 1024})
+
+	if !bytes.Equal(got, data) {
+		t.Fatalf("expected received data to equal sent data")
+	}
+
+	if stats.LiteralBytes > 1024+100 {
+		t.Fatalf("expected at most one block of literals, got %d bytes", stats.LiteralBytes)
+	}
+}
+
+func Test_Receiver_Learns_About_Rejected_Params(t *testing.T) {
+	sender, receiver := net.Pipe()
+	defer sender.Close()
+	defer receiver.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := Send(sender, testutil.RandomBytes(t, 1, 1000))
+		done <- err
+	}()
+
+	// Receiver is faked, since it cannot chunk with invalid params itself.
+	invalid := fastcdc.Params{MinSize: 4096, NormalSize: 1024, MaxSize: 256}
+	if err := gob.NewEncoder(receiver).Encode(&hello{Version: Version, Params: invalid}); err != nil {
+		t.Fatal(err)
+	}
+
+	var hdr header
+	if err := gob.NewDecoder(receiver).Decode(&hdr); err != nil {
+		t.Fatal(err)
+	}
+	if hdr.Error == "" {
+		t.Fatalf("expected header to carry an error")
+	}
+
+	if err := <-done; err == nil {
+		t.Fatalf("expected sender to fail")
+	}
+}
+
+func Test_Receiver_Rejects_Invalid_Change_Count(t *testing.T) {
+	for _, n := range []int{-1, MaxChanges + 1} {
+		sender, receiver := net.Pipe()
+
+		done := make(chan error, 1)
+		go func() {
+			_, err := Receive(receiver, testutil.RandomBytes(t, 1, 1000))
+			done <- err
+		}()
+
+		// Sender is faked to send a count no real sender would.
+		var h hello
+		if err := gob.NewDecoder(sender).Decode(&h); err != nil {
+			t.Fatal(err)
+		}
+		if err := gob.NewEncoder(sender).Encode(&header{Version: Version, Changes: n}); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := <-done; !errors.Is(err, ErrMalformed) {
+			t.Fatalf("expected ErrMalformed for %d changes, got %v", n, err)
+		}
+
+		sender.Close()
+		receiver.Close()
+	}
+}
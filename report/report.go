@@ -0,0 +1,202 @@
+// Package report renders chunk boundaries of two versions of a file and the
+// delta between them as a self-contained HTML page.
+package report
+
+import (
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"io"
+
+	"github.com/tuommaki/rollingdiff/rollingdiff"
+)
+
+// Status of a chunk in the report.
+type Status string
+
+// Statuses of chunks. Edited chunks are built by Edit changes.
+const (
+	Kept    Status = "kept"
+	Moved   Status = "moved"
+	Added   Status = "added"
+	Edited  Status = "edited"
+	Deleted Status = "deleted"
+)
+
+// Block is a chunk as drawn in a strip.
+type Block struct {
+	Index  int
+	Offset int
+	Size   int
+	Digest string
+	Status Status
+	// Width is the share of the strip width in percent.
+	Width float64
+	// Gap is the share of the strip width left blank before the block, in
+	// percent, opposite chunks of the other version.
+	Gap float64
+}
+
+// Strip is one version of the file.
+type Strip struct {
+	Title  string
+	Size   int
+	Blocks []Block
+}
+
+// Report is the data rendered by WriteHTML.
+type Report struct {
+	Old, New Strip
+	Counts   map[Status]int
+}
+
+// digestPrefix is the number of hex digits of chunk digests shown.
+const digestPrefix = 12
+
+// New builds a report of `changes`, as computed by Delta, between `src` and
+// `dst` chunks. Both strips are drawn to the same scale, and chunks not kept
+// in either version are drawn opposite a gap in the other one, so that kept
+// chunks line up.
+func New(oldTitle, newTitle string, src, dst []rollingdiff.Chunk, changes []rollingdiff.Change) Report {
+	oldStatus := make(map[int]Status)
+	newStatus := make(map[int]Status)
+	for _, c := range changes {
+		switch c.Op {
+		case rollingdiff.Delete:
+			oldStatus[c.From] = Deleted
+		case rollingdiff.Add:
+			newStatus[c.To] = Added
+		case rollingdiff.Edit:
+			newStatus[c.To] = Edited
+		case rollingdiff.Move:
+			oldStatus[c.From] = Moved
+			newStatus[c.To] = Moved
+		}
+	}
+
+	r := Report{
+		Old:    strip(oldTitle, src, oldStatus),
+		New:    strip(newTitle, dst, newStatus),
+		Counts: make(map[Status]int),
+	}
+
+	oldStart, newStart, scale := align(r.Old.Blocks, r.New.Blocks)
+	for _, s := range []struct {
+		strip *Strip
+		start []int
+	}{
+		{&r.Old, oldStart},
+		{&r.New, newStart},
+	} {
+		end := 0
+		for i := range s.strip.Blocks {
+			b := &s.strip.Blocks[i]
+			b.Width = 100 * float64(b.Size) / float64(scale)
+			b.Gap = 100 * float64(s.start[i]-end) / float64(scale)
+			end = s.start[i] + b.Size
+			r.Counts[b.Status]++
+		}
+	}
+
+	return r
+}
+
+// align returns positions of `old` and `new` blocks in bytes when drawn
+// aligned, and the length of both strips. Kept chunks are in the same order
+// in both versions, and other blocks between them are placed one after
+// another, deleted and moved chunks of the old version first.
+func align(old, new []Block) ([]int, []int, int) {
+	oldStart, newStart := make([]int, len(old)), make([]int, len(new))
+
+	i, j, at := 0, 0, 0
+	for i < len(old) || j < len(new) {
+		switch {
+		case i < len(old) && old[i].Status != Kept:
+			oldStart[i] = at
+			at += old[i].Size
+			i++
+		case j < len(new) && new[j].Status != Kept:
+			newStart[j] = at
+			at += new[j].Size
+			j++
+		default:
+			size := 0
+			if i < len(old) {
+				oldStart[i] = at
+				size = old[i].Size
+				i++
+			}
+			if j < len(new) {
+				newStart[j] = at
+				if new[j].Size > size {
+					size = new[j].Size
+				}
+				j++
+			}
+			at += size
+		}
+	}
+
+	return oldStart, newStart, at
+}
+
+func strip(title string, chunks []rollingdiff.Chunk, status map[int]Status) Strip {
+	s := Strip{Title: title, Blocks: make([]Block, len(chunks))}
+	for i, c := range chunks {
+		st, exists := status[c.Index]
+		if !exists {
+			st = Kept
+		}
+
+		s.Blocks[i] = Block{
+			Index:  c.Index,
+			Offset: c.Offset,
+			Size:   len(c.Bytes),
+			Digest: hex.EncodeToString(c.Signature[:])[:digestPrefix],
+			Status: st,
+		}
+		s.Size += len(c.Bytes)
+	}
+	return s
+}
+
+// Strips returns strips of both versions, the old one first.
+func (r Report) Strips() []Strip {
+	return []Strip{r.Old, r.New}
+}
+
+// WriteHTML renders the report to `w` as a self-contained HTML page.
+func (r Report) WriteHTML(w io.Writer) error {
+	return page.Execute(w, r)
+}
+
+var page = template.Must(template.New("report").Funcs(template.FuncMap{
+	"statuses": func() []Status { return []Status{Kept, Moved, Added, Edited, Deleted} },
+	"width":    func(w float64) template.CSS { return template.CSS(fmt.Sprintf("width:%.4f%%", w)) },
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Old.Title}} → {{.New.Title}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+h2 { font-size: 1em; margin: 1.5em 0 0.3em; }
+.strip { display: flex; height: 3em; border: 1px solid #444; }
+.strip div { box-sizing: border-box; border-right: 1px solid #fff; min-width: 1px; }
+.strip .gap { border-right: none; min-width: 0; }
+.kept { background: #9e9e9e; }
+.moved { background: #1e88e5; }
+.added { background: #43a047; }
+.edited { background: #fdd835; }
+.deleted { background: #e53935; }
+.legend span { display: inline-block; margin-right: 1.5em; }
+.legend i { display: inline-block; width: 1em; height: 1em; margin-right: 0.3em; vertical-align: middle; }
+</style>
+</head>
+<body>
+<p class="legend">{{range statuses}}<span><i class="{{.}}"></i>{{.}}: {{index $.Counts .}}</span>{{end}}</p>
+{{range .Strips}}<h2>{{.Title}} ({{.Size}} bytes, {{len .Blocks}} chunks)</h2>
+<div class="strip">{{range .Blocks}}{{if gt .Gap 0.0}}<div class="gap" style="{{width .Gap}}"></div>{{end}}<div class="{{.Status}}" style="{{width .Width}}" title="chunk {{.Index}}, {{.Status}}&#10;offset {{.Offset}}, {{.Size}} bytes&#10;sha256 {{.Digest}}…"></div>{{end}}</div>
+{{end}}</body>
+</html>
+`))
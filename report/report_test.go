@@ -0,0 +1,99 @@
+package report
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/tuommaki/rollingdiff/fastcdc"
+	"github.com/tuommaki/rollingdiff/internal/testutil"
+	"github.com/tuommaki/rollingdiff/rollingdiff"
+)
+
+func Test_New_Marks_Chunk_Statuses(t *testing.T) {
+	oldData := testutil.RandomBytes(t, 1, 8*fastcdc.MaxSize)
+	src := rollingdiff.Signatures(oldData)
+	if len(src) < 4 {
+		t.Fatalf("expected at least 4 chunks, got %d", len(src))
+	}
+
+	// The first chunk is replaced, the second and third ones swapped.
+	added := rollingdiff.Signatures(testutil.RandomBytes(t, 2, 1000))[0]
+	dst := append([]rollingdiff.Chunk{added, src[2], src[1]}, src[3:]...)
+
+	var newData []byte
+	for i := range dst {
+		dst[i].Index, dst[i].Offset = i, len(newData)
+		newData = append(newData, dst[i].Bytes...)
+	}
+
+	changes := rollingdiff.Delta(src, dst)
+	r := New("old", "new", src, dst, changes)
+
+	if r.Old.Size != len(oldData) || r.New.Size != len(newData) {
+		t.Fatalf("expected sizes %d and %d, got %d and %d", len(oldData), len(newData), r.Old.Size, r.New.Size)
+	}
+
+	if r.Old.Blocks[0].Status != Deleted {
+		t.Fatalf("expected first old chunk to be deleted, got %s", r.Old.Blocks[0].Status)
+	}
+
+	if r.Old.Blocks[1].Status != Moved {
+		t.Fatalf("expected second old chunk to be moved, got %s", r.Old.Blocks[1].Status)
+	}
+
+	if r.Counts[Added] == 0 || r.Counts[Kept] == 0 {
+		t.Fatalf("expected added and kept chunks, got %v", r.Counts)
+	}
+
+	// Kept chunks start at the same position in both strips, and neither
+	// strip is wider than the page.
+	var oldKept, newKept []float64
+	for _, s := range []struct {
+		strip Strip
+		kept  *[]float64
+	}{
+		{r.Old, &oldKept},
+		{r.New, &newKept},
+	} {
+		at := 0.0
+		for _, b := range s.strip.Blocks {
+			at += b.Gap
+			if b.Status == Kept {
+				*s.kept = append(*s.kept, at)
+			}
+			at += b.Width
+		}
+		if at > 100.01 {
+			t.Fatalf("expected strip %s to span at most 100%%, got %f", s.strip.Title, at)
+		}
+	}
+
+	if len(oldKept) != len(newKept) {
+		t.Fatalf("expected the same number of kept chunks, got %d and %d", len(oldKept), len(newKept))
+	}
+	for i := range oldKept {
+		if d := oldKept[i] - newKept[i]; d < -0.01 || d > 0.01 {
+			t.Fatalf("expected kept chunk %d at the same position, got %f and %f", i, oldKept[i], newKept[i])
+		}
+	}
+}
+
+func Test_WriteHTML_Escapes_Titles(t *testing.T) {
+	data := testutil.RandomBytes(t, 1, fastcdc.MaxSize)
+	chunks := rollingdiff.Signatures(data)
+
+	var buf bytes.Buffer
+	if err := New("<old>", "new", chunks, chunks, nil).WriteHTML(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	html := buf.String()
+	if strings.Contains(html, "<old>") || !strings.Contains(html, "&lt;old&gt;") {
+		t.Fatalf("expected title to be escaped")
+	}
+
+	if n := strings.Count(html, `class="kept" style`); n != 2*len(chunks) {
+		t.Fatalf("expected %d kept chunks, got %d", 2*len(chunks), n)
+	}
+}
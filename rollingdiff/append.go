@@ -0,0 +1,109 @@
+package rollingdiff
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+)
+
+// ErrNotAppended is returned by AppendDelta when the earlier version of the
+// data is not a prefix of the new data.
+var ErrNotAppended = errors.New("rollingdiff: data was not only appended to")
+
+// AppendDelta computes changes from `prev`, the chunks of an earlier version
+// of the data of `prevSize` bytes, to `buf`, for data that is only appended
+// to, such as logs. Chunks of `prev` need Offset and Signature set.
+//
+// Every chunk of `prev` but the last one is verified against `buf` and kept
+// as is. Only the data from the start of the last chunk, which was usually cut
+// short by the earlier end of data, is re-chunked. New chunks copy the old
+// content of that chunk with Edit changes, unless it was rewritten too, and
+// chunks past it are added. It returns chunks of `buf`, as Signatures would,
+// and the changes. If the data was modified elsewhere, it returns an error
+// wrapping ErrNotAppended and Delta needs to be used instead.
+func (ch Chunker) AppendDelta(prev []Chunk, prevSize int, buf []byte) ([]Chunk, []Change, error) {
+	return ch.appendDelta(prev, prevSize, buf, true)
+}
+
+// AppendDeltaUnverified is like AppendDelta, but trusts that every chunk of
+// `prev` but the last one is unchanged in `buf`, as known from elsewhere,
+// and does not read them. Only the data from the start of the last chunk is
+// hashed.
+func (ch Chunker) AppendDeltaUnverified(prev []Chunk, prevSize int, buf []byte) ([]Chunk, []Change, error) {
+	return ch.appendDelta(prev, prevSize, buf, false)
+}
+
+func (ch Chunker) appendDelta(prev []Chunk, prevSize int, buf []byte, verify bool) ([]Chunk, []Change, error) {
+	if len(buf) < prevSize {
+		return nil, nil, fmt.Errorf("%w: data is truncated", ErrNotAppended)
+	}
+
+	last := len(prev) - 1
+	chunks := make([]Chunk, 0, len(prev))
+	for i := 0; i < last; i++ {
+		c := prev[i]
+		end := prev[i+1].Offset
+		if verify && sha256.Sum256(buf[c.Offset:end]) != c.Signature {
+			return nil, nil, fmt.Errorf("%w: chunk %d is modified", ErrNotAppended, i)
+		}
+
+		chunks = append(chunks, Chunk{
+			Bytes:     buf[c.Offset:end],
+			Index:     i,
+			Offset:    c.Offset,
+			Signature: c.Signature,
+		})
+	}
+
+	tail, kept := 0, false
+	if last >= 0 {
+		tail = prev[last].Offset
+		kept = sha256.Sum256(buf[tail:prevSize]) == prev[last].Signature
+	}
+
+	params := ch.params()
+	for offset := tail; offset < len(buf); {
+		n := ch.length(params, buf[offset:])
+		chunks = append(chunks, Chunk{
+			Bytes:     buf[offset : offset+n],
+			Index:     len(chunks),
+			Offset:    offset,
+			Signature: sha256.Sum256(buf[offset : offset+n]),
+		})
+		offset += n
+	}
+
+	changes := make([]Change, 0)
+	added := chunks
+	if last >= 0 {
+		added = chunks[last:]
+		if len(added) > 0 && added[0].Signature == prev[last].Signature {
+			// Last chunk ended at a boundary, and stays.
+			added = added[1:]
+		} else {
+			changes = append(changes, Change{Op: Delete, From: last})
+		}
+	}
+
+	for _, c := range added {
+		end := c.Offset + len(c.Bytes)
+		if !kept || c.Offset >= prevSize {
+			changes = append(changes, Change{Op: Add, To: c.Index, Bytes: c.Bytes})
+			continue
+		}
+
+		// Old content of the last chunk is copied, and appended data
+		// inserted after it.
+		copied := end
+		if copied > prevSize {
+			copied = prevSize
+		}
+		parts := []Part{{Offset: c.Offset - tail, Length: copied - c.Offset}}
+		if end > copied {
+			parts = append(parts, Part{Bytes: c.Bytes[copied-c.Offset:]})
+		}
+		changes = append(changes, Change{Op: Edit, From: last, To: c.Index, Parts: parts})
+	}
+
+	return chunks, changes, nil
+}
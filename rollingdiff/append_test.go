@@ -0,0 +1,151 @@
+package rollingdiff
+
+import (
+	"bytes"
+	"errors"
+	"strconv"
+	"testing"
+
+	"github.com/tuommaki/rollingdiff/fastcdc"
+)
+
+func Test_AppendDelta(t *testing.T) {
+	oldData := randomBytes(t, *seed, 8*fastcdc.MaxSize+123)
+
+	testCases := []struct {
+		name     string
+		chunker  Chunker
+		oldData  []byte
+		appended []byte
+	}{
+		{
+			name:     "few bytes appended",
+			oldData:  oldData,
+			appended: []byte("hello"),
+		},
+		{
+			name:     "several chunks appended",
+			oldData:  oldData,
+			appended: randomBytes(t, *seed+1, 4*fastcdc.MaxSize),
+		},
+		{
+			name:    "nothing appended",
+			oldData: oldData,
+		},
+		{
+			name:     "appended to empty data",
+			appended: randomBytes(t, *seed+1, 2*fastcdc.MaxSize),
+		},
+		{
+			name:     "fixed size blocks",
+			chunker:  Chunker{BlockSize: 1000},
+			oldData:  oldData,
+			appended: randomBytes(t, *seed+1, 3500),
+		},
+	}
+
+	for i, tc := range testCases {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			t.Logf(tc.name)
+
+			newData := append(append([]byte{}, tc.oldData...), tc.appended...)
+			src := tc.chunker.Signatures(tc.oldData)
+
+			chunks, changes, err := tc.chunker.AppendDelta(src, len(tc.oldData), newData)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			expected := tc.chunker.Signatures(newData)
+			if len(chunks) != len(expected) {
+				t.Fatalf("expected %d chunks, got %d", len(expected), len(chunks))
+			}
+			for j, e := range expected {
+				c := chunks[j]
+				if c.Index != e.Index || c.Offset != e.Offset || c.Signature != e.Signature || !bytes.Equal(c.Bytes, e.Bytes) {
+					t.Fatalf("expected chunk %d at %d of %d bytes, got chunk %d at %d of %d bytes", e.Index, e.Offset, len(e.Bytes), c.Index, c.Offset, len(c.Bytes))
+				}
+			}
+
+			if n := literalBytes(changes); n != len(tc.appended) {
+				t.Fatalf("expected %d literal bytes, got %d", len(tc.appended), n)
+			}
+
+			result, err := Apply(src, changes)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(result, newData) {
+				t.Fatalf("expected %d bytes of new data, got %d bytes", len(newData), len(result))
+			}
+		})
+	}
+}
+
+func Test_AppendDelta_Sends_Rewritten_Last_Chunk(t *testing.T) {
+	oldData := randomBytes(t, *seed, 8*fastcdc.MaxSize+123)
+	src := Signatures(oldData)
+
+	newData := append(append([]byte{}, oldData...), []byte("hello")...)
+	newData[len(oldData)-1] = ^newData[len(oldData)-1]
+
+	_, changes, err := Chunker{}.AppendDelta(src, len(oldData), newData)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := Apply(src, changes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(result, newData) {
+		t.Fatalf("expected %d bytes of new data, got %d bytes", len(newData), len(result))
+	}
+}
+
+func Test_AppendDelta_Rejects_Modified_Data(t *testing.T) {
+	oldData := randomBytes(t, *seed, 8*fastcdc.MaxSize+123)
+	src := Signatures(oldData)
+
+	modified := append(append([]byte{}, oldData...), []byte("hello")...)
+	modified[100] = ^modified[100]
+
+	testCases := []struct {
+		name    string
+		newData []byte
+	}{
+		{name: "prefix modified", newData: modified},
+		{name: "data truncated", newData: oldData[:len(oldData)-1]},
+	}
+
+	for i, tc := range testCases {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			t.Logf(tc.name)
+
+			_, _, err := Chunker{}.AppendDelta(src, len(oldData), tc.newData)
+			if !errors.Is(err, ErrNotAppended) {
+				t.Fatalf("expected ErrNotAppended, got %v", err)
+			}
+		})
+	}
+}
+
+func Test_AppendDeltaUnverified_Trusts_Chunks_Before_Last(t *testing.T) {
+	oldData := randomBytes(t, *seed, 8*fastcdc.MaxSize+123)
+	src := Signatures(oldData)
+
+	// The modified prefix is not read, so its chunk keeps the old signature.
+	modified := append(append([]byte{}, oldData...), []byte("hello")...)
+	modified[100] = ^modified[100]
+
+	chunks, changes, err := Chunker{}.AppendDeltaUnverified(src, len(oldData), modified)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chunks[0].Signature != src[0].Signature {
+		t.Fatalf("expected first chunk to keep its signature")
+	}
+	if literalBytes(changes) != len("hello") {
+		t.Fatalf("expected %d literal bytes, got %d", len("hello"), literalBytes(changes))
+	}
+}
@@ -0,0 +1,194 @@
+package rollingdiff
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+)
+
+// ErrInvalidDelta is returned when changes cannot be applied to given source
+// chunks.
+var ErrInvalidDelta = errors.New("rollingdiff: delta does not apply to source")
+
+// Apply performs `changes`, as computed by Delta, to `src` chunks and returns
+// the resulting data. Chunks in `src` must be in order, as returned by
+// Signatures, and carry their content.
+func Apply(src []Chunk, changes []Change) ([]byte, error) {
+	chunks, err := ApplyChunks(src, changes)
+	if err != nil {
+		return nil, err
+	}
+
+	return join(chunks), nil
+}
+
+func join(chunks []Chunk) []byte {
+	size := 0
+	for _, c := range chunks {
+		size += len(c.Bytes)
+	}
+
+	buf := make([]byte, 0, size)
+	for _, c := range chunks {
+		buf = append(buf, c.Bytes...)
+	}
+
+	return buf
+}
+
+// ApplyChunks is like Apply, but returns the resulting data as a list of
+// chunks, with their indexes, offsets and signatures set.
+func ApplyChunks(src []Chunk, changes []Change) ([]Chunk, error) {
+	segments, err := Layout(src, changes)
+	if err != nil {
+		return nil, err
+	}
+
+	chunks := make([]Chunk, len(segments))
+	for i, s := range segments {
+		chunks[i] = s.Chunk
+	}
+
+	return chunks, nil
+}
+
+// Segment describes origin of a single chunk of the result of applying a
+// delta.
+type Segment struct {
+	// Chunk is the resulting chunk, with its index and offset within the
+	// result.
+	Chunk Chunk
+	// Source is the index of the src chunk the content is copied from, or
+	// -1 when the content comes from an Add or Edit change.
+	Source int
+}
+
+// Layout resolves origin of every chunk of the result of applying `changes`
+// to `src`, without assembling the data. Position in the returned list is
+// the index of a result chunk.
+func Layout(src []Chunk, changes []Change) ([]Segment, error) {
+	segments, err := layout(src, changes)
+	if err != nil {
+		return nil, err
+	}
+
+	offset := 0
+	for i := range segments {
+		segments[i].Chunk.Index = i
+		segments[i].Chunk.Offset = offset
+		offset += len(segments[i].Chunk.Bytes)
+	}
+
+	return segments, nil
+}
+
+func layout(src []Chunk, changes []Change) ([]Segment, error) {
+	for i, c := range src {
+		if c.Index != i {
+			return nil, fmt.Errorf("%w: source chunk at %d has index %d", ErrInvalidDelta, i, c.Index)
+		}
+	}
+
+	slots, err := arrange(len(src), changes)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]Segment, len(slots))
+	for i, s := range slots {
+		if s.Source >= 0 {
+			result[i] = Segment{Chunk: src[s.Source], Source: s.Source}
+			continue
+		}
+
+		data, err := changes[s.Change].Content(src)
+		if err != nil {
+			return nil, err
+		}
+		result[i] = Segment{
+			Chunk:  Chunk{Bytes: data, Signature: sha256.Sum256(data)},
+			Source: -1,
+		}
+	}
+
+	return result, nil
+}
+
+// slot is the origin of a chunk of the result of applying a delta: chunk
+// Source of the source data, or the Add or Edit change at Change of the
+// delta when Source is -1.
+type slot struct {
+	Source int
+	Change int
+}
+
+// arrange resolves origin of every chunk of the result of applying
+// `changes` to `n` source chunks.
+func arrange(n int, changes []Change) ([]slot, error) {
+	deleted := make([]bool, n)
+	size := n
+	for _, c := range changes {
+		switch c.Op {
+		case Delete:
+			if c.From < 0 || c.From >= n || deleted[c.From] {
+				return nil, fmt.Errorf("%w: invalid delete of chunk %d", ErrInvalidDelta, c.From)
+			}
+			deleted[c.From] = true
+			size--
+		case Add, Edit:
+			size++
+		}
+	}
+
+	result := make([]slot, size)
+	filled := make([]bool, size)
+	moved := make([]bool, n)
+
+	for i, c := range changes {
+		switch c.Op {
+		case Add, Edit:
+			if c.To < 0 || c.To >= size || filled[c.To] {
+				return nil, fmt.Errorf("%w: invalid %v to chunk %d", ErrInvalidDelta, c.Op, c.To)
+			}
+			result[c.To] = slot{Source: -1, Change: i}
+			filled[c.To] = true
+		case Move:
+			if c.From < 0 || c.From >= n || deleted[c.From] || moved[c.From] {
+				return nil, fmt.Errorf("%w: invalid move from chunk %d", ErrInvalidDelta, c.From)
+			}
+			if c.To < 0 || c.To >= size || filled[c.To] {
+				return nil, fmt.Errorf("%w: invalid move to chunk %d", ErrInvalidDelta, c.To)
+			}
+			result[c.To] = slot{Source: c.From}
+			filled[c.To] = true
+			moved[c.From] = true
+		}
+	}
+
+	// Chunks that were neither deleted nor moved keep their relative order
+	// and fill the remaining positions.
+	j := 0
+	for i := 0; i < n; i++ {
+		if deleted[i] || moved[i] {
+			continue
+		}
+
+		for j < size && filled[j] {
+			j++
+		}
+		if j == size {
+			return nil, fmt.Errorf("%w: no position left for chunk %d", ErrInvalidDelta, i)
+		}
+
+		result[j] = slot{Source: i}
+		filled[j] = true
+	}
+
+	for i := range filled {
+		if !filled[i] {
+			return nil, fmt.Errorf("%w: no content for chunk %d", ErrInvalidDelta, i)
+		}
+	}
+
+	return result, nil
+}
@@ -0,0 +1,138 @@
+package rollingdiff
+
+import (
+	"bytes"
+	"errors"
+	"strconv"
+	"testing"
+
+	"github.com/tuommaki/rollingdiff/fastcdc"
+)
+
+func joinChunks(chunks []Chunk) []byte {
+	var buf []byte
+	for _, c := range chunks {
+		buf = append(buf, c.Bytes...)
+	}
+	return buf
+}
+
+func Test_Apply(t *testing.T) {
+	testCases := []struct {
+		name      string
+		oldChunks []Chunk
+		newChunks []Chunk
+	}{
+		{
+			name:      "identical chunks",
+			oldChunks: randomChunks(t, *seed, 4),
+			newChunks: randomChunks(t, *seed, 4),
+		},
+		{
+			name:      "append chunk to end of new chunks",
+			oldChunks: randomChunks(t, *seed, 4),
+			newChunks: append(randomChunks(t, *seed, 4), randomChunk(t, *seed+1, 4)),
+		},
+		{
+			name:      "prepend chunk to beginning of new chunks and delete one in the middle",
+			oldChunks: randomChunks(t, *seed, 4),
+			newChunks: alignChunkIndexes(dropChunkAt(append([]Chunk{randomChunk(t, *seed+1, 0)}, randomChunks(t, *seed, 4)...), 3)),
+		},
+		{
+			name:      "replace a chunk with a new one and swap chunks around it",
+			oldChunks: randomChunks(t, *seed, 4),
+			newChunks: alignChunkIndexes(swapChunksAt(replaceChunkAt(randomChunks(t, *seed, 4), randomChunk(t, *seed+2, 2), 2), 1, 3)),
+		},
+		{
+			name:      "duplicate a chunk",
+			oldChunks: randomChunks(t, *seed, 4),
+			newChunks: alignChunkIndexes(append(randomChunks(t, *seed, 4), randomChunks(t, *seed, 2)...)),
+		},
+		{
+			name:      "drop duplicates and reorder",
+			oldChunks: alignChunkIndexes(append(randomChunks(t, *seed, 3), randomChunks(t, *seed, 3)...)),
+			newChunks: alignChunkIndexes(swapChunksAt(randomChunks(t, *seed, 4), 0, 3)),
+		},
+		{
+			name:      "everything deleted",
+			oldChunks: randomChunks(t, *seed, 4),
+			newChunks: nil,
+		},
+	}
+
+	for i, tc := range testCases {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			t.Logf(tc.name)
+
+			changes := Delta(tc.oldChunks, tc.newChunks)
+
+			result, err := Apply(tc.oldChunks, changes)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(result, joinChunks(tc.newChunks)) {
+				t.Fatalf("expected result to equal new data, got %d != %d bytes", len(result), len(joinChunks(tc.newChunks)))
+			}
+		})
+	}
+}
+
+func Test_Apply_Data_Roundtrip(t *testing.T) {
+	oldData := randomBytes(t, *seed, 8*fastcdc.MaxSize)
+
+	newData := append([]byte{}, oldData[:fastcdc.MaxSize]...)
+	newData = append(newData, randomBytes(t, *seed+1, 1000)...)
+	newData = append(newData, oldData[3*fastcdc.MaxSize:]...)
+	newData = append(newData, oldData[fastcdc.MaxSize:2*fastcdc.MaxSize]...)
+
+	oldChunks := Signatures(oldData)
+	result, err := Apply(oldChunks, Delta(oldChunks, Signatures(newData)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(result, newData) {
+		t.Fatalf("expected result to equal new data")
+	}
+}
+
+func Test_Apply_Rejects_Invalid_Delta(t *testing.T) {
+	src := randomChunks(t, *seed, 4)
+
+	testCases := []struct {
+		name    string
+		changes []Change
+	}{
+		{
+			name:    "delete out of range",
+			changes: []Change{{Op: Delete, From: 4}},
+		},
+		{
+			name:    "delete twice",
+			changes: []Change{{Op: Delete, From: 1}, {Op: Delete, From: 1}},
+		},
+		{
+			name:    "add out of range",
+			changes: []Change{{Op: Add, To: 5}},
+		},
+		{
+			name:    "move onto added chunk",
+			changes: []Change{{Op: Add, To: 1}, {Op: Move, From: 2, To: 1}},
+		},
+		{
+			name:    "move deleted chunk",
+			changes: []Change{{Op: Delete, From: 2}, {Op: Move, From: 2, To: 0}},
+		},
+	}
+
+	for i, tc := range testCases {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			t.Logf(tc.name)
+
+			if _, err := Apply(src, tc.changes); !errors.Is(err, ErrInvalidDelta) {
+				t.Fatalf("expected ErrInvalidDelta, got %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,145 @@
+package rollingdiff
+
+import (
+	"crypto/sha256"
+	"sort"
+
+	"github.com/tuommaki/rollingdiff/internal/rollsum"
+)
+
+// BlockSignature identifies a chunk of the source data by a weak rolling
+// checksum, cheap to compute at every offset, and the strong signature of
+// its content.
+type BlockSignature struct {
+	Index     int
+	Size      int
+	Weak      uint32
+	Signature [sha256.Size]byte
+}
+
+// BlockSignatures computes block signatures of `chunks`, typically split by
+// a Chunker with BlockSize set.
+func BlockSignatures(chunks []Chunk) []BlockSignature {
+	blocks := make([]BlockSignature, len(chunks))
+	for i, c := range chunks {
+		var sum rollsum.Rsync
+		sum.Update(c.Bytes)
+
+		blocks[i] = BlockSignature{
+			Index:     c.Index,
+			Size:      len(c.Bytes),
+			Weak:      sum.Digest(),
+			Signature: c.Signature,
+		}
+	}
+
+	return blocks
+}
+
+// MatchBlocks finds blocks of the source in `dst` at any offset, as rsync
+// does, by rolling the weak checksum over `dst` byte by byte and confirming
+// candidates with the strong signature. It returns changes that need to be
+// performed to the source chunks `src` was computed from in order to result
+// with `dst`. Matched blocks are kept or moved, blocks matched more than once
+// are copied by Edit changes and data between matches is added.
+//
+// Unlike Delta, unchanged data is found even when shifted by any amount
+// within a block. The checksum is rolled separately for every distinct
+// block size, so blocks should be of fixed size.
+func MatchBlocks(src []BlockSignature, dst []byte) []Change {
+	index := make(map[uint32][]int, len(src))
+	hasSize := make(map[int]bool)
+	var sizes []int
+	for i, b := range src {
+		if b.Size <= 0 {
+			continue
+		}
+		if !hasSize[b.Size] {
+			hasSize[b.Size] = true
+			sizes = append(sizes, b.Size)
+		}
+		index[b.Weak] = append(index[b.Weak], i)
+	}
+
+	// Longer blocks are preferred when several match at the same offset.
+	sort.Sort(sort.Reverse(sort.IntSlice(sizes)))
+
+	found := rollsum.Find(dst, sizes, false, func() rollsum.Sum { return &rollsum.Rsync{} }, func(weak uint32, window []byte) int {
+		var strong *[sha256.Size]byte
+		for _, i := range index[weak] {
+			if src[i].Size != len(window) {
+				continue
+			}
+			if strong == nil {
+				sum := sha256.Sum256(window)
+				strong = &sum
+			}
+			if *strong == src[i].Signature {
+				return i
+			}
+		}
+		return -1
+	})
+
+	// Result chunks in order: positions of matched blocks in src, or -1 for
+	// literal data.
+	var matches []int
+	var literals [][]byte
+
+	literal := 0
+	for _, m := range found {
+		if literal < m.Offset {
+			matches = append(matches, -1)
+			literals = append(literals, dst[literal:m.Offset])
+		}
+		matches = append(matches, m.Block)
+		literals = append(literals, nil)
+		literal = m.Offset + m.Length
+	}
+	if literal < len(dst) {
+		matches = append(matches, -1)
+		literals = append(literals, dst[literal:])
+	}
+
+	// The first occurrence of a block keeps or moves the source chunk,
+	// further ones copy it.
+	used := make([]bool, len(src))
+	var keptDst []int
+	var copies []Change
+	for to, i := range matches {
+		switch {
+		case i < 0:
+			copies = append(copies, Change{Op: Add, To: to, Bytes: literals[to]})
+		case used[i]:
+			copies = append(copies, Change{
+				Op:    Edit,
+				From:  src[i].Index,
+				To:    to,
+				Parts: []Part{{Offset: 0, Length: src[i].Size}},
+			})
+		default:
+			used[i] = true
+			keptDst = append(keptDst, to)
+		}
+	}
+
+	changes := make([]Change, 0)
+	var keptSrc []int
+	for i, b := range src {
+		if used[i] {
+			keptSrc = append(keptSrc, i)
+			continue
+		}
+		changes = append(changes, Change{Op: Delete, From: b.Index})
+	}
+	changes = append(changes, copies...)
+
+	// As in Delta, kept chunks out of place are moved.
+	for k, to := range keptDst {
+		if i := matches[to]; keptSrc[k] != i {
+			changes = append(changes, Change{Op: Move, From: src[i].Index, To: to})
+		}
+	}
+
+	return changes
+}
@@ -0,0 +1,85 @@
+package rollingdiff
+
+import (
+	"bytes"
+	"strconv"
+	"testing"
+)
+
+func Test_MatchBlocks(t *testing.T) {
+	const blockSize = 1024
+	oldData := randomBytes(t, *seed, 64*blockSize+100)
+
+	testCases := []struct {
+		name     string
+		newData  []byte
+		maxBytes int
+	}{
+		{
+			name:     "unchanged data",
+			newData:  oldData,
+			maxBytes: 0,
+		},
+		{
+			name:     "insert few bytes in the middle of a block",
+			newData:  append(append(append([]byte{}, oldData[:10000]...), "hello, world"...), oldData[10000:]...),
+			maxBytes: blockSize + 12,
+		},
+		{
+			name:     "delete few bytes in the middle of a block",
+			newData:  append(append([]byte{}, oldData[:10000]...), oldData[10003:]...),
+			maxBytes: blockSize,
+		},
+		{
+			name:     "swap and repeat blocks",
+			newData:  append(append(append(append([]byte{}, oldData[4*blockSize:8*blockSize]...), oldData[:4*blockSize]...), oldData[:blockSize]...), "tail"...),
+			maxBytes: 4,
+		},
+		{
+			name:     "empty new data",
+			newData:  []byte{},
+			maxBytes: 0,
+		},
+	}
+
+	for i, tc := range testCases {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			t.Logf(tc.name)
+
+			src := Chunker{BlockSize: blockSize}.Signatures(oldData)
+			changes := MatchBlocks(BlockSignatures(src), tc.newData)
+
+			if n := literalBytes(changes); n > tc.maxBytes {
+				t.Fatalf("expected at most %d literal bytes, got %d", tc.maxBytes, n)
+			}
+
+			result, err := Apply(src, changes)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(result, tc.newData) {
+				t.Fatalf("expected result to equal new data")
+			}
+		})
+	}
+}
+
+func Test_MatchBlocks_Finds_Shifted_Data_Missed_By_Delta(t *testing.T) {
+	oldData := randomBytes(t, *seed, 1<<20)
+
+	// Every 4 KiB, a byte is inserted. Content defined chunk boundaries
+	// rarely survive, but fixed size blocks are found at their new offsets.
+	var newData []byte
+	for off := 0; off < len(oldData); off += 4096 {
+		newData = append(append(newData, oldData[off:off+4096]...), byte(off))
+	}
+
+	src := Chunker{BlockSize: 512}.Signatures(oldData)
+	blockBytes := literalBytes(MatchBlocks(BlockSignatures(src), newData))
+	cdcBytes := literalBytes(Delta(Signatures(oldData), Signatures(newData)))
+
+	if blockBytes > len(newData)/4 || blockBytes >= cdcBytes {
+		t.Fatalf("expected block matching to add less than %d bytes and CDC delta, got %d and %d", len(newData)/4, blockBytes, cdcBytes)
+	}
+}
@@ -0,0 +1,242 @@
+package rollingdiff
+
+import (
+	"fmt"
+	"sort"
+)
+
+// origin describes content of a chunk in terms of the original source data:
+// either chunk `source` of it, or `parts` copying from absolute offsets of
+// the source data and inserting literal data.
+type origin struct {
+	source int
+	parts  []Part
+	size   int
+}
+
+// Compose merges `d1`, changes turning `src` into intermediate data, and
+// `d2`, changes turning the intermediate data into the result, into a single
+// delta from `src` to the result. The intermediate data is not built: chunks
+// are tracked through both deltas, so that literals of `d1` deleted by `d2`
+// are dropped, moves of both steps resolve to moves from `src`, and edits of
+// `d2` copy from `src` or include literals of `d1`. Chunks in `src` need to
+// carry their content, as given to Apply, for their sizes.
+func Compose(src []Chunk, d1, d2 []Change) ([]Change, error) {
+	offsets := make([]int, len(src)+1)
+	origins := make([]origin, len(src))
+	for i, c := range src {
+		if c.Index != i {
+			return nil, fmt.Errorf("%w: source chunk at %d has index %d", ErrInvalidDelta, i, c.Index)
+		}
+		offsets[i+1] = offsets[i] + len(c.Bytes)
+		origins[i] = origin{source: i, size: len(c.Bytes)}
+	}
+
+	mid, err := follow(origins, offsets, d1)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := follow(mid, offsets, d2)
+	if err != nil {
+		return nil, err
+	}
+
+	return originChanges(result, offsets), nil
+}
+
+// follow resolves origins of chunks resulting from applying `changes` to
+// chunks of origins `in`. `offsets` are offsets of chunks of the original
+// source data.
+func follow(in []origin, offsets []int, changes []Change) ([]origin, error) {
+	slots, err := arrange(len(in), changes)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]origin, len(slots))
+	for i, s := range slots {
+		if s.Source >= 0 {
+			out[i] = in[s.Source]
+			continue
+		}
+
+		c := changes[s.Change]
+		if c.Op == Add {
+			out[i] = origin{source: -1, parts: []Part{{Bytes: c.Bytes}}, size: len(c.Bytes)}
+			continue
+		}
+
+		if c.From < 0 || c.From >= len(in) {
+			return nil, fmt.Errorf("%w: invalid edit of chunk %d", ErrInvalidDelta, c.From)
+		}
+
+		o := origin{source: -1}
+		for j, p := range c.Parts {
+			if p.Bytes != nil {
+				o.parts = appendPart(o.parts, p)
+				o.size += len(p.Bytes)
+				continue
+			}
+
+			if p.Offset < 0 || p.Length < 0 {
+				return nil, fmt.Errorf("%w: edit to chunk %d: part %d out of range", ErrInvalidDelta, c.To, j)
+			}
+
+			// Copies may extend into the chunks following chunk From.
+			k, start := c.From, 0
+			for off, n := p.Offset, p.Length; n > 0; k++ {
+				if k == len(in) {
+					return nil, fmt.Errorf("%w: edit to chunk %d: part %d out of range", ErrInvalidDelta, c.To, j)
+				}
+				if off >= start+in[k].size {
+					start += in[k].size
+					continue
+				}
+
+				length := start + in[k].size - off
+				if length > n {
+					length = n
+				}
+				o.parts = appendRange(o.parts, in[k], offsets, off-start, length)
+				o.size += length
+
+				off += length
+				n -= length
+				start += in[k].size
+			}
+		}
+		out[i] = o
+	}
+
+	return out, nil
+}
+
+// appendRange appends parts making `length` bytes of content of `o`
+// starting at `off`.
+func appendRange(parts []Part, o origin, offsets []int, off, length int) []Part {
+	if o.source >= 0 {
+		return appendPart(parts, Part{Offset: offsets[o.source] + off, Length: length})
+	}
+
+	start := 0
+	for _, p := range o.parts {
+		size := p.Length
+		if p.Bytes != nil {
+			size = len(p.Bytes)
+		}
+
+		from, to := off, off+length
+		if from < start {
+			from = start
+		}
+		if to > start+size {
+			to = start + size
+		}
+
+		if from < to {
+			if p.Bytes != nil {
+				parts = appendPart(parts, Part{Bytes: p.Bytes[from-start : to-start]})
+			} else {
+				parts = appendPart(parts, Part{Offset: p.Offset + from - start, Length: to - from})
+			}
+		}
+		start += size
+	}
+
+	return parts
+}
+
+// appendPart appends `p` to `parts`, merging it with the last part when
+// both copy adjacent data or both insert.
+func appendPart(parts []Part, p Part) []Part {
+	if len(parts) > 0 {
+		last := &parts[len(parts)-1]
+		switch {
+		case p.Bytes == nil && last.Bytes == nil && last.Offset+last.Length == p.Offset:
+			last.Length += p.Length
+			return parts
+		case p.Bytes != nil && last.Bytes != nil:
+			last.Bytes = append(last.Bytes[:len(last.Bytes):len(last.Bytes)], p.Bytes...)
+			return parts
+		}
+	}
+	return append(parts, p)
+}
+
+// originChanges returns changes building chunks of origins `result` from the
+// original source data of chunks at `offsets`, in the same form as Delta
+// and Refine: deletes first, then adds and edits, and finally moves of
+// chunks out of place.
+func originChanges(result []origin, offsets []int) []Change {
+	n := len(offsets) - 1
+	changes := make([]Change, 0)
+
+	used := make([]bool, n)
+	for _, o := range result {
+		if o.source >= 0 {
+			used[o.source] = true
+		}
+	}
+
+	var keptSrc []int
+	for i := 0; i < n; i++ {
+		if !used[i] {
+			changes = append(changes, Change{Op: Delete, From: i})
+			continue
+		}
+		keptSrc = append(keptSrc, i)
+	}
+
+	for to, o := range result {
+		if o.source >= 0 {
+			continue
+		}
+		changes = append(changes, originChange(o, to, offsets))
+	}
+
+	// Chunks kept in the same relative order need no change, as in Delta.
+	k := 0
+	for i, o := range result {
+		if o.source < 0 {
+			continue
+		}
+		if keptSrc[k] != o.source {
+			changes = append(changes, Change{Op: Move, From: o.source, To: i})
+		}
+		k++
+	}
+
+	return changes
+}
+
+// originChange returns the Add or Edit change building chunk `to` of origin
+// `o`.
+func originChange(o origin, to int, offsets []int) Change {
+	first := -1
+	for _, p := range o.parts {
+		if p.Bytes == nil && (first < 0 || p.Offset < first) {
+			first = p.Offset
+		}
+	}
+
+	if first < 0 {
+		// Adjacent inserts are merged into a single part.
+		var data []byte
+		if len(o.parts) > 0 {
+			data = o.parts[0].Bytes
+		}
+		return Change{Op: Add, To: to, Bytes: data}
+	}
+
+	// Copies are relative to the chunk containing the first copied byte.
+	from := sort.Search(len(offsets)-1, func(i int) bool { return offsets[i+1] > first })
+	parts := make([]Part, len(o.parts))
+	for i, p := range o.parts {
+		if p.Bytes == nil {
+			p.Offset -= offsets[from]
+		}
+		parts[i] = p
+	}
+	return Change{Op: Edit, From: from, To: to, Parts: parts}
+}
@@ -0,0 +1,174 @@
+package rollingdiff
+
+import (
+	"bytes"
+	"strconv"
+	"testing"
+
+	"github.com/tuommaki/rollingdiff/fastcdc"
+)
+
+func Test_Compose(t *testing.T) {
+	a := randomBytes(t, *seed, 16*fastcdc.MaxSize)
+	third := len(a) / 3
+
+	insert := func(data []byte, offset int, inserted []byte) []byte {
+		return append(append(append([]byte{}, data[:offset]...), inserted...), data[offset:]...)
+	}
+	b := insert(a, third, randomBytes(t, *seed+1, 5000))
+
+	testCases := []struct {
+		name   string
+		c      []byte
+		refine bool
+	}{
+		{
+			name: "edits in different places",
+			c:    insert(b, 2*third, []byte("hello, world")),
+		},
+		{
+			name:   "refined edits in different places",
+			c:      insert(b, 2*third, []byte("hello, world")),
+			refine: true,
+		},
+		{
+			name:   "refined edits in the same place",
+			c:      insert(b, third+2500, []byte("hello, world")),
+			refine: true,
+		},
+		{
+			name:   "inserted data deleted",
+			c:      a,
+			refine: true,
+		},
+		{
+			name: "data moved",
+			c:    append(append([]byte{}, b[third:]...), b[:third]...),
+		},
+	}
+
+	for i, tc := range testCases {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			t.Logf(tc.name)
+
+			srcA, srcB, srcC := Signatures(a), Signatures(b), Signatures(tc.c)
+			d1, d2 := Delta(srcA, srcB), Delta(srcB, srcC)
+			if tc.refine {
+				var err error
+				if d1, err = Refine(srcA, d1); err != nil {
+					t.Fatal(err)
+				}
+				if d2, err = Refine(srcB, d2); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			composed, err := Compose(srcA, d1, d2)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Data copied more than once by the second delta may be literal
+			// data of the first one, which the composed delta repeats.
+			if n, max := literalBytes(composed), literalBytes(d1)+literalBytes(d2)+overlappingCopies(d2); n > max {
+				t.Fatalf("expected at most %d literal bytes, got %d", max, n)
+			}
+
+			result, err := Apply(srcA, composed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(result, tc.c) {
+				t.Fatalf("expected result to equal data after both deltas")
+			}
+		})
+	}
+}
+
+// overlappingCopies returns the number of bytes copied again by parts of
+// edits in `changes` starting before the copy preceding them ends.
+func overlappingCopies(changes []Change) int {
+	n := 0
+	for _, c := range changes {
+		end := -1
+		for _, p := range c.Parts {
+			if p.Bytes != nil {
+				continue
+			}
+			if overlap := end - p.Offset; overlap > 0 {
+				if overlap > p.Length {
+					overlap = p.Length
+				}
+				n += overlap
+			}
+			end = p.Offset + p.Length
+		}
+	}
+	return n
+}
+
+func Test_Compose_Drops_Changes_Reverted_By_Second_Delta(t *testing.T) {
+	a := randomChunks(t, *seed, 8)
+
+	// Chunks 1 and 5 are swapped and a new chunk is inserted in between.
+	b := swapChunksAt(append([]Chunk{}, a...), 1, 5)
+	b = append(b[:3], append([]Chunk{randomChunk(t, *seed+1, 3)}, b[3:]...)...)
+	b = alignChunkIndexes(b)
+
+	d1 := Delta(a, b)
+	if literalBytes(d1) == 0 {
+		t.Fatalf("expected first delta to add literal data")
+	}
+
+	composed, err := Compose(a, d1, Delta(b, a))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(composed) != 0 {
+		t.Fatalf("expected no changes, got %v", composed)
+	}
+
+	// Dropping the inserted chunk leaves only moves.
+	c := alignChunkIndexes(dropChunkAt(append([]Chunk{}, b...), 3))
+	composed, err = Compose(a, d1, Delta(b, c))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, ch := range composed {
+		if ch.Op != Move {
+			t.Fatalf("expected only moves, got %v", ch.Op)
+		}
+	}
+
+	result, err := Apply(a, composed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(result, join(c)) {
+		t.Fatalf("expected result to equal chunks after both deltas")
+	}
+}
+
+func Test_Patch_Compose_Verifies_Digests(t *testing.T) {
+	a, b, c := randomChunks(t, *seed, 4), randomChunks(t, *seed+1, 4), randomChunks(t, *seed+2, 4)
+	p1, p2 := NewPatch(a, b), NewPatch(b, c)
+
+	p, err := p1.Compose(a, p2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := p.Apply(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(result, join(c)) {
+		t.Fatalf("expected result to equal chunks after both patches")
+	}
+
+	if _, err := p2.Compose(a, p1); err == nil {
+		t.Fatalf("expected error composing patches out of order")
+	}
+}
@@ -1,6 +1,9 @@
 package rollingdiff
 
-import "crypto/sha256"
+import (
+	"crypto/sha256"
+	"strconv"
+)
 
 type Operation int
 
@@ -9,13 +12,42 @@ const (
 	Delete Operation = iota
 	Add    Operation = iota
 	Move   Operation = iota
+	// Edit builds content of chunk To with Parts, copying from the source
+	// starting at chunk From. It is produced by Refine.
+	Edit Operation = iota
 )
 
+var operationNames = [...]string{
+	Nop:    "nop",
+	Delete: "delete",
+	Add:    "add",
+	Move:   "move",
+	Edit:   "edit",
+}
+
+func (op Operation) String() string {
+	if op >= 0 && int(op) < len(operationNames) {
+		return operationNames[op]
+	}
+	return "Operation(" + strconv.Itoa(int(op)) + ")"
+}
+
 type Change struct {
 	Op    Operation
 	From  int
 	To    int
 	Bytes []byte
+	Parts []Part
+}
+
+// Part is a byte-level operation of an Edit change. It either inserts Bytes,
+// if set, or copies Length bytes from Offset of the source data, counted
+// from the start of chunk From of the change. Copies may extend into the
+// chunks following it.
+type Part struct {
+	Offset int
+	Length int
+	Bytes  []byte
 }
 
 // Delta computes difference between two lists of chunks. It returns list of
@@ -23,64 +55,73 @@ type Change struct {
 func Delta(src, dst []Chunk) []Change {
 	changes := make([]Change, 0)
 
-	mSrc := make(map[[sha256.Size]byte]Chunk, len(src))
+	// Chunks with equal content may occur several times on both sides. Only
+	// as many occurrences can be reused as there are on the other side.
+	nSrc := make(map[[sha256.Size]byte]int, len(src))
 	for _, c := range src {
-		mSrc[c.Signature] = c
+		nSrc[c.Signature]++
 	}
 
-	mDst := make(map[[sha256.Size]byte]Chunk, len(dst))
+	nDst := make(map[[sha256.Size]byte]int, len(dst))
 	for _, c := range dst {
-		mDst[c.Signature] = c
+		nDst[c.Signature]++
 	}
 
 	// Add changes for deleted chunks.
-	for i := 0; i < len(src); i++ {
-		_, exists := mDst[src[i].Signature]
-		if !exists {
-			c := Change{
-				Op:   Delete,
-				From: src[i].Index,
-			}
-			changes = append(changes, c)
-			delete(mSrc, src[i].Signature)
-			src = append(src[:i], src[i+1:]...)
-			i--
+	keptSrc := make([]Chunk, 0, len(src))
+	kept := make(map[[sha256.Size]byte]int, len(src))
+	for _, c := range src {
+		if kept[c.Signature] < nDst[c.Signature] {
+			kept[c.Signature]++
+			keptSrc = append(keptSrc, c)
+			continue
 		}
+
+		changes = append(changes, Change{
+			Op:   Delete,
+			From: c.Index,
+		})
 	}
 
 	// Add changes for added chunks.
-	for i := 0; i < len(dst); i++ {
-		_, exists := mSrc[dst[i].Signature]
-		if !exists {
-			c := Change{
-				Op:    Add,
-				To:    dst[i].Index,
-				Bytes: dst[i].Bytes,
-			}
-			changes = append(changes, c)
-			delete(mDst, dst[i].Signature)
-			dst = append(dst[:i], dst[i+1:]...)
-			i--
+	keptDst := make([]Chunk, 0, len(dst))
+	kept = make(map[[sha256.Size]byte]int, len(dst))
+	for _, c := range dst {
+		if kept[c.Signature] < nSrc[c.Signature] {
+			kept[c.Signature]++
+			keptDst = append(keptDst, c)
+			continue
+		}
+
+		changes = append(changes, Change{
+			Op:    Add,
+			To:    c.Index,
+			Bytes: c.Bytes,
+		})
+	}
+
+	// Remaining chunks are the same on both sides, but possibly in different
+	// order. Collect positions that are out of place.
+	targets := make(map[[sha256.Size]byte][]int)
+	for i, c := range keptDst {
+		if keptSrc[i].Signature != c.Signature {
+			targets[c.Signature] = append(targets[c.Signature], c.Index)
 		}
 	}
 
 	// Finally check Moved chunks.
-	for i, c := range src {
-		if dst[i].Signature == c.Signature {
+	for i, c := range keptSrc {
+		if keptDst[i].Signature == c.Signature {
 			continue
 		}
 
-		v, exists := mDst[c.Signature]
-		if exists {
-			// Create Move change on first occurrance.
-			chg := Change{
-				Op:   Move,
-				From: c.Index,
-				To:   v.Index,
-			}
-			changes = append(changes, chg)
-			delete(mDst, c.Signature)
-		}
+		to := targets[c.Signature]
+		changes = append(changes, Change{
+			Op:   Move,
+			From: c.Index,
+			To:   to[0],
+		})
+		targets[c.Signature] = to[1:]
 	}
 
 	return changes
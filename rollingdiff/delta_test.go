@@ -168,6 +168,38 @@ func Test_Delta(t *testing.T) {
 				},
 			},
 		},
+		{
+			name:      "repeat first two chunks at the end",
+			oldChunks: randomChunks(t, *seed, 4),
+			newChunks: alignChunkIndexes(append(randomChunks(t, *seed, 4), randomChunks(t, *seed, 2)...)),
+			expected: []Change{
+				{
+					Op:    Add,
+					To:    4,
+					Bytes: randomChunk(t, *seed, 0).Bytes,
+				},
+				{
+					Op:    Add,
+					To:    5,
+					Bytes: randomChunks(t, *seed, 2)[1].Bytes,
+				},
+			},
+		},
+		{
+			name:      "drop repeated chunks",
+			oldChunks: alignChunkIndexes(append(randomChunks(t, *seed, 4), randomChunks(t, *seed, 2)...)),
+			newChunks: randomChunks(t, *seed, 4),
+			expected: []Change{
+				{
+					Op:   Delete,
+					From: 4,
+				},
+				{
+					Op:   Delete,
+					From: 5,
+				},
+			},
+		},
 	}
 
 	for i, tc := range testCases {
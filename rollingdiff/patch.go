@@ -0,0 +1,119 @@
+package rollingdiff
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+)
+
+// Errors wrapped by *DigestError.
+var (
+	ErrBaseMismatch   = errors.New("rollingdiff: delta applied to wrong base")
+	ErrResultMismatch = errors.New("rollingdiff: delta produced unexpected result")
+)
+
+// DigestError is returned when a digest verified by Patch does not match.
+// It wraps ErrBaseMismatch or ErrResultMismatch.
+type DigestError struct {
+	Err      error
+	Expected [sha256.Size]byte
+	Actual   [sha256.Size]byte
+}
+
+func (e *DigestError) Error() string {
+	return fmt.Sprintf("%v: expected digest %x, got %x", e.Err, e.Expected, e.Actual)
+}
+
+func (e *DigestError) Unwrap() error {
+	return e.Err
+}
+
+// Patch is a delta bound to the data it applies to. Applying it verifies
+// that the base is the expected one and that the result is intact.
+type Patch struct {
+	// Base is the digest of the data the changes apply to.
+	Base [sha256.Size]byte
+	// Result is the digest of the data resulting from the changes.
+	Result [sha256.Size]byte
+	// Changes are the changes computed by Delta.
+	Changes []Change
+}
+
+// Digest returns SHA-256 of content of `chunks` concatenated.
+func Digest(chunks []Chunk) [sha256.Size]byte {
+	h := sha256.New()
+	for _, c := range chunks {
+		h.Write(c.Bytes)
+	}
+
+	var sum [sha256.Size]byte
+	copy(sum[:], h.Sum(nil))
+	return sum
+}
+
+// NewPatch computes Delta between `src` and `dst` along with digests of both.
+func NewPatch(src, dst []Chunk) Patch {
+	return Patch{
+		Base:    Digest(src),
+		Result:  Digest(dst),
+		Changes: Delta(src, dst),
+	}
+}
+
+// Apply is like Apply of the package, but fails with *DigestError if `src`
+// is not the base of the patch, or if the result is not the expected one.
+func (p Patch) Apply(src []Chunk) ([]byte, error) {
+	chunks, err := p.ApplyChunks(src)
+	if err != nil {
+		return nil, err
+	}
+
+	return join(chunks), nil
+}
+
+// ApplyChunks is like Apply, but returns the result as a list of chunks.
+func (p Patch) ApplyChunks(src []Chunk) ([]Chunk, error) {
+	if err := p.VerifyBase(src); err != nil {
+		return nil, err
+	}
+
+	chunks, err := ApplyChunks(src, p.Changes)
+	if err != nil {
+		return nil, err
+	}
+
+	if sum := Digest(chunks); sum != p.Result {
+		return nil, &DigestError{Err: ErrResultMismatch, Expected: p.Result, Actual: sum}
+	}
+
+	return chunks, nil
+}
+
+// VerifyBase checks that `src` is the base of the patch.
+func (p Patch) VerifyBase(src []Chunk) error {
+	if sum := Digest(src); sum != p.Base {
+		return &DigestError{Err: ErrBaseMismatch, Expected: p.Base, Actual: sum}
+	}
+	return nil
+}
+
+// Compose is like Compose of the package, merging the patch with `next`,
+// which applies to its result, into a single patch from `src`. It fails with
+// *DigestError if `src` is not the base of the patch, or if `next` does not
+// apply to its result.
+func (p Patch) Compose(src []Chunk, next Patch) (Patch, error) {
+	if err := p.VerifyBase(src); err != nil {
+		return Patch{}, err
+	}
+
+	if next.Base != p.Result {
+		return Patch{}, &DigestError{Err: ErrBaseMismatch, Expected: next.Base, Actual: p.Result}
+	}
+
+	changes, err := Compose(src, p.Changes, next.Changes)
+	if err != nil {
+		return Patch{}, err
+	}
+
+	return Patch{Base: p.Base, Result: next.Result, Changes: changes}, nil
+}
@@ -0,0 +1,68 @@
+package rollingdiff
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/tuommaki/rollingdiff/fastcdc"
+)
+
+func Test_Patch_Apply(t *testing.T) {
+	oldData := randomBytes(t, *seed, 4*fastcdc.MaxSize)
+	newData := append(randomBytes(t, *seed+1, 1000), oldData[fastcdc.MaxSize:]...)
+
+	oldChunks := Signatures(oldData)
+	p := NewPatch(oldChunks, Signatures(newData))
+
+	result, err := p.Apply(oldChunks)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(result, newData) {
+		t.Fatalf("expected result to equal new data")
+	}
+}
+
+func Test_Patch_Apply_Rejects_Wrong_Base(t *testing.T) {
+	oldData := randomBytes(t, *seed, 4*fastcdc.MaxSize)
+	newData := append(randomBytes(t, *seed+1, 1000), oldData[fastcdc.MaxSize:]...)
+
+	p := NewPatch(Signatures(oldData), Signatures(newData))
+
+	// Same chunk boundaries, different content of one chunk.
+	otherChunks := Signatures(oldData)
+	otherChunks[1].Bytes = randomBytes(t, *seed+2, len(otherChunks[1].Bytes))
+
+	_, err := p.Apply(otherChunks)
+
+	var derr *DigestError
+	if !errors.As(err, &derr) || !errors.Is(err, ErrBaseMismatch) {
+		t.Fatalf("expected *DigestError wrapping ErrBaseMismatch, got %v", err)
+	}
+
+	if derr.Expected != p.Base {
+		t.Fatalf("expected digest %x, got %x", p.Base, derr.Expected)
+	}
+}
+
+func Test_Patch_Apply_Rejects_Wrong_Result(t *testing.T) {
+	oldData := randomBytes(t, *seed, 4*fastcdc.MaxSize)
+	newData := append(randomBytes(t, *seed+1, 1000), oldData[fastcdc.MaxSize:]...)
+
+	oldChunks := Signatures(oldData)
+	p := NewPatch(oldChunks, Signatures(newData))
+
+	for i, c := range p.Changes {
+		if c.Op == Add {
+			p.Changes[i].Bytes = append([]byte{}, c.Bytes...)
+			p.Changes[i].Bytes[0]++
+			break
+		}
+	}
+
+	if _, err := p.Apply(oldChunks); !errors.Is(err, ErrResultMismatch) {
+		t.Fatalf("expected ErrResultMismatch, got %v", err)
+	}
+}
@@ -0,0 +1,117 @@
+package rollingdiff
+
+import (
+	"crypto/sha256"
+	"sort"
+)
+
+// Range is a range of `Length` bytes starting at `Offset`.
+type Range struct {
+	Offset int
+	Length int
+}
+
+// Rechunk splits `buf` into the same chunks as Signatures does, reusing
+// `prev`, the chunks of an earlier version of the data of `prevSize` bytes,
+// outside of `modified` ranges. The data is assumed to be modified in place:
+// bytes outside of modified ranges are at the same offsets in both versions,
+// and the earlier version may have been truncated or extended at its end.
+// Modified ranges may come from any hint, such as blocks written since the
+// last modification time.
+//
+// Data is re-chunked from the last boundary before each modified range until
+// boundaries resynchronize with `prev`. Chunks of `prev` need Offset and
+// Signature set; their content is not read and signatures of reused chunks
+// are not recomputed.
+func (ch Chunker) Rechunk(prev []Chunk, prevSize int, buf []byte, modified []Range) []Chunk {
+	params := ch.params()
+	regions := dirtyRegions(modified, prevSize, len(buf), ch.window())
+
+	size := func(k int) int {
+		if k+1 < len(prev) {
+			return prev[k+1].Offset - prev[k].Offset
+		}
+		return prevSize - prev[k].Offset
+	}
+
+	var chunks []Chunk
+	r := 0
+	for offset := 0; offset < len(buf); {
+		for r < len(regions) && regions[r].Offset+regions[r].Length <= offset {
+			r++
+		}
+
+		// A chunk of the earlier version starting at the same boundary is
+		// reused if it ends before the next modified region.
+		k := sort.Search(len(prev), func(k int) bool { return prev[k].Offset >= offset })
+		if k < len(prev) && prev[k].Offset == offset {
+			end := offset + size(k)
+			if end <= len(buf) && (r == len(regions) || end <= regions[r].Offset) {
+				chunks = append(chunks, Chunk{
+					Bytes:     buf[offset:end],
+					Index:     len(chunks),
+					Offset:    offset,
+					Signature: prev[k].Signature,
+				})
+				offset = end
+				continue
+			}
+		}
+
+		n := ch.length(params, buf[offset:])
+		chunks = append(chunks, Chunk{
+			Bytes:     buf[offset : offset+n],
+			Index:     len(chunks),
+			Offset:    offset,
+			Signature: sha256.Sum256(buf[offset : offset+n]),
+		})
+		offset += n
+	}
+
+	return chunks
+}
+
+// dirtyRegions returns sorted, non-overlapping ranges where chunks of the
+// earlier version cannot be reused. If the size changed, the end of the data
+// within `window` bytes is included, since chunking near the end depends on
+// where the data ends.
+func dirtyRegions(modified []Range, prevSize, size, window int) []Range {
+	regions := make([]Range, 0, len(modified)+1)
+	for _, m := range modified {
+		if m.Length > 0 {
+			regions = append(regions, m)
+		}
+	}
+
+	if prevSize != size {
+		start := prevSize
+		if size < start {
+			start = size
+		}
+		start -= window
+		if start < 0 {
+			start = 0
+		}
+
+		end := prevSize
+		if size > end {
+			end = size
+		}
+		regions = append(regions, Range{Offset: start, Length: end - start})
+	}
+
+	sort.Slice(regions, func(i, j int) bool { return regions[i].Offset < regions[j].Offset })
+
+	merged := regions[:0]
+	for _, m := range regions {
+		if n := len(merged); n > 0 && m.Offset <= merged[n-1].Offset+merged[n-1].Length {
+			if end := m.Offset + m.Length; end > merged[n-1].Offset+merged[n-1].Length {
+				merged[n-1].Length = end - merged[n-1].Offset
+			}
+			continue
+		}
+		merged = append(merged, m)
+	}
+
+	return merged
+}
@@ -0,0 +1,113 @@
+package rollingdiff
+
+import (
+	"bytes"
+	"strconv"
+	"testing"
+
+	"github.com/tuommaki/rollingdiff/fastcdc"
+)
+
+func Test_Rechunk_Matches_Signatures(t *testing.T) {
+	oldData := randomBytes(t, *seed, 32*fastcdc.MaxSize)
+	mid := len(oldData) / 2
+
+	overwrite := func(data []byte, offset int, patch []byte) []byte {
+		data = append([]byte{}, data...)
+		copy(data[offset:], patch)
+		return data
+	}
+
+	testCases := []struct {
+		name     string
+		chunker  Chunker
+		newData  []byte
+		modified []Range
+	}{
+		{
+			name:    "unchanged data",
+			newData: oldData,
+		},
+		{
+			name:     "single byte modified",
+			newData:  overwrite(oldData, mid, []byte{^oldData[mid]}),
+			modified: []Range{{Offset: mid, Length: 1}},
+		},
+		{
+			name:     "several ranges modified",
+			newData:  overwrite(overwrite(oldData, 100, randomBytes(t, *seed+1, 5000)), mid, randomBytes(t, *seed+2, 100)),
+			modified: []Range{{Offset: mid, Length: 100}, {Offset: 100, Length: 5000}},
+		},
+		{
+			name:    "data extended",
+			newData: append(append([]byte{}, oldData...), randomBytes(t, *seed+1, 10000)...),
+		},
+		{
+			name:    "data truncated",
+			newData: oldData[:mid+123],
+		},
+		{
+			name:     "fixed size blocks",
+			chunker:  Chunker{BlockSize: 1000},
+			newData:  overwrite(oldData, mid, []byte("hello")),
+			modified: []Range{{Offset: mid, Length: 5}},
+		},
+	}
+
+	for i, tc := range testCases {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			t.Logf(tc.name)
+
+			prev := tc.chunker.Signatures(oldData)
+			expected := tc.chunker.Signatures(tc.newData)
+
+			// Chunks of the earlier version carry no content, and
+			// their signatures are kept by reused chunks.
+			reused := make([]Chunk, len(prev))
+			for j, c := range prev {
+				reused[j] = Chunk{Index: c.Index, Offset: c.Offset, Signature: c.Signature}
+			}
+
+			chunks := tc.chunker.Rechunk(reused, len(oldData), tc.newData, tc.modified)
+			if len(chunks) != len(expected) {
+				t.Fatalf("expected %d chunks, got %d", len(expected), len(chunks))
+			}
+
+			for j, e := range expected {
+				c := chunks[j]
+				if c.Index != e.Index || c.Offset != e.Offset || c.Signature != e.Signature || !bytes.Equal(c.Bytes, e.Bytes) {
+					t.Fatalf("expected chunk %d at %d of %d bytes, got chunk %d at %d of %d bytes", e.Index, e.Offset, len(e.Bytes), c.Index, c.Offset, len(c.Bytes))
+				}
+			}
+		})
+	}
+}
+
+func Test_Rechunk_Reuses_Chunks_Outside_Of_Modified_Ranges(t *testing.T) {
+	oldData := randomBytes(t, *seed, 32*fastcdc.MaxSize)
+	mid := len(oldData) / 2
+
+	newData := append([]byte{}, oldData...)
+	newData[mid] = ^newData[mid]
+
+	// Signatures of the earlier version are replaced by a marker, which
+	// shows up only in reused chunks.
+	var marker [32]byte
+	prev := Signatures(oldData)
+	for i := range prev {
+		prev[i].Signature = marker
+	}
+
+	chunks := Chunker{}.Rechunk(prev, len(oldData), newData, []Range{{Offset: mid, Length: 1}})
+
+	rehashed := 0
+	for _, c := range chunks {
+		if c.Signature != marker {
+			rehashed++
+		}
+	}
+
+	if rehashed == 0 || rehashed > 3 {
+		t.Fatalf("expected 1 to 3 of %d chunks rehashed, got %d", len(chunks), rehashed)
+	}
+}
@@ -0,0 +1,216 @@
+package rollingdiff
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Parameters of byte-level matching.
+const (
+	// refineBlockSize is the shortest match found by Refine.
+	refineBlockSize = 16
+	// refinePartCost approximates encoding overhead of a single Part.
+	refinePartCost = 8
+)
+
+// Refine diffs content of every chunk added by `changes` against the most
+// similar chunks of `src` at byte level. Add changes that can be expressed
+// more compactly as copies from a source chunk and inserts are replaced by
+// Edit changes. Candidates are the source chunks surrounding the position
+// where the chunk is added, which covers small in-place edits, and the
+// chunks deleted next to them.
+func Refine(src []Chunk, changes []Change) ([]Change, error) {
+	segments, err := Layout(src, changes)
+	if err != nil {
+		return nil, err
+	}
+
+	refined := make([]Change, len(changes))
+	for i, c := range changes {
+		refined[i] = c
+		if c.Op != Add || len(c.Bytes) < refineBlockSize {
+			continue
+		}
+
+		// Chunk boundaries near an edit may have moved, so the candidate
+		// is matched along with its neighbours.
+		best, bestCost := -1, len(c.Bytes)
+		var bestParts []Part
+		tried := make(map[int]bool)
+		for _, j := range candidates(segments, c.To, len(src)) {
+			from, to := j-1, j+2
+			if from < 0 {
+				from = 0
+			}
+			if to > len(src) {
+				to = len(src)
+			}
+			if tried[from] {
+				continue
+			}
+			tried[from] = true
+
+			parts := diffBytes(join(src[from:to]), c.Bytes)
+			if cost := partsCost(parts); cost < bestCost {
+				best, bestCost, bestParts = from, cost, parts
+			}
+		}
+
+		if best >= 0 {
+			refined[i] = Change{Op: Edit, From: best, To: c.To, Parts: bestParts}
+		}
+	}
+
+	return refined, nil
+}
+
+// candidates returns indexes of source chunks likely similar to result chunk
+// `to`: nearest chunks copied from the source on both sides, and chunks
+// following or preceding them in the source at the same distance.
+func candidates(segments []Segment, to, n int) []int {
+	var found []int
+	seen := make(map[int]bool)
+	add := func(i int) {
+		if i >= 0 && i < n && !seen[i] {
+			seen[i] = true
+			found = append(found, i)
+		}
+	}
+
+	for d := 1; to-d >= 0; d++ {
+		if s := segments[to-d].Source; s >= 0 {
+			add(s + d)
+			add(s)
+			break
+		}
+	}
+
+	for d := 1; to+d < len(segments); d++ {
+		if s := segments[to+d].Source; s >= 0 {
+			add(s - d)
+			add(s)
+			break
+		}
+	}
+
+	return found
+}
+
+// diffBytes expresses `target` as copies from `base` and inserts. Base is
+// indexed by non-overlapping blocks, and matches found at any offset of the
+// target are extended in both directions.
+func diffBytes(base, target []byte) []Part {
+	index := make(map[string]int, len(base)/refineBlockSize)
+	for off := 0; off+refineBlockSize <= len(base); off += refineBlockSize {
+		k := string(base[off : off+refineBlockSize])
+		if _, exists := index[k]; !exists {
+			index[k] = off
+		}
+	}
+
+	var parts []Part
+	literal := 0
+	for i := 0; i+refineBlockSize <= len(target); {
+		off, exists := index[string(target[i:i+refineBlockSize])]
+		if !exists {
+			i++
+			continue
+		}
+
+		start, baseStart := i, off
+		for start > literal && baseStart > 0 && target[start-1] == base[baseStart-1] {
+			start--
+			baseStart--
+		}
+
+		end, baseEnd := i+refineBlockSize, off+refineBlockSize
+		for end < len(target) && baseEnd < len(base) && target[end] == base[baseEnd] {
+			end++
+			baseEnd++
+		}
+
+		if start > literal {
+			parts = append(parts, Part{Bytes: target[literal:start]})
+		}
+		parts = append(parts, Part{Offset: baseStart, Length: end - start})
+
+		literal, i = end, end
+	}
+
+	if literal < len(target) {
+		parts = append(parts, Part{Bytes: target[literal:]})
+	}
+
+	return parts
+}
+
+func partsCost(parts []Part) int {
+	cost := 0
+	for _, p := range parts {
+		cost += refinePartCost + len(p.Bytes)
+	}
+	return cost
+}
+
+// Content returns the literal content of chunk To made by Add or Edit change
+// `c`. Edit changes copy from `src`, which needs to carry content only for
+// the chunks copied from.
+func (c Change) Content(src []Chunk) ([]byte, error) {
+	switch c.Op {
+	case Add:
+		return c.Bytes, nil
+	case Edit:
+		if c.From < 0 || c.From >= len(src) {
+			return nil, fmt.Errorf("%w: invalid edit of chunk %d", ErrInvalidDelta, c.From)
+		}
+		data, err := edit(src, c.From, c.Parts)
+		if err != nil {
+			return nil, fmt.Errorf("%w: edit to chunk %d: %v", ErrInvalidDelta, c.To, err)
+		}
+		return data, nil
+	default:
+		return nil, fmt.Errorf("%w: change to chunk %d has no content", ErrInvalidDelta, c.To)
+	}
+}
+
+// edit builds content with `parts` copying from `src` starting at chunk
+// `from`.
+func edit(src []Chunk, from int, parts []Part) ([]byte, error) {
+	// starts[i] is the offset of chunk from+i, relative to chunk from.
+	var starts []int
+	end := 0
+
+	var buf []byte
+	for i, p := range parts {
+		if p.Bytes != nil {
+			buf = append(buf, p.Bytes...)
+			continue
+		}
+
+		if p.Offset < 0 || p.Length < 0 {
+			return nil, fmt.Errorf("part %d out of range", i)
+		}
+
+		// Chunks are gathered lazily, as far as the copies reach.
+		for end < p.Offset+p.Length && from+len(starts) < len(src) {
+			starts = append(starts, end)
+			end += len(src[from+len(starts)-1].Bytes)
+		}
+		if p.Offset+p.Length > end {
+			return nil, fmt.Errorf("part %d out of range", i)
+		}
+
+		j := sort.Search(len(starts), func(k int) bool { return starts[k] > p.Offset }) - 1
+		for off, n := p.Offset, p.Length; n > 0; j++ {
+			data := src[from+j].Bytes[off-starts[j]:]
+			if len(data) > n {
+				data = data[:n]
+			}
+			buf = append(buf, data...)
+			off += len(data)
+			n -= len(data)
+		}
+	}
+
+	return buf, nil
+}
@@ -0,0 +1,96 @@
+package rollingdiff
+
+import (
+	"bytes"
+	"strconv"
+	"testing"
+
+	"github.com/tuommaki/rollingdiff/fastcdc"
+)
+
+func literalBytes(changes []Change) int {
+	n := 0
+	for _, c := range changes {
+		n += len(c.Bytes)
+		for _, p := range c.Parts {
+			n += len(p.Bytes)
+		}
+	}
+	return n
+}
+
+func Test_Refine(t *testing.T) {
+	oldData := randomBytes(t, *seed, 8*fastcdc.MaxSize)
+	mid := len(oldData) / 2
+
+	testCases := []struct {
+		name     string
+		newData  []byte
+		maxBytes int
+	}{
+		{
+			name:     "change single byte",
+			newData:  append(append(append([]byte{}, oldData[:mid]...), ^oldData[mid]), oldData[mid+1:]...),
+			maxBytes: 64,
+		},
+		{
+			name:     "insert few bytes",
+			newData:  append(append(append([]byte{}, oldData[:mid]...), "hello, world"...), oldData[mid:]...),
+			maxBytes: 64,
+		},
+		{
+			name:     "delete few bytes",
+			newData:  append(append([]byte{}, oldData[:mid]...), oldData[mid+100:]...),
+			maxBytes: 64,
+		},
+		{
+			// Only a single source chunk is used as base of an edit, so
+			// data around a longer insert is not always fully matched.
+			name:     "insert unrelated data",
+			newData:  append(append(append([]byte{}, oldData[:mid]...), randomBytes(t, *seed+1, 5000)...), oldData[mid:]...),
+			maxBytes: 5000 + fastcdc.MaxSize,
+		},
+	}
+
+	for i, tc := range testCases {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			t.Logf(tc.name)
+
+			src := Signatures(oldData)
+			changes := Delta(src, Signatures(tc.newData))
+
+			refined, err := Refine(src, changes)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if n := literalBytes(refined); n > tc.maxBytes {
+				t.Fatalf("expected at most %d literal bytes, got %d (%d before refinement)", tc.maxBytes, n, literalBytes(changes))
+			}
+
+			result, err := Apply(src, refined)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(result, tc.newData) {
+				t.Fatalf("expected result to equal new data")
+			}
+		})
+	}
+}
+
+func Test_Apply_Rejects_Invalid_Edit(t *testing.T) {
+	src := randomChunks(t, *seed, 2)
+
+	changes := []Change{{
+		Op:    Edit,
+		From:  1,
+		To:    2,
+		Parts: []Part{{Offset: len(src[1].Bytes) - 1, Length: 2}},
+	}}
+
+	if _, err := Apply(src, changes); err == nil {
+		t.Fatalf("expected error, got nil")
+	}
+}
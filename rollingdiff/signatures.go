@@ -2,6 +2,7 @@ package rollingdiff
 
 import (
 	"crypto/sha256"
+	"fmt"
 
 	"github.com/tuommaki/rollingdiff/fastcdc"
 )
@@ -9,26 +10,50 @@ import (
 type Chunk struct {
 	Bytes     []byte
 	Index     int
+	Offset    int
 	Signature [sha256.Size]byte
 }
 
+// Chunker splits data into chunks with configurable chunk size limits. Zero
+// value uses fastcdc.DefaultParams.
+type Chunker struct {
+	Params fastcdc.Params
+	// BlockSize, when set, splits data into blocks of fixed size instead of
+	// content defined chunks, for use with MatchBlocks. The last block may
+	// be shorter.
+	BlockSize int
+}
+
+// Validate checks that chunk size limits are either zero, for defaults, or
+// valid, and that the block size is not negative. Chunkers read from
+// untrusted input need to be validated before use.
+func (ch Chunker) Validate() error {
+	if ch.BlockSize < 0 {
+		return fmt.Errorf("rollingdiff: negative block size %d", ch.BlockSize)
+	}
+	if ch.Params == (fastcdc.Params{}) {
+		return nil
+	}
+	return ch.Params.Validate()
+}
+
+// Signatures splits `buf` into chunks using default chunk size limits.
 func Signatures(buf []byte) []Chunk {
+	return Chunker{}.Signatures(buf)
+}
+
+// Signatures splits `buf` into chunks.
+func (ch Chunker) Signatures(buf []byte) []Chunk {
 	var chunks []Chunk
+	params := ch.params()
 
 	for counter, offset := 0, 0; offset < len(buf); counter++ {
-		// FastCDC computes the next chunk boundary.
-		idx := fastcdc.Compute(buf[offset:len(buf)])
-
-		if (offset + idx) < len(buf) {
-			// Returned index from fastcdc points to last byte of chunk.
-			// Increase it by one to account for Go slice operation & offset
-			// pointing to beginning of next slice.
-			idx++
-		}
+		idx := ch.length(params, buf[offset:])
 
 		c := Chunk{
 			Bytes:     buf[offset : offset+idx],
 			Index:     counter,
+			Offset:    offset,
 			Signature: sha256.Sum256(buf[offset : offset+idx]),
 		}
 
@@ -38,3 +63,41 @@ func Signatures(buf []byte) []Chunk {
 
 	return chunks
 }
+
+// length returns length of the chunk at the start of `buf`. Result depends
+// only on the first window() bytes of `buf`.
+func (ch Chunker) length(params fastcdc.Params, buf []byte) int {
+	if ch.BlockSize > 0 {
+		if len(buf) > ch.BlockSize {
+			return ch.BlockSize
+		}
+		return len(buf)
+	}
+
+	// FastCDC computes the next chunk boundary.
+	idx := params.Compute(buf)
+
+	if idx < len(buf) {
+		// Returned index from fastcdc points to last byte of chunk.
+		// Increase it by one to account for Go slice operation & offset
+		// pointing to beginning of next slice.
+		idx++
+	}
+
+	return idx
+}
+
+// window returns the number of bytes needed to find the end of a chunk.
+func (ch Chunker) window() int {
+	if ch.BlockSize > 0 {
+		return ch.BlockSize
+	}
+	return ch.params().MaxSize + 1
+}
+
+func (ch Chunker) params() fastcdc.Params {
+	if ch.Params == (fastcdc.Params{}) {
+		return fastcdc.DefaultParams
+	}
+	return ch.Params
+}
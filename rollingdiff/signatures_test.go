@@ -1,6 +1,7 @@
 package rollingdiff
 
 import (
+	"strconv"
 	"testing"
 
 	"github.com/tuommaki/rollingdiff/fastcdc"
@@ -24,6 +25,10 @@ func Test_Signatures_Splits_Data_Into_Chunks_With_Correct_Content(t *testing.T)
 
 	offset := 0
 	for i, chunk := range chunks {
+		if chunk.Offset != offset {
+			t.Fatalf("expected chunk[%d].Offset == %d, got %d", i, offset, chunk.Offset)
+		}
+
 		for j, b := range chunk.Bytes {
 			if data[offset] != b {
 				t.Fatalf("expected data[%d] == chunk[%d].Bytes[%d], got %#x != %#x", offset, i, j, data[offset], b)
@@ -321,3 +326,71 @@ func Test_Signatures_Delete_Second_Segment(t *testing.T) {
 		}
 	}
 }
+
+func Test_Chunker_Signatures_Respects_Params(t *testing.T) {
+	data := randomBytes(t, *seed, 16*fastcdc.MaxSize)
+
+	defaultChunks := Chunker{}.Signatures(data)
+	expectedChunks := Signatures(data)
+	if len(defaultChunks) != len(expectedChunks) {
+		t.Fatalf("expected zero value Chunker to use default params, got %d != %d chunks", len(defaultChunks), len(expectedChunks))
+	}
+
+	params := fastcdc.Params{MinSize: 256, NormalSize: 1024, MaxSize: 4096}
+	chunks := Chunker{Params: params}.Signatures(data)
+
+	if len(chunks) <= len(defaultChunks) {
+		t.Fatalf("expected smaller params to produce more chunks, got %d <= %d", len(chunks), len(defaultChunks))
+	}
+
+	// Like with default params, chunks cut at the size limit end one byte
+	// past MaxSize.
+	for i, c := range chunks[:len(chunks)-1] {
+		if len(c.Bytes) < params.MinSize || len(c.Bytes) > params.MaxSize+1 {
+			t.Fatalf("expected %d <= len(chunks[%d].Bytes) <= %d, got %d", params.MinSize, i, params.MaxSize+1, len(c.Bytes))
+		}
+	}
+}
+
+func Test_Chunker_Signatures_Splits_Fixed_Size_Blocks(t *testing.T) {
+	data := randomBytes(t, *seed, 10000)
+
+	chunks := Chunker{BlockSize: 1024}.Signatures(data)
+	if len(chunks) != 10 {
+		t.Fatalf("expected 10 blocks, got %d", len(chunks))
+	}
+
+	for i, c := range chunks {
+		expected := 1024
+		if i == len(chunks)-1 {
+			expected = 10000 - 9*1024
+		}
+		if len(c.Bytes) != expected || c.Offset != i*1024 {
+			t.Fatalf("expected block %d of %d bytes at %d, got %d bytes at %d", i, expected, i*1024, len(c.Bytes), c.Offset)
+		}
+	}
+}
+
+func Test_Chunker_Validate(t *testing.T) {
+	testCases := []struct {
+		name    string
+		chunker Chunker
+		valid   bool
+	}{
+		{name: "zero value", valid: true},
+		{name: "fixed size blocks", chunker: Chunker{BlockSize: 1024}, valid: true},
+		{name: "custom params", chunker: Chunker{Params: fastcdc.Params{MinSize: 256, NormalSize: 1024, MaxSize: 4096}}, valid: true},
+		{name: "negative min size", chunker: Chunker{Params: fastcdc.Params{MinSize: -5, NormalSize: 1024, MaxSize: 4096}}},
+		{name: "negative block size", chunker: Chunker{BlockSize: -1}},
+	}
+
+	for i, tc := range testCases {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			t.Logf(tc.name)
+
+			if err := tc.chunker.Validate(); (err == nil) != tc.valid {
+				t.Fatalf("expected valid %v, got %v", tc.valid, err)
+			}
+		})
+	}
+}
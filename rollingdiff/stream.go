@@ -0,0 +1,81 @@
+package rollingdiff
+
+import (
+	"crypto/sha256"
+	"io"
+)
+
+// ChunkReader splits a stream into chunks, one at a time, without holding
+// the whole data in memory. Chunk boundaries are the same as of Signatures
+// of the whole data.
+type ChunkReader struct {
+	chunker Chunker
+	r       io.Reader
+	window  int
+	buf     []byte
+	// Data read but not yet returned as chunks is buf[start:end].
+	start, end int
+	eof        bool
+	index      int
+	offset     int
+}
+
+// NewReader returns a ChunkReader splitting data read from `r`.
+func (ch Chunker) NewReader(r io.Reader) *ChunkReader {
+	ch.Params = ch.params()
+	window := ch.window()
+
+	return &ChunkReader{
+		chunker: ch,
+		r:       r,
+		window:  window,
+		buf:     make([]byte, 4*window),
+	}
+}
+
+// Next returns the next chunk of the stream, or io.EOF at its end. Bytes of
+// the returned chunk are only valid until the following call of Next.
+func (cr *ChunkReader) Next() (Chunk, error) {
+	if err := cr.fill(); err != nil {
+		return Chunk{}, err
+	}
+
+	data := cr.buf[cr.start:cr.end]
+	if len(data) == 0 {
+		return Chunk{}, io.EOF
+	}
+
+	n := cr.chunker.length(cr.chunker.Params, data)
+	c := Chunk{
+		Bytes:     data[:n],
+		Index:     cr.index,
+		Offset:    cr.offset,
+		Signature: sha256.Sum256(data[:n]),
+	}
+
+	cr.start += n
+	cr.index++
+	cr.offset += n
+
+	return c, nil
+}
+
+// fill reads until a whole window of data is buffered, or the stream ends.
+func (cr *ChunkReader) fill() error {
+	for !cr.eof && cr.end-cr.start < cr.window {
+		if len(cr.buf)-cr.start < cr.window {
+			n := copy(cr.buf, cr.buf[cr.start:cr.end])
+			cr.start, cr.end = 0, n
+		}
+
+		n, err := cr.r.Read(cr.buf[cr.end:])
+		cr.end += n
+		if err == io.EOF {
+			cr.eof = true
+		} else if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
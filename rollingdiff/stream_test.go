@@ -0,0 +1,66 @@
+package rollingdiff
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strconv"
+	"testing"
+	"testing/iotest"
+
+	"github.com/tuommaki/rollingdiff/fastcdc"
+)
+
+func Test_ChunkReader_Matches_Signatures(t *testing.T) {
+	data := randomBytes(t, *seed, 32*fastcdc.MaxSize+123)
+
+	testCases := []struct {
+		name    string
+		chunker Chunker
+	}{
+		{name: "default params", chunker: Chunker{}},
+		{name: "small params", chunker: Chunker{Params: fastcdc.Params{MinSize: 256, NormalSize: 1024, MaxSize: 4096}}},
+		{name: "fixed size blocks", chunker: Chunker{BlockSize: 1000}},
+	}
+
+	for i, tc := range testCases {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			t.Logf(tc.name)
+
+			expected := tc.chunker.Signatures(data)
+
+			// Short reads make the buffer refill at arbitrary positions.
+			cr := tc.chunker.NewReader(iotest.HalfReader(bytes.NewReader(data)))
+			for j := 0; ; j++ {
+				c, err := cr.Next()
+				if err == io.EOF {
+					if j != len(expected) {
+						t.Fatalf("expected %d chunks, got %d", len(expected), j)
+					}
+					break
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if j >= len(expected) {
+					t.Fatalf("expected %d chunks, got more", len(expected))
+				}
+
+				e := expected[j]
+				if c.Index != e.Index || c.Offset != e.Offset || c.Signature != e.Signature || !bytes.Equal(c.Bytes, e.Bytes) {
+					t.Fatalf("expected chunk %d at %d of %d bytes, got chunk %d at %d of %d bytes", e.Index, e.Offset, len(e.Bytes), c.Index, c.Offset, len(c.Bytes))
+				}
+			}
+		})
+	}
+}
+
+func Test_ChunkReader_Returns_Read_Error(t *testing.T) {
+	errRead := errors.New("read failed")
+	cr := Chunker{}.NewReader(iotest.ErrReader(errRead))
+
+	if _, err := cr.Next(); !errors.Is(err, errRead) {
+		t.Fatalf("expected read error, got %v", err)
+	}
+}
@@ -0,0 +1,57 @@
+package rollingdiff
+
+// Summary accounts for bytes of a delta.
+type Summary struct {
+	OldSize int
+	NewSize int
+	// Reused is the number of bytes of the new data taken from the old
+	// data, either as whole chunks or copied by edits.
+	Reused int
+	// Added is the number of literal bytes carried by the delta.
+	Added int
+	// Deleted is the number of bytes of deleted chunks.
+	Deleted int
+	Moves   int
+	Changes int
+}
+
+// Summarize accounts for bytes of `changes` computed between `src` and `dst`
+// chunks, which need to carry their content.
+func Summarize(src, dst []Chunk, changes []Change) Summary {
+	s := Summary{Changes: len(changes)}
+	for _, c := range src {
+		s.OldSize += len(c.Bytes)
+	}
+	for _, c := range dst {
+		s.NewSize += len(c.Bytes)
+	}
+
+	for _, c := range changes {
+		switch c.Op {
+		case Delete:
+			if c.From >= 0 && c.From < len(src) {
+				s.Deleted += len(src[c.From].Bytes)
+			}
+		case Move:
+			s.Moves++
+		}
+
+		s.Added += len(c.Bytes)
+		for _, p := range c.Parts {
+			s.Added += len(p.Bytes)
+		}
+	}
+
+	s.Reused = s.NewSize - s.Added
+	return s
+}
+
+// Ratio returns literal data of the delta relative to size of the new data,
+// i.e. the fraction of the new data that needs to be transferred. It is zero
+// for empty new data.
+func (s Summary) Ratio() float64 {
+	if s.NewSize == 0 {
+		return 0
+	}
+	return float64(s.Added) / float64(s.NewSize)
+}
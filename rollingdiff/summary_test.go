@@ -0,0 +1,45 @@
+package rollingdiff
+
+import "testing"
+
+func Test_Summarize_Accounts_For_Bytes(t *testing.T) {
+	oldChunks := randomChunks(t, *seed, 4)
+	added := randomChunk(t, *seed+1, 0)
+
+	// Second chunk is replaced and the last two are swapped.
+	newChunks := alignChunkIndexes([]Chunk{oldChunks[0], added, oldChunks[3], oldChunks[2]})
+
+	s := Summarize(oldChunks, newChunks, Delta(oldChunks, newChunks))
+
+	oldSize := len(joinChunks(oldChunks))
+	newSize := len(joinChunks(newChunks))
+	if s.OldSize != oldSize || s.NewSize != newSize {
+		t.Fatalf("expected sizes %d and %d, got %d and %d", oldSize, newSize, s.OldSize, s.NewSize)
+	}
+
+	if s.Added != len(added.Bytes) {
+		t.Fatalf("expected %d added bytes, got %d", len(added.Bytes), s.Added)
+	}
+
+	if s.Deleted != len(oldChunks[1].Bytes) {
+		t.Fatalf("expected %d deleted bytes, got %d", len(oldChunks[1].Bytes), s.Deleted)
+	}
+
+	if s.Reused != newSize-len(added.Bytes) {
+		t.Fatalf("expected %d reused bytes, got %d", newSize-len(added.Bytes), s.Reused)
+	}
+
+	if s.Moves != 2 {
+		t.Fatalf("expected 2 moves, got %d", s.Moves)
+	}
+
+	if expected := float64(len(added.Bytes)) / float64(newSize); s.Ratio() != expected {
+		t.Fatalf("expected ratio %f, got %f", expected, s.Ratio())
+	}
+}
+
+func Test_Summary_Ratio_Of_Empty_Data(t *testing.T) {
+	if r := Summarize(nil, nil, nil).Ratio(); r != 0 {
+		t.Fatalf("expected zero ratio, got %f", r)
+	}
+}
@@ -0,0 +1,127 @@
+package rollingdiff
+
+import (
+	"crypto/sha256"
+	"fmt"
+)
+
+// VerifyError describes chunks that failed verification.
+type VerifyError struct {
+	// Corrupted lists indexes of chunks whose content does not match their
+	// signature.
+	Corrupted []int
+	// Missing lists indexes of chunks that are expected but absent.
+	Missing []int
+	// Orphaned lists indexes of stored chunks that are not expected.
+	Orphaned []int
+}
+
+func (e *VerifyError) Error() string {
+	return fmt.Sprintf("rollingdiff: %d corrupted, %d missing and %d orphaned chunks", len(e.Corrupted), len(e.Missing), len(e.Orphaned))
+}
+
+func (e *VerifyError) empty() bool {
+	return len(e.Corrupted) == 0 && len(e.Missing) == 0 && len(e.Orphaned) == 0
+}
+
+// Verify re-hashes content of every chunk and compares it against its
+// signature. It also checks that chunk indexes form a consecutive sequence
+// starting from zero. Chunks lost after the last one present cannot be told
+// from a shorter list; VerifyManifest notices those as well. On failure,
+// returned error is of type *VerifyError.
+func Verify(chunks []Chunk) error {
+	var verr VerifyError
+
+	seen := make(map[int]bool, len(chunks))
+	maxIndex := -1
+	for _, c := range chunks {
+		if sha256.Sum256(c.Bytes) != c.Signature {
+			verr.Corrupted = append(verr.Corrupted, c.Index)
+		}
+
+		seen[c.Index] = true
+		if c.Index > maxIndex {
+			maxIndex = c.Index
+		}
+	}
+
+	for i := 0; i <= maxIndex; i++ {
+		if !seen[i] {
+			verr.Missing = append(verr.Missing, i)
+		}
+	}
+
+	if !verr.empty() {
+		return &verr
+	}
+
+	return nil
+}
+
+// VerifyManifest checks stored `chunks` against `manifest`, the chunks data
+// is expected to consist of, of which only indexes and signatures are used.
+// Stored chunks carry the signature they are stored under. Corrupted lists
+// indexes of stored chunks whose content does not match that signature,
+// Missing lists indexes of manifest chunks no stored chunk is stored under,
+// and Orphaned lists indexes of stored chunks the manifest does not refer
+// to. On failure, returned error is of type *VerifyError.
+func VerifyManifest(manifest, chunks []Chunk) error {
+	var verr VerifyError
+
+	expected := make(map[[sha256.Size]byte]bool, len(manifest))
+	for _, c := range manifest {
+		expected[c.Signature] = true
+	}
+
+	stored := make(map[[sha256.Size]byte]bool, len(chunks))
+	for _, c := range chunks {
+		stored[c.Signature] = true
+
+		if sha256.Sum256(c.Bytes) != c.Signature {
+			verr.Corrupted = append(verr.Corrupted, c.Index)
+		}
+		if !expected[c.Signature] {
+			verr.Orphaned = append(verr.Orphaned, c.Index)
+		}
+	}
+
+	for _, c := range manifest {
+		if !stored[c.Signature] {
+			verr.Missing = append(verr.Missing, c.Index)
+		}
+	}
+
+	if !verr.empty() {
+		return &verr
+	}
+
+	return nil
+}
+
+// Repair rebuilds chunks of `manifest` from content of stored `chunks`,
+// found by hashing it, regardless of the index and signature they are
+// stored under. Returned chunks have indexes, offsets and signatures of the
+// manifest. If content of some manifest chunks is not found, the error is
+// of type *VerifyError listing them as Missing.
+func Repair(manifest, chunks []Chunk) ([]Chunk, error) {
+	content := make(map[[sha256.Size]byte][]byte, len(chunks))
+	for _, c := range chunks {
+		content[sha256.Sum256(c.Bytes)] = c.Bytes
+	}
+
+	var verr VerifyError
+	repaired := make([]Chunk, len(manifest))
+	for i, c := range manifest {
+		data, exists := content[c.Signature]
+		if !exists {
+			verr.Missing = append(verr.Missing, c.Index)
+		}
+		repaired[i] = Chunk{Bytes: data, Index: c.Index, Offset: c.Offset, Signature: c.Signature}
+	}
+
+	if !verr.empty() {
+		return nil, &verr
+	}
+
+	return repaired, nil
+}
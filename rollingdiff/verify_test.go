@@ -0,0 +1,106 @@
+package rollingdiff
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/tuommaki/rollingdiff/fastcdc"
+)
+
+func Test_Verify_Detects_Corrupted_And_Missing_Chunks(t *testing.T) {
+	data := randomBytes(t, *seed, 4*fastcdc.MaxSize)
+	chunks := Signatures(data)
+
+	if err := Verify(chunks); err != nil {
+		t.Fatalf("expected Verify() == nil, got %v", err)
+	}
+
+	// Modify content of the second chunk and drop the third one.
+	corrupted := make([]Chunk, len(chunks))
+	copy(corrupted, chunks)
+	corrupted[1].Bytes = append([]byte{}, corrupted[1].Bytes...)
+	corrupted[1].Bytes[0]++
+	corrupted = dropChunkAt(corrupted, 2)
+
+	err := Verify(corrupted)
+	verr, ok := err.(*VerifyError)
+	if !ok {
+		t.Fatalf("expected *VerifyError, got %#v", err)
+	}
+
+	if len(verr.Corrupted) != 1 || verr.Corrupted[0] != 1 {
+		t.Fatalf("expected verr.Corrupted == [1], got %v", verr.Corrupted)
+	}
+
+	if len(verr.Missing) != 1 || verr.Missing[0] != 2 {
+		t.Fatalf("expected verr.Missing == [2], got %v", verr.Missing)
+	}
+}
+
+func Test_VerifyManifest_Detects_Corrupted_Missing_And_Orphaned_Chunks(t *testing.T) {
+	data := randomBytes(t, *seed, 4*fastcdc.MaxSize)
+	manifest := Signatures(data)
+
+	if err := VerifyManifest(manifest, manifest); err != nil {
+		t.Fatalf("expected VerifyManifest() == nil, got %v", err)
+	}
+
+	// Modify content of the first chunk, drop the last one and store an
+	// unrelated chunk.
+	last := len(manifest) - 1
+	stored := append([]Chunk{}, manifest[:last]...)
+	stored[0].Bytes = append([]byte{}, stored[0].Bytes...)
+	stored[0].Bytes[0]++
+	stored = append(stored, randomChunk(t, *seed+1, len(manifest)))
+
+	err := VerifyManifest(manifest, stored)
+	verr, ok := err.(*VerifyError)
+	if !ok {
+		t.Fatalf("expected *VerifyError, got %#v", err)
+	}
+
+	if len(verr.Corrupted) != 1 || verr.Corrupted[0] != 0 {
+		t.Fatalf("expected verr.Corrupted == [0], got %v", verr.Corrupted)
+	}
+
+	if len(verr.Missing) != 1 || verr.Missing[0] != last {
+		t.Fatalf("expected verr.Missing == [%d], got %v", last, verr.Missing)
+	}
+
+	if len(verr.Orphaned) != 1 || verr.Orphaned[0] != len(manifest) {
+		t.Fatalf("expected verr.Orphaned == [%d], got %v", len(manifest), verr.Orphaned)
+	}
+}
+
+func Test_Repair_Rebuilds_Chunks_From_Content_Stored_Elsewhere(t *testing.T) {
+	data := randomBytes(t, *seed, 4*fastcdc.MaxSize)
+	manifest := Signatures(data)
+
+	// Chunks are stored under each other's indexes and signatures.
+	stored := swapChunksAt(append([]Chunk{}, manifest...), 0, 2)
+	stored[0].Index, stored[0].Signature = 0, manifest[0].Signature
+	stored[2].Index, stored[2].Signature = 2, manifest[2].Signature
+	if err := VerifyManifest(manifest, stored); err == nil {
+		t.Fatalf("expected swapped chunks to fail verification")
+	}
+
+	repaired, err := Repair(manifest, stored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyManifest(manifest, repaired); err != nil {
+		t.Fatalf("expected repaired chunks to verify, got %v", err)
+	}
+	if !bytes.Equal(join(repaired), data) {
+		t.Fatalf("expected repaired chunks to equal original data")
+	}
+
+	_, err = Repair(manifest, dropChunkAt(stored, 1))
+	verr, ok := err.(*VerifyError)
+	if !ok {
+		t.Fatalf("expected *VerifyError, got %#v", err)
+	}
+	if len(verr.Missing) != 1 || verr.Missing[0] != 1 {
+		t.Fatalf("expected verr.Missing == [1], got %v", verr.Missing)
+	}
+}
@@ -0,0 +1,285 @@
+// Package tree provides snapshots of directory trees and computes
+// differences between them.
+package tree
+
+import (
+	"crypto/sha256"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/tuommaki/rollingdiff/rollingdiff"
+)
+
+// RenameThreshold is the minimum fraction of file content, measured in bytes
+// of shared chunks, that must be equal between removed and added file for
+// them to be considered a rename.
+const RenameThreshold = 0.5
+
+// Entry describes a single file system object within a snapshot.
+type Entry struct {
+	// Path is slash separated path relative to snapshot root.
+	Path string
+	Mode os.FileMode
+	// Target is the destination of a symbolic link.
+	Target string
+	// Size and Digest describe content of a regular file.
+	Size   int64
+	Digest [sha256.Size]byte
+	Chunks []rollingdiff.Chunk
+}
+
+// Snapshot is a recorded state of a directory tree.
+type Snapshot struct {
+	// Entries are sorted by path.
+	Entries []Entry
+	byPath  map[string]int
+}
+
+// Take walks the directory tree under `root` and records every directory,
+// symbolic link and regular file in it. Regular files are split into chunks
+// with rollingdiff.Signatures. Other file types (devices, sockets, pipes) are
+// skipped.
+func Take(root string) (*Snapshot, error) {
+	var entries []Entry
+
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+
+		e := Entry{
+			Path: filepath.ToSlash(rel),
+			Mode: info.Mode(),
+		}
+
+		switch {
+		case info.Mode().IsDir():
+		case info.Mode()&os.ModeSymlink != 0:
+			e.Target, err = os.Readlink(path)
+			if err != nil {
+				return err
+			}
+		case info.Mode().IsRegular():
+			data, err := ioutil.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			e.Size = int64(len(data))
+			e.Digest = sha256.Sum256(data)
+			e.Chunks = rollingdiff.Signatures(data)
+		default:
+			return nil
+		}
+
+		entries = append(entries, e)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return NewSnapshot(entries), nil
+}
+
+// NewSnapshot creates a snapshot from a list of entries.
+func NewSnapshot(entries []Entry) *Snapshot {
+	s := &Snapshot{
+		Entries: append([]Entry(nil), entries...),
+		byPath:  make(map[string]int, len(entries)),
+	}
+
+	sort.Slice(s.Entries, func(i, j int) bool {
+		return s.Entries[i].Path < s.Entries[j].Path
+	})
+
+	for i, e := range s.Entries {
+		s.byPath[e.Path] = i
+	}
+
+	return s
+}
+
+// Lookup returns entry with given `path`.
+func (s *Snapshot) Lookup(path string) (Entry, bool) {
+	i, exists := s.byPath[path]
+	if !exists {
+		return Entry{}, false
+	}
+	return s.Entries[i], true
+}
+
+// FileDelta describes change of a single entry that exists in both
+// snapshots, possibly under different path.
+type FileDelta struct {
+	OldPath string
+	NewPath string
+	OldMode os.FileMode
+	NewMode os.FileMode
+	// Changes is the chunk level delta of a regular file's content. It is
+	// empty when the content did not change.
+	Changes []rollingdiff.Change
+}
+
+// Diff describes differences between two snapshots.
+type Diff struct {
+	Added    []Entry
+	Removed  []Entry
+	Renamed  []FileDelta
+	Modified []FileDelta
+}
+
+// Empty reports whether snapshots were equal.
+func (d Diff) Empty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Renamed) == 0 && len(d.Modified) == 0
+}
+
+// Compare computes differences between `src` and `dst` snapshots.
+//
+// Entries present in both snapshots under the same path are reported as
+// modified when their type, mode, symlink target or content differ; type
+// change is reported as removal and addition. Regular files present only in
+// one of the snapshots are paired into renames when they share enough
+// content, measured by matching chunk signatures.
+func Compare(src, dst *Snapshot) Diff {
+	var d Diff
+
+	for _, se := range src.Entries {
+		de, exists := dst.Lookup(se.Path)
+		if !exists || se.Mode.Type() != de.Mode.Type() {
+			d.Removed = append(d.Removed, se)
+			continue
+		}
+
+		if se.Mode == de.Mode && se.Target == de.Target && se.Digest == de.Digest {
+			continue
+		}
+
+		d.Modified = append(d.Modified, fileDelta(se, de))
+	}
+
+	for _, de := range dst.Entries {
+		se, exists := src.Lookup(de.Path)
+		if !exists || se.Mode.Type() != de.Mode.Type() {
+			d.Added = append(d.Added, de)
+		}
+	}
+
+	d.Renamed, d.Removed, d.Added = detectRenames(d.Removed, d.Added)
+
+	return d
+}
+
+func fileDelta(src, dst Entry) FileDelta {
+	fd := FileDelta{
+		OldPath: src.Path,
+		NewPath: dst.Path,
+		OldMode: src.Mode,
+		NewMode: dst.Mode,
+	}
+
+	if src.Mode.IsRegular() && src.Digest != dst.Digest {
+		fd.Changes = rollingdiff.Delta(src.Chunks, dst.Chunks)
+	}
+
+	return fd
+}
+
+// detectRenames pairs removed and added regular files into renames. Pairs
+// are chosen greedily starting from the most similar ones. Remaining removed
+// and added entries are returned as is.
+func detectRenames(removed, added []Entry) ([]FileDelta, []Entry, []Entry) {
+	type candidate struct {
+		r, a       int
+		similarity float64
+	}
+
+	var candidates []candidate
+	for i, r := range removed {
+		if !r.Mode.IsRegular() {
+			continue
+		}
+
+		for j, a := range added {
+			if !a.Mode.IsRegular() {
+				continue
+			}
+
+			s := similarity(r, a)
+			if s >= RenameThreshold {
+				candidates = append(candidates, candidate{r: i, a: j, similarity: s})
+			}
+		}
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].similarity > candidates[j].similarity
+	})
+
+	var renamed []FileDelta
+	usedRemoved := make(map[int]bool)
+	usedAdded := make(map[int]bool)
+	for _, c := range candidates {
+		if usedRemoved[c.r] || usedAdded[c.a] {
+			continue
+		}
+
+		usedRemoved[c.r] = true
+		usedAdded[c.a] = true
+		renamed = append(renamed, fileDelta(removed[c.r], added[c.a]))
+	}
+
+	sort.Slice(renamed, func(i, j int) bool {
+		return renamed[i].NewPath < renamed[j].NewPath
+	})
+
+	return renamed, unused(removed, usedRemoved), unused(added, usedAdded)
+}
+
+// similarity computes fraction of bytes in chunks shared between `a` and
+// `b`, relative to the larger of the two.
+func similarity(a, b Entry) float64 {
+	if a.Size == 0 || b.Size == 0 {
+		// Empty files carry no content to identify them by.
+		return 0
+	}
+
+	sigs := make(map[[sha256.Size]byte]int, len(a.Chunks))
+	for _, c := range a.Chunks {
+		sigs[c.Signature]++
+	}
+
+	shared := 0
+	for _, c := range b.Chunks {
+		if sigs[c.Signature] > 0 {
+			sigs[c.Signature]--
+			shared += len(c.Bytes)
+		}
+	}
+
+	size := a.Size
+	if b.Size > size {
+		size = b.Size
+	}
+
+	return float64(shared) / float64(size)
+}
+
+func unused(entries []Entry, used map[int]bool) []Entry {
+	var res []Entry
+	for i, e := range entries {
+		if !used[i] {
+			res = append(res, e)
+		}
+	}
+	return res
+}
@@ -0,0 +1,163 @@
+package tree
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/tuommaki/rollingdiff/fastcdc"
+	"github.com/tuommaki/rollingdiff/internal/testutil"
+	"github.com/tuommaki/rollingdiff/rollingdiff"
+)
+
+func writeFile(t *testing.T, root, path string, data []byte, mode os.FileMode) {
+	t.Helper()
+
+	p := filepath.Join(root, filepath.FromSlash(path))
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(p, data, mode); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(p, mode); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func takeSnapshot(t *testing.T, root string) *Snapshot {
+	t.Helper()
+
+	s, err := Take(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func paths(entries []Entry) []string {
+	var res []string
+	for _, e := range entries {
+		res = append(res, e.Path)
+	}
+	return res
+}
+
+func Test_Take_Records_Files_Symlinks_And_Empty_Directories(t *testing.T) {
+	root := t.TempDir()
+
+	writeFile(t, root, "a/file", testutil.RandomBytes(t, 1, 3*fastcdc.MaxSize), 0640)
+	if err := os.Mkdir(filepath.Join(root, "empty"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("a/file", filepath.Join(root, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	s := takeSnapshot(t, root)
+
+	expected := []string{"a", "a/file", "empty", "link"}
+	got := paths(s.Entries)
+	if len(got) != len(expected) {
+		t.Fatalf("expected entries %v, got %v", expected, got)
+	}
+	for i := range expected {
+		if expected[i] != got[i] {
+			t.Fatalf("expected entries %v, got %v", expected, got)
+		}
+	}
+
+	f, _ := s.Lookup("a/file")
+	if f.Mode.Perm() != 0640 {
+		t.Fatalf("expected mode 0640, got %#o", f.Mode.Perm())
+	}
+	if f.Size != 3*int64(fastcdc.MaxSize) || len(f.Chunks) < 3 {
+		t.Fatalf("expected file to be chunked, got size %d with %d chunks", f.Size, len(f.Chunks))
+	}
+
+	l, _ := s.Lookup("link")
+	if l.Target != "a/file" {
+		t.Fatalf("expected link target a/file, got %q", l.Target)
+	}
+
+	d, _ := s.Lookup("empty")
+	if !d.Mode.IsDir() {
+		t.Fatalf("expected empty to be a directory, got %v", d.Mode)
+	}
+}
+
+func Test_Compare(t *testing.T) {
+	oldRoot := t.TempDir()
+	newRoot := t.TempDir()
+
+	unchanged := testutil.RandomBytes(t, 1, 2*fastcdc.MaxSize)
+	renamed := testutil.RandomBytes(t, 2, 4*fastcdc.MaxSize)
+	modified := testutil.RandomBytes(t, 3, 4*fastcdc.MaxSize)
+
+	writeFile(t, oldRoot, "unchanged", unchanged, 0644)
+	writeFile(t, newRoot, "unchanged", unchanged, 0644)
+
+	writeFile(t, oldRoot, "old/name", renamed, 0644)
+	writeFile(t, newRoot, "new/name", renamed, 0644)
+
+	writeFile(t, oldRoot, "modified", modified, 0644)
+	writeFile(t, newRoot, "modified", append(append([]byte{}, modified...), testutil.RandomBytes(t, 4, fastcdc.MaxSize)...), 0644)
+
+	writeFile(t, oldRoot, "chmod", unchanged, 0644)
+	writeFile(t, newRoot, "chmod", unchanged, 0755)
+
+	writeFile(t, oldRoot, "removed", testutil.RandomBytes(t, 5, 1024), 0644)
+	writeFile(t, newRoot, "added", testutil.RandomBytes(t, 6, 1024), 0644)
+
+	d := Compare(takeSnapshot(t, oldRoot), takeSnapshot(t, newRoot))
+
+	if got := paths(d.Added); len(got) != 2 || got[0] != "added" || got[1] != "new" {
+		t.Fatalf("expected added [added new], got %v", got)
+	}
+
+	if got := paths(d.Removed); len(got) != 2 || got[0] != "old" || got[1] != "removed" {
+		t.Fatalf("expected removed [old removed], got %v", got)
+	}
+
+	if len(d.Renamed) != 1 || d.Renamed[0].OldPath != "old/name" || d.Renamed[0].NewPath != "new/name" {
+		t.Fatalf("expected rename of old/name to new/name, got %#v", d.Renamed)
+	}
+	if len(d.Renamed[0].Changes) != 0 {
+		t.Fatalf("expected renamed file to have no content changes, got %d", len(d.Renamed[0].Changes))
+	}
+
+	if len(d.Modified) != 2 {
+		t.Fatalf("expected 2 modified entries, got %d", len(d.Modified))
+	}
+
+	chmod, mod := d.Modified[0], d.Modified[1]
+	if chmod.OldPath != "chmod" || chmod.OldMode.Perm() != 0644 || chmod.NewMode.Perm() != 0755 || len(chmod.Changes) != 0 {
+		t.Fatalf("expected mode change of chmod, got %#v", chmod)
+	}
+
+	if mod.OldPath != "modified" || len(mod.Changes) == 0 {
+		t.Fatalf("expected content changes in modified, got %#v", mod)
+	}
+
+	// Data was appended, so only the old trailing chunk may be deleted.
+	old, _ := takeSnapshot(t, oldRoot).Lookup("modified")
+	for _, c := range mod.Changes {
+		if c.Op == rollingdiff.Delete && c.From != len(old.Chunks)-1 {
+			t.Fatalf("expected only last chunk to be deleted, got %#v", c)
+		}
+		if c.Op == rollingdiff.Move {
+			t.Fatalf("expected no moves, got %#v", c)
+		}
+	}
+}
+
+func Test_Compare_Equal_Snapshots(t *testing.T) {
+	root := t.TempDir()
+	writeFile(t, root, "a/b/c", testutil.RandomBytes(t, 1, 1024), 0644)
+
+	d := Compare(takeSnapshot(t, root), takeSnapshot(t, root))
+	if !d.Empty() {
+		t.Fatalf("expected empty diff, got %#v", d)
+	}
+}
@@ -0,0 +1,277 @@
+package vcdiff
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/adler32"
+	"io"
+
+	"github.com/tuommaki/rollingdiff/rollingdiff"
+)
+
+// Decode reads a VCDIFF stream from `r` and converts it into changes that
+// turn `src` chunks into the target of the stream, for use with
+// rollingdiff.Apply. Chunks in `src` must carry their content, which is
+// needed to resolve copies within the target.
+//
+// Every window of the stream becomes a single chunk of the result, built by
+// an Edit change copying from the source where the stream does, or by an
+// Add change when there is no source.
+func Decode(r io.Reader, src []rollingdiff.Chunk) ([]rollingdiff.Change, error) {
+	source := make([]byte, 0)
+	for _, c := range src {
+		source = append(source, c.Bytes...)
+	}
+
+	br := bufio.NewReader(r)
+	sr := &reader{r: br}
+
+	header, err := sr.bytes(len(magic) + 1)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(header[:len(magic)], magic[:]) {
+		return nil, fmt.Errorf("%w: bad magic", ErrFormat)
+	}
+
+	indicator := header[len(magic)]
+	if indicator&(vcdDecompress|vcdCodeTable) != 0 {
+		return nil, fmt.Errorf("%w: secondary compression or custom code table", ErrUnsupported)
+	}
+	if indicator&^(vcdDecompress|vcdCodeTable|vcdAppHeader) != 0 {
+		return nil, fmt.Errorf("%w: header indicator %#x", ErrFormat, indicator)
+	}
+	if indicator&vcdAppHeader != 0 {
+		n, err := sr.int()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := io.CopyN(io.Discard, br, int64(n)); err != nil {
+			return nil, fmt.Errorf("%w: unexpected end of data", ErrFormat)
+		}
+	}
+
+	var changes []rollingdiff.Change
+	for i := range src {
+		changes = append(changes, rollingdiff.Change{Op: rollingdiff.Delete, From: i})
+	}
+
+	var target []byte
+	for to := 0; ; {
+		if _, err := br.Peek(1); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		w, err := decodeWindow(sr, source, target)
+		if err != nil {
+			return nil, err
+		}
+		if len(w.data) == 0 {
+			continue
+		}
+		target = append(target, w.data...)
+
+		if len(src) == 0 {
+			changes = append(changes, rollingdiff.Change{Op: rollingdiff.Add, To: to, Bytes: w.data})
+		} else {
+			changes = append(changes, rollingdiff.Change{Op: rollingdiff.Edit, From: 0, To: to, Parts: w.parts})
+		}
+		to++
+	}
+
+	return changes, nil
+}
+
+// window is a decoded target window, both as data and as parts copying from
+// the source.
+type window struct {
+	data  []byte
+	parts []rollingdiff.Part
+}
+
+func (w *window) insert(data []byte) {
+	w.data = append(w.data, data...)
+	w.insertPart(data)
+}
+
+// insertPart records `data`, already appended to the window, as inserted.
+func (w *window) insertPart(data []byte) {
+	if n := len(w.parts); n > 0 && w.parts[n-1].Bytes != nil {
+		w.parts[n-1].Bytes = append(w.parts[n-1].Bytes, data...)
+		return
+	}
+	w.parts = append(w.parts, rollingdiff.Part{Bytes: append([]byte{}, data...)})
+}
+
+func (w *window) copySource(source []byte, offset, size int) {
+	w.data = append(w.data, source[offset:offset+size]...)
+
+	if n := len(w.parts); n > 0 && w.parts[n-1].Bytes == nil && w.parts[n-1].Offset+w.parts[n-1].Length == offset {
+		w.parts[n-1].Length += size
+		return
+	}
+	w.parts = append(w.parts, rollingdiff.Part{Offset: offset, Length: size})
+}
+
+func decodeWindow(sr *reader, source, target []byte) (window, error) {
+	var w window
+
+	indicator, err := sr.byte()
+	if err != nil {
+		return w, err
+	}
+	if indicator&^(vcdSource|vcdTarget|vcdAdler32) != 0 || indicator&(vcdSource|vcdTarget) == vcdSource|vcdTarget {
+		return w, fmt.Errorf("%w: window indicator %#x", ErrFormat, indicator)
+	}
+
+	// Segment of the source or of the target decoded so far, which copies
+	// address before the target window.
+	var segment []byte
+	segmentPos := 0
+	fromSource := indicator&vcdSource != 0
+	if indicator&(vcdSource|vcdTarget) != 0 {
+		size, err := sr.int()
+		if err != nil {
+			return w, err
+		}
+		pos, err := sr.int()
+		if err != nil {
+			return w, err
+		}
+
+		data := target
+		if fromSource {
+			data = source
+		}
+		if pos > len(data) || size > len(data)-pos {
+			return w, fmt.Errorf("%w: segment %d+%d out of range", ErrFormat, pos, size)
+		}
+		segment, segmentPos = data[pos:pos+size], pos
+	}
+
+	deltaSize, err := sr.int()
+	if err != nil {
+		return w, err
+	}
+	if deltaSize > 2*MaxWindowSize {
+		return w, fmt.Errorf("%w: window of %d bytes", ErrUnsupported, deltaSize)
+	}
+	delta, err := sr.bytes(deltaSize)
+	if err != nil {
+		return w, err
+	}
+
+	dr := &reader{r: bytes.NewReader(delta)}
+	targetSize, err := dr.int()
+	if err != nil {
+		return w, err
+	}
+	if targetSize > MaxWindowSize {
+		return w, fmt.Errorf("%w: target window of %d bytes", ErrUnsupported, targetSize)
+	}
+
+	if compression, err := dr.byte(); err != nil {
+		return w, err
+	} else if compression != 0 {
+		return w, fmt.Errorf("%w: secondary compression", ErrUnsupported)
+	}
+
+	var lengths [3]int
+	for i := range lengths {
+		if lengths[i], err = dr.int(); err != nil {
+			return w, err
+		}
+	}
+
+	var checksum []byte
+	if indicator&vcdAdler32 != 0 {
+		if checksum, err = dr.bytes(4); err != nil {
+			return w, err
+		}
+	}
+
+	var sections [3][]byte
+	for i, n := range lengths {
+		if sections[i], err = dr.bytes(n); err != nil {
+			return w, err
+		}
+	}
+
+	instSection := bytes.NewReader(sections[1])
+	data := &reader{r: bytes.NewReader(sections[0])}
+	inst := &reader{r: instSection}
+	addrs := &reader{r: bytes.NewReader(sections[2])}
+
+	var cache addressCache
+	w.data = make([]byte, 0, targetSize)
+
+	for len(w.data) < targetSize || instSection.Len() > 0 {
+		opcode, err := inst.byte()
+		if err != nil {
+			return w, err
+		}
+
+		for _, in := range defaultCodeTable[opcode] {
+			if in.typ == noop {
+				continue
+			}
+
+			size := int(in.size)
+			if size == 0 {
+				if size, err = inst.int(); err != nil {
+					return w, err
+				}
+			}
+			if size > targetSize-len(w.data) {
+				return w, fmt.Errorf("%w: instruction exceeds target window", ErrFormat)
+			}
+
+			switch in.typ {
+			case add:
+				b, err := data.bytes(size)
+				if err != nil {
+					return w, err
+				}
+				w.insert(b)
+			case run:
+				b, err := data.byte()
+				if err != nil {
+					return w, err
+				}
+				w.insert(bytes.Repeat([]byte{b}, size))
+			case copyOp:
+				addr, err := cache.decode(addrs, len(segment)+len(w.data), in.mode)
+				if err != nil {
+					return w, err
+				}
+
+				if fromSource && addr+size <= len(segment) {
+					w.copySource(source, segmentPos+addr, size)
+					continue
+				}
+
+				// Copy may overlap the data it produces, so it proceeds
+				// byte by byte.
+				start := len(w.data)
+				for i := 0; i < size; i++ {
+					if p := addr + i; p < len(segment) {
+						w.data = append(w.data, segment[p])
+					} else {
+						w.data = append(w.data, w.data[p-len(segment)])
+					}
+				}
+				w.insertPart(w.data[start:])
+			}
+		}
+	}
+
+	if checksum != nil && adler32.Checksum(w.data) != binary.BigEndian.Uint32(checksum) {
+		return w, ErrChecksum
+	}
+
+	return w, nil
+}
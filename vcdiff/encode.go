@@ -0,0 +1,239 @@
+package vcdiff
+
+import (
+	"io"
+
+	"github.com/tuommaki/rollingdiff/rollingdiff"
+)
+
+// minRun is the shortest sequence of equal literal bytes encoded as RUN.
+const minRun = 8
+
+// op is an instruction of the target, with copy addresses as offsets in the
+// whole source.
+type op struct {
+	typ  byte
+	addr int
+	size int
+	data []byte
+}
+
+// Encode writes `changes`, as computed by rollingdiff.Delta or
+// rollingdiff.Refine against `src` chunks, as a VCDIFF stream to `w`. Chunks
+// in `src` must carry offsets; their content is not needed.
+//
+// The result is split into windows of at most MaxWindowSize bytes, each
+// referring to the span of the source it copies from.
+func Encode(w io.Writer, src []rollingdiff.Chunk, changes []rollingdiff.Change) error {
+	ops, err := instructions(src, changes)
+	if err != nil {
+		return err
+	}
+
+	if _, err := w.Write(append(magic[:], 0)); err != nil {
+		return err
+	}
+
+	for len(ops) > 0 {
+		var window []op
+		window, ops = nextWindow(ops)
+
+		if _, err := w.Write(encodeWindow(window)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// instructions converts changes into a list of instructions building the
+// result.
+func instructions(src []rollingdiff.Chunk, changes []rollingdiff.Change) ([]op, error) {
+	// Content of edited chunks is encoded from their parts.
+	edits := make(map[int]rollingdiff.Change)
+	for _, c := range changes {
+		if c.Op == rollingdiff.Edit {
+			edits[c.To] = c
+		}
+	}
+
+	// Layout builds content of edited chunks, which requires content of the
+	// source chunks. Edits are given to it as empty additions instead.
+	layoutChanges := make([]rollingdiff.Change, len(changes))
+	for i, c := range changes {
+		if c.Op == rollingdiff.Edit {
+			c = rollingdiff.Change{Op: rollingdiff.Add, To: c.To}
+		}
+		layoutChanges[i] = c
+	}
+
+	segments, err := rollingdiff.Layout(src, layoutChanges)
+	if err != nil {
+		return nil, err
+	}
+
+	var ops []op
+	for i, s := range segments {
+		if s.Source >= 0 {
+			ops = appendCopy(ops, src[s.Source].Offset, len(s.Chunk.Bytes))
+			continue
+		}
+
+		e, edited := edits[i]
+		if !edited {
+			ops = appendLiteral(ops, s.Chunk.Bytes)
+			continue
+		}
+
+		base := src[e.From].Offset
+		for _, p := range e.Parts {
+			if p.Bytes != nil {
+				ops = appendLiteral(ops, p.Bytes)
+			} else {
+				ops = appendCopy(ops, base+p.Offset, p.Length)
+			}
+		}
+	}
+
+	return ops, nil
+}
+
+func appendCopy(ops []op, addr, size int) []op {
+	if size == 0 {
+		return ops
+	}
+
+	if n := len(ops); n > 0 && ops[n-1].typ == copyOp && ops[n-1].addr+ops[n-1].size == addr {
+		ops[n-1].size += size
+		return ops
+	}
+
+	return append(ops, op{typ: copyOp, addr: addr, size: size})
+}
+
+func appendLiteral(ops []op, data []byte) []op {
+	start := 0
+	for i := 0; i < len(data); {
+		// Length of the run of equal bytes at i.
+		n := 1
+		for i+n < len(data) && data[i+n] == data[i] {
+			n++
+		}
+
+		if n >= minRun {
+			ops = appendAdd(ops, data[start:i])
+			ops = append(ops, op{typ: run, size: n, data: data[i : i+1]})
+			start = i + n
+		}
+		i += n
+	}
+
+	return appendAdd(ops, data[start:])
+}
+
+// appendAdd adds `data` to the list, merged with the preceding ADD if any.
+// Data of ADD instructions is always a copy, so it can be appended to.
+func appendAdd(ops []op, data []byte) []op {
+	if len(data) == 0 {
+		return ops
+	}
+
+	if n := len(ops); n > 0 && ops[n-1].typ == add {
+		ops[n-1].data = append(ops[n-1].data, data...)
+		ops[n-1].size += len(data)
+		return ops
+	}
+
+	return append(ops, op{typ: add, size: len(data), data: append([]byte{}, data...)})
+}
+
+// nextWindow splits off instructions producing at most MaxWindowSize bytes.
+func nextWindow(ops []op) (window, rest []op) {
+	size := 0
+	for i, o := range ops {
+		if size+o.size <= MaxWindowSize {
+			size += o.size
+			continue
+		}
+
+		// Split the instruction at the window boundary.
+		head, tail := o, o
+		head.size = MaxWindowSize - size
+		tail.size -= head.size
+		switch o.typ {
+		case add:
+			head.data, tail.data = o.data[:head.size], o.data[head.size:]
+		case copyOp:
+			tail.addr += head.size
+		}
+
+		window = append(ops[:i:i], head)
+		rest = append([]op{tail}, ops[i+1:]...)
+		return window, rest
+	}
+
+	return ops, nil
+}
+
+func encodeWindow(ops []op) []byte {
+	// Source segment spans everything copied within the window.
+	lo, hi := -1, 0
+	targetSize := 0
+	for _, o := range ops {
+		targetSize += o.size
+		if o.typ != copyOp {
+			continue
+		}
+		if lo < 0 || o.addr < lo {
+			lo = o.addr
+		}
+		if o.addr+o.size > hi {
+			hi = o.addr + o.size
+		}
+	}
+
+	var data, inst, addr []byte
+	for _, o := range ops {
+		switch o.typ {
+		case add:
+			if o.size <= 17 {
+				inst = append(inst, byte(opAdd+o.size))
+			} else {
+				inst = appendInt(append(inst, opAdd), o.size)
+			}
+			data = append(data, o.data...)
+		case run:
+			inst = appendInt(append(inst, opRun), o.size)
+			data = append(data, o.data[0])
+		case copyOp:
+			if o.size >= 4 && o.size <= 18 {
+				inst = append(inst, byte(opCopySelf+o.size-3))
+			} else {
+				inst = appendInt(append(inst, opCopySelf), o.size)
+			}
+			addr = appendInt(addr, o.addr-lo)
+		}
+	}
+
+	var delta []byte
+	delta = appendInt(delta, targetSize)
+	delta = append(delta, 0)
+	delta = appendInt(delta, len(data))
+	delta = appendInt(delta, len(inst))
+	delta = appendInt(delta, len(addr))
+	delta = append(delta, data...)
+	delta = append(delta, inst...)
+	delta = append(delta, addr...)
+
+	var buf []byte
+	if lo < 0 {
+		buf = append(buf, 0)
+	} else {
+		buf = append(buf, vcdSource)
+		buf = appendInt(buf, hi-lo)
+		buf = appendInt(buf, lo)
+	}
+	buf = appendInt(buf, len(delta))
+
+	return append(buf, delta...)
+}
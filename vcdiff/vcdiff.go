@@ -0,0 +1,231 @@
+// Package vcdiff converts rollingdiff deltas to and from VCDIFF (RFC 3284)
+// streams, as produced and consumed by tools such as xdelta3 and open-vcdiff.
+//
+// Streams are written with the default code table and no secondary
+// compression. Streams using the default code table, any address cache mode,
+// source or target segments and the Adler-32 window checksum extension can
+// be read.
+package vcdiff
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+var magic = [4]byte{0xd6, 0xc3, 0xc4, 0x00}
+
+// Header indicator bits.
+const (
+	vcdDecompress = 1 << 0
+	vcdCodeTable  = 1 << 1
+	vcdAppHeader  = 1 << 2
+)
+
+// Window indicator bits.
+const (
+	vcdSource  = 1 << 0
+	vcdTarget  = 1 << 1
+	vcdAdler32 = 1 << 2
+)
+
+// Instruction types.
+const (
+	noop = iota
+	add
+	run
+	copyOp
+)
+
+// Sizes of the default address cache.
+const (
+	nearSize = 4
+	sameSize = 3
+)
+
+const maxInt = int(^uint(0) >> 1)
+
+// MaxWindowSize is the largest target window written by Encode, and accepted
+// by Decode.
+const MaxWindowSize = 1 << 24
+
+var (
+	// ErrFormat is returned when a stream is not valid VCDIFF.
+	ErrFormat = errors.New("vcdiff: invalid stream")
+	// ErrUnsupported is returned for valid streams using features that are
+	// not supported, such as secondary compression or custom code tables.
+	ErrUnsupported = errors.New("vcdiff: unsupported feature")
+	// ErrChecksum is returned when a window does not match its checksum.
+	ErrChecksum = errors.New("vcdiff: window checksum mismatch")
+)
+
+// instruction is a single entry half of the code table.
+type instruction struct {
+	typ  byte
+	size byte
+	mode byte
+}
+
+// defaultCodeTable is the code table of RFC 3284, section 5.6.
+var defaultCodeTable = func() (table [256][2]instruction) {
+	i := 0
+	next := func(first, second instruction) {
+		table[i] = [2]instruction{first, second}
+		i++
+	}
+
+	next(instruction{typ: run}, instruction{})
+	for size := 0; size <= 17; size++ {
+		next(instruction{typ: add, size: byte(size)}, instruction{})
+	}
+	for mode := 0; mode < 9; mode++ {
+		next(instruction{typ: copyOp, mode: byte(mode)}, instruction{})
+		for size := 4; size <= 18; size++ {
+			next(instruction{typ: copyOp, size: byte(size), mode: byte(mode)}, instruction{})
+		}
+	}
+	for mode := 0; mode < 6; mode++ {
+		for addSize := 1; addSize <= 4; addSize++ {
+			for copySize := 4; copySize <= 6; copySize++ {
+				next(instruction{typ: add, size: byte(addSize)},
+					instruction{typ: copyOp, size: byte(copySize), mode: byte(mode)})
+			}
+		}
+	}
+	for mode := 6; mode < 9; mode++ {
+		for addSize := 1; addSize <= 4; addSize++ {
+			next(instruction{typ: add, size: byte(addSize)},
+				instruction{typ: copyOp, size: 4, mode: byte(mode)})
+		}
+	}
+	for mode := 0; mode < 9; mode++ {
+		next(instruction{typ: copyOp, size: 4, mode: byte(mode)},
+			instruction{typ: add, size: 1})
+	}
+
+	return table
+}()
+
+// Opcodes of the default code table used by the encoder.
+const (
+	opRun      = 0
+	opAdd      = 1
+	opCopySelf = 19
+)
+
+// addressCache implements the address encoding modes of RFC 3284, section
+// 5.1.
+type addressCache struct {
+	near     [nearSize]int
+	nextSlot int
+	same     [sameSize * 256]int
+}
+
+func (c *addressCache) reset() {
+	*c = addressCache{}
+}
+
+func (c *addressCache) update(addr int) {
+	c.near[c.nextSlot] = addr
+	c.nextSlot = (c.nextSlot + 1) % nearSize
+	c.same[addr%(sameSize*256)] = addr
+}
+
+// decode reads address of a copy in `mode` at position `here` of the
+// address space.
+func (c *addressCache) decode(r *reader, here int, mode byte) (int, error) {
+	var addr int
+	switch {
+	case mode == 0:
+		n, err := r.int()
+		if err != nil {
+			return 0, err
+		}
+		addr = n
+	case mode == 1:
+		n, err := r.int()
+		if err != nil {
+			return 0, err
+		}
+		addr = here - n
+	case int(mode) < 2+nearSize:
+		n, err := r.int()
+		if err != nil {
+			return 0, err
+		}
+		addr = c.near[mode-2] + n
+	case int(mode) < 2+nearSize+sameSize:
+		b, err := r.byte()
+		if err != nil {
+			return 0, err
+		}
+		addr = c.same[int(mode-2-nearSize)*256+int(b)]
+	default:
+		return 0, fmt.Errorf("%w: address mode %d", ErrFormat, mode)
+	}
+
+	if addr < 0 || addr >= here {
+		return 0, fmt.Errorf("%w: address %d out of range", ErrFormat, addr)
+	}
+
+	c.update(addr)
+	return addr, nil
+}
+
+// appendInt appends `n` as a VCDIFF integer: base 128, most significant
+// digit first, with the high bit set on all but the last byte.
+func appendInt(buf []byte, n int) []byte {
+	var tmp [10]byte
+	i := len(tmp) - 1
+	tmp[i] = byte(n & 0x7f)
+	for n >>= 7; n > 0; n >>= 7 {
+		i--
+		tmp[i] = byte(n&0x7f) | 0x80
+	}
+	return append(buf, tmp[i:]...)
+}
+
+// reader reads VCDIFF integers and bytes from a section or a stream.
+type reader struct {
+	r interface {
+		io.Reader
+		io.ByteReader
+	}
+}
+
+func (r *reader) byte() (byte, error) {
+	b, err := r.r.ReadByte()
+	if err == io.EOF {
+		return 0, fmt.Errorf("%w: unexpected end of data", ErrFormat)
+	}
+	return b, err
+}
+
+func (r *reader) int() (int, error) {
+	n := 0
+	for i := 0; i < 9; i++ {
+		b, err := r.byte()
+		if err != nil {
+			return 0, err
+		}
+
+		if n > maxInt>>7 {
+			return 0, fmt.Errorf("%w: integer too large", ErrFormat)
+		}
+		n = n<<7 | int(b&0x7f)
+		if b&0x80 == 0 {
+			return n, nil
+		}
+	}
+	return 0, fmt.Errorf("%w: integer too long", ErrFormat)
+}
+
+func (r *reader) bytes(n int) ([]byte, error) {
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(r.r, buf); err == io.EOF || err == io.ErrUnexpectedEOF {
+		return nil, fmt.Errorf("%w: unexpected end of data", ErrFormat)
+	} else if err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
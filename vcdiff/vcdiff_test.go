@@ -0,0 +1,208 @@
+package vcdiff
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/adler32"
+	"strconv"
+	"testing"
+
+	"github.com/tuommaki/rollingdiff/fastcdc"
+	"github.com/tuommaki/rollingdiff/internal/testutil"
+	"github.com/tuommaki/rollingdiff/rollingdiff"
+)
+
+func concat(parts ...[]byte) []byte {
+	var buf []byte
+	for _, p := range parts {
+		buf = append(buf, p...)
+	}
+	return buf
+}
+
+func Test_Encode_Decode_Roundtrip(t *testing.T) {
+	a := testutil.RandomBytes(t, 1, 4*fastcdc.MaxSize)
+	b := testutil.RandomBytes(t, 2, 4*fastcdc.MaxSize)
+	lit := testutil.RandomBytes(t, 3, 3000)
+	zeros := make([]byte, 5000)
+
+	testCases := []struct {
+		name    string
+		oldData []byte
+		newData []byte
+		refine  bool
+	}{
+		{name: "no changes", oldData: concat(a, b), newData: concat(a, b)},
+		{name: "swap", oldData: concat(a, b), newData: concat(b, lit, a)},
+		{name: "runs in literal data", oldData: concat(a), newData: concat(a, zeros, lit, zeros)},
+		{name: "refined edit", oldData: concat(a, b), newData: concat(a[:1000], []byte("edit"), a[1000:], b), refine: true},
+		{name: "from empty", oldData: nil, newData: concat(lit, zeros)},
+		{name: "to empty", oldData: concat(a), newData: nil},
+	}
+
+	for i, tc := range testCases {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			t.Logf(tc.name)
+
+			src := rollingdiff.Signatures(tc.oldData)
+			changes := rollingdiff.Delta(src, rollingdiff.Signatures(tc.newData))
+			if tc.refine {
+				var err error
+				if changes, err = rollingdiff.Refine(src, changes); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			var buf bytes.Buffer
+			if err := Encode(&buf, src, changes); err != nil {
+				t.Fatal(err)
+			}
+
+			decoded, err := Decode(bytes.NewReader(buf.Bytes()), src)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			result, err := rollingdiff.Apply(src, decoded)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(result, tc.newData) {
+				t.Fatalf("expected result to equal new data")
+			}
+		})
+	}
+}
+
+// testWindow encodes a target window from its sections.
+func testWindow(indicator byte, segment []int, targetSize int, data, inst, addr []byte, checksum []byte) []byte {
+	var delta []byte
+	delta = appendInt(delta, targetSize)
+	delta = append(delta, 0)
+	delta = appendInt(delta, len(data))
+	delta = appendInt(delta, len(inst))
+	delta = appendInt(delta, len(addr))
+	delta = append(delta, checksum...)
+	delta = append(delta, data...)
+	delta = append(delta, inst...)
+	delta = append(delta, addr...)
+
+	buf := []byte{indicator}
+	for _, n := range segment {
+		buf = appendInt(buf, n)
+	}
+	buf = appendInt(buf, len(delta))
+	return append(buf, delta...)
+}
+
+func Test_Decode_Default_Code_Table(t *testing.T) {
+	source := []byte("abcdefghijklmnopqrstuvwxyz")
+	first := []byte("XabcdklmuvwxklmnZZZZZZZZZZZ")
+	second := []byte("abcd!!")
+
+	var inst, addr []byte
+	// ADD 1 + COPY 4, mode self: "X", "abcd".
+	inst = append(inst, 163)
+	addr = appendInt(addr, 0)
+	// COPY 3, mode here: "klm".
+	inst = appendInt(append(inst, 19+16), 3)
+	addr = appendInt(addr, 26+5-10)
+	// COPY 4, mode near 0: "uvwx".
+	inst = append(inst, 19+2*16+1)
+	addr = appendInt(addr, 20)
+	// COPY 4, mode same 0: "klmn".
+	inst = append(inst, 19+6*16+1)
+	addr = append(addr, 10)
+	// RUN 5: "ZZZZZ".
+	inst = appendInt(append(inst, 0), 5)
+	// COPY 6 overlapping itself in the target: "ZZZZZZ".
+	inst = appendInt(append(inst, 19), 6)
+	addr = appendInt(addr, 26+16)
+
+	var checksum [4]byte
+	binary.BigEndian.PutUint32(checksum[:], adler32.Checksum(first))
+
+	stream := append(append([]byte{}, magic[:]...), 0)
+	stream = append(stream, testWindow(vcdSource|vcdAdler32, []int{26, 0}, len(first), []byte("XZ"), inst, addr, checksum[:])...)
+	// Window copying from the target decoded so far.
+	stream = append(stream, testWindow(vcdTarget, []int{4, 1}, len(second), []byte("!!"), []byte{20, 3}, []byte{0}, nil)...)
+
+	src := rollingdiff.Signatures(source)
+	changes, err := Decode(bytes.NewReader(stream), src)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := rollingdiff.Apply(src, changes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if expected := concat(first, second); !bytes.Equal(result, expected) {
+		t.Fatalf("expected %q, got %q", expected, result)
+	}
+
+	// Damaged window checksum.
+	stream[len(magic)+1+5+4] ^= 0xff
+	if _, err := Decode(bytes.NewReader(stream), src); !errors.Is(err, ErrChecksum) {
+		t.Fatalf("expected ErrChecksum, got %v", err)
+	}
+}
+
+func Test_Decode_Rejects_Invalid_Streams(t *testing.T) {
+	testCases := []struct {
+		name   string
+		stream []byte
+		err    error
+	}{
+		{name: "bad magic", stream: []byte{0xd6, 0xc3, 0xc4, 0x01, 0}, err: ErrFormat},
+		{name: "secondary compression", stream: []byte{0xd6, 0xc3, 0xc4, 0x00, vcdDecompress, 1}, err: ErrUnsupported},
+		{name: "truncated window", stream: []byte{0xd6, 0xc3, 0xc4, 0x00, 0, 0, 10, 5}, err: ErrFormat},
+		{name: "copy without source", stream: append([]byte{0xd6, 0xc3, 0xc4, 0x00, 0}, testWindow(0, nil, 4, nil, []byte{20}, []byte{0}, nil)...), err: ErrFormat},
+	}
+
+	for i, tc := range testCases {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			t.Logf(tc.name)
+
+			if _, err := Decode(bytes.NewReader(tc.stream), nil); !errors.Is(err, tc.err) {
+				t.Fatalf("expected %v, got %v", tc.err, err)
+			}
+		})
+	}
+}
+
+func Test_nextWindow_Splits_Instructions(t *testing.T) {
+	ops := []op{
+		{typ: copyOp, addr: 100, size: MaxWindowSize - 10},
+		{typ: run, size: 30, data: []byte{1}},
+		{typ: copyOp, addr: 0, size: MaxWindowSize + 5},
+	}
+
+	var windows [][]op
+	for len(ops) > 0 {
+		var w []op
+		w, ops = nextWindow(ops)
+		windows = append(windows, w)
+	}
+
+	if len(windows) != 3 {
+		t.Fatalf("expected 3 windows, got %d", len(windows))
+	}
+
+	for i, w := range windows {
+		size := 0
+		for _, o := range w {
+			size += o.size
+		}
+		if size > MaxWindowSize {
+			t.Fatalf("window %d: expected at most %d bytes, got %d", i, MaxWindowSize, size)
+		}
+	}
+
+	if last := windows[2][0]; last.addr != MaxWindowSize-20 || last.size != 25 {
+		t.Fatalf("expected last copy of 25 bytes at %d, got %d at %d", MaxWindowSize-20, last.size, last.addr)
+	}
+}
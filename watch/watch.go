@@ -0,0 +1,197 @@
+// Package watch follows a file as it changes and emits a delta from the
+// previously emitted version each time, which makes a simple replication
+// log. The file is polled for changes of its size and modification time, so
+// a rewrite keeping both is not noticed. Changed data is found by comparing
+// CRC-32C checksums of regions of the file, so only those regions are chunked
+// and hashed again.
+package watch
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/tuommaki/rollingdiff/rollingdiff"
+)
+
+// regionSize is the size of regions of the file compared by checksum.
+const regionSize = 64 << 10
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// Version is a delta from the previously emitted version of the watched
+// file. The first version is computed against empty data.
+type Version struct {
+	// Seq numbers versions starting from 1.
+	Seq   int
+	Patch rollingdiff.Patch
+}
+
+// Watcher polls a file and emits deltas between its versions. Only chunk
+// signatures and region checksums of the last version are kept in memory.
+type Watcher struct {
+	path    string
+	chunker rollingdiff.Chunker
+
+	seq     int
+	polled  bool
+	size    int64
+	modTime time.Time
+	chunks  []rollingdiff.Chunk
+	sums    []uint32
+	// prevSize is the size of the last version.
+	prevSize int
+	digest   [sha256.Size]byte
+}
+
+// New returns a Watcher of the file at `path`, splitting it into chunks with
+// `chunker`.
+func New(path string, chunker rollingdiff.Chunker) *Watcher {
+	return &Watcher{
+		path:    path,
+		chunker: chunker,
+		digest:  sha256.Sum256(nil),
+	}
+}
+
+// Poll checks the file once. It returns the next version if the file has
+// changed since the last emitted version, or nil otherwise.
+func (w *Watcher) Poll() (*Version, error) {
+	fi, err := os.Stat(w.path)
+	if err != nil {
+		return nil, err
+	}
+
+	if w.polled && fi.Size() == w.size && fi.ModTime().Equal(w.modTime) {
+		return nil, nil
+	}
+
+	data, err := ioutil.ReadFile(w.path)
+	if err != nil {
+		return nil, err
+	}
+	w.polled = true
+	w.size, w.modTime = fi.Size(), fi.ModTime()
+
+	sums := regionSums(data)
+	chunks, changes := w.delta(data, sums)
+	if len(changes) == 0 && w.seq > 0 {
+		return nil, nil
+	}
+
+	w.seq++
+	v := &Version{
+		Seq: w.seq,
+		Patch: rollingdiff.Patch{
+			Base:    w.digest,
+			Result:  sha256.Sum256(data),
+			Changes: changes,
+		},
+	}
+
+	// Content is not needed to compute the next delta.
+	for i := range chunks {
+		chunks[i].Bytes = nil
+	}
+	w.chunks = chunks
+	w.sums = sums
+	w.prevSize = len(data)
+	w.digest = v.Patch.Result
+
+	return v, nil
+}
+
+// delta splits `data` into chunks and computes changes from the last
+// version, given checksums `sums` of its regions. Only regions modified
+// since the last version are re-chunked, and files that only grew are
+// re-chunked from the start of their last chunk.
+func (w *Watcher) delta(data []byte, sums []uint32) ([]rollingdiff.Chunk, []rollingdiff.Change) {
+	modified := w.modified(data, sums)
+
+	if w.seq > 0 && len(data) >= w.prevSize {
+		tail := 0
+		if len(w.chunks) > 0 {
+			tail = w.chunks[len(w.chunks)-1].Offset
+		}
+		if len(modified) == 0 || modified[0].Offset >= tail {
+			chunks, changes, err := w.chunker.AppendDeltaUnverified(w.chunks, w.prevSize, data)
+			if err == nil {
+				return chunks, changes
+			}
+		}
+	}
+
+	chunks := w.chunker.Rechunk(w.chunks, w.prevSize, data, modified)
+	return chunks, rollingdiff.Delta(w.chunks, chunks)
+}
+
+// modified returns regions of the last version whose content differs in
+// `data`, given checksums `sums` of regions of `data`.
+func (w *Watcher) modified(data []byte, sums []uint32) []rollingdiff.Range {
+	var ranges []rollingdiff.Range
+	for i, sum := range w.sums {
+		start, end := i*regionSize, (i+1)*regionSize
+		if end > w.prevSize {
+			end = w.prevSize
+		}
+
+		switch {
+		case end > len(data):
+			// Truncated data is re-chunked by Rechunk.
+			continue
+		case end-start < regionSize:
+			// The last region of the last version was shorter.
+			if crc32.Checksum(data[start:end], castagnoli) == sum {
+				continue
+			}
+		case sums[i] == sum:
+			continue
+		}
+		ranges = append(ranges, rollingdiff.Range{Offset: start, Length: end - start})
+	}
+	return ranges
+}
+
+// regionSums returns checksums of regions of `data`.
+func regionSums(data []byte) []uint32 {
+	sums := make([]uint32, 0, (len(data)+regionSize-1)/regionSize)
+	for start := 0; start < len(data); start += regionSize {
+		end := start + regionSize
+		if end > len(data) {
+			end = len(data)
+		}
+		sums = append(sums, crc32.Checksum(data[start:end], castagnoli))
+	}
+	return sums
+}
+
+// Run polls the file every `interval` and calls `emit` with each new
+// version, until `ctx` is done or an error occurs. A missing file, such as
+// one being rotated, is polled again.
+func (w *Watcher) Run(ctx context.Context, interval time.Duration, emit func(Version) error) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		v, err := w.Poll()
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+
+		if v != nil {
+			if err := emit(*v); err != nil {
+				return err
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,218 @@
+package watch
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/tuommaki/rollingdiff/fastcdc"
+	"github.com/tuommaki/rollingdiff/internal/testutil"
+	"github.com/tuommaki/rollingdiff/rollingdiff"
+)
+
+// writeFile writes `data` to `path` and moves its modification time
+// forward, so that the change is noticed regardless of timestamp
+// granularity.
+func writeFile(t *testing.T, path string, data []byte, seq int) {
+	t.Helper()
+
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	mtime := time.Unix(1000000000+int64(seq), 0)
+	if err := os.Chtimes(path, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// literalBytes returns the number of literal bytes carried by `changes`.
+func literalBytes(changes []rollingdiff.Change) int {
+	n := 0
+	for _, c := range changes {
+		n += len(c.Bytes)
+		for _, p := range c.Parts {
+			n += len(p.Bytes)
+		}
+	}
+	return n
+}
+
+func Test_Watcher_Emits_Deltas_Between_Versions(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "file")
+	data := testutil.RandomBytes(t, 1, 8*fastcdc.MaxSize)
+	writeFile(t, path, data, 1)
+
+	w := New(path, rollingdiff.Chunker{})
+
+	var replica []byte
+	apply := func(v *Version) {
+		t.Helper()
+
+		result, err := v.Patch.Apply(rollingdiff.Signatures(replica))
+		if err != nil {
+			t.Fatal(err)
+		}
+		replica = result
+	}
+
+	v, err := w.Poll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v == nil || v.Seq != 1 {
+		t.Fatalf("expected first version, got %+v", v)
+	}
+	apply(v)
+
+	if v, err := w.Poll(); err != nil || v != nil {
+		t.Fatalf("expected no version of unchanged file, got %+v, %v", v, err)
+	}
+
+	// Only the appended data is carried by the next delta.
+	appended := testutil.RandomBytes(t, 2, 1000)
+	data = append(data, appended...)
+	writeFile(t, path, data, 2)
+
+	v, err = w.Poll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v == nil || v.Seq != 2 {
+		t.Fatalf("expected second version, got %+v", v)
+	}
+
+	if n := literalBytes(v.Patch.Changes); n != len(appended) {
+		t.Fatalf("expected %d literal bytes, got %d", len(appended), n)
+	}
+	apply(v)
+
+	if !bytes.Equal(replica, data) {
+		t.Fatalf("expected replica to equal watched file")
+	}
+
+	// Data modified in place is not appended to, and only chunks around
+	// the modification are sent.
+	data[100] = ^data[100]
+	writeFile(t, path, data, 3)
+
+	v, err = w.Poll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v == nil || v.Seq != 3 {
+		t.Fatalf("expected third version, got %+v", v)
+	}
+	if n := literalBytes(v.Patch.Changes); n > 2*fastcdc.MaxSize {
+		t.Fatalf("expected at most %d literal bytes, got %d", 2*fastcdc.MaxSize, n)
+	}
+	apply(v)
+
+	if !bytes.Equal(replica, data) {
+		t.Fatalf("expected replica to equal watched file")
+	}
+
+	// Touching the file without changing its content emits nothing.
+	writeFile(t, path, data, 4)
+	if v, err := w.Poll(); err != nil || v != nil {
+		t.Fatalf("expected no version of touched file, got %+v, %v", v, err)
+	}
+}
+
+func Test_Watcher_Rechunks_Only_Modified_Regions(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "file")
+	data := testutil.RandomBytes(t, 1, 64*fastcdc.MaxSize)
+	writeFile(t, path, data, 1)
+
+	w := New(path, rollingdiff.Chunker{})
+	if _, err := w.Poll(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Signatures of chunks far from the modification are reused as they
+	// are, not computed again.
+	last := len(w.chunks) - 1
+	w.chunks[last].Signature = [sha256.Size]byte{}
+
+	data[100] = ^data[100]
+	writeFile(t, path, data, 2)
+
+	v, err := w.Poll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v == nil {
+		t.Fatalf("expected version of modified file")
+	}
+	if w.chunks[last].Signature != ([sha256.Size]byte{}) {
+		t.Fatalf("expected signature of unmodified last chunk to be reused")
+	}
+
+	// Truncated data is re-chunked at its end.
+	data = data[:len(data)/2]
+	writeFile(t, path, data, 3)
+	if _, err := w.Poll(); err != nil {
+		t.Fatal(err)
+	}
+	if expected := rollingdiff.Signatures(data); len(w.chunks) != len(expected) || w.chunks[len(w.chunks)-1].Signature != expected[len(expected)-1].Signature {
+		t.Fatalf("expected chunks of truncated data")
+	}
+}
+
+func Test_Watcher_Run_Waits_For_Missing_File(t *testing.T) {
+	dir := t.TempDir()
+	path, rotated := filepath.Join(dir, "file"), filepath.Join(dir, "file.new")
+	writeFile(t, rotated, testutil.RandomBytes(t, 1, 1000), 1)
+
+	// The file appears after a few polls, as when moved in place.
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		os.Rename(rotated, path)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	errStop := errors.New("stop")
+	err := New(path, rollingdiff.Chunker{}).Run(ctx, time.Millisecond, func(v Version) error {
+		return errStop
+	})
+	if !errors.Is(err, errStop) {
+		t.Fatalf("expected version once file exists, got %v", err)
+	}
+}
+
+func Test_Watcher_Run_Stops_On_Emit_Error(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "file")
+	writeFile(t, path, testutil.RandomBytes(t, 1, 1000), 1)
+
+	errStop := errors.New("stop")
+	emitted := 0
+	err := New(path, rollingdiff.Chunker{}).Run(context.Background(), time.Millisecond, func(v Version) error {
+		emitted++
+		return errStop
+	})
+
+	if !errors.Is(err, errStop) || emitted != 1 {
+		t.Fatalf("expected to stop after single version, got %d versions, %v", emitted, err)
+	}
+}
+
+func Test_Watcher_Run_Stops_When_Context_Is_Done(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "file")
+	writeFile(t, path, testutil.RandomBytes(t, 1, 1000), 1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	err := New(path, rollingdiff.Chunker{}).Run(ctx, time.Millisecond, func(v Version) error { return nil })
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+	}
+}